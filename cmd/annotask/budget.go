@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FailureBudget tracks failed tasks of a run and decides when to stop dispatching
+// A nil *FailureBudget means no budget: nothing is tracked and it is never exceeded
+type FailureBudget struct {
+	limit         int  // Maximum number of failed tasks allowed; the budget is exceeded when failures > limit
+	cancelRunning bool // Cancel in-flight tasks once the budget is exceeded
+	maxAttempts   int  // Attempts of a task in this run, a failure is only counted once they are used up
+
+	mu       sync.Mutex
+	failed   map[int]bool
+	attempts map[int]int // Failed attempts per task in this run
+	exceeded bool
+	done     chan struct{} // Closed when the budget is exceeded
+}
+
+// parseMaxFailures parses --max-failures value
+// Supports formats: "5" (number of failed tasks) and "10%" (percentage of tasks in this run)
+// Returns count (or -1 if a percentage was given) and percent
+func parseMaxFailures(s string) (int, float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, 0, fmt.Errorf("empty max-failures string")
+	}
+
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("invalid max-failures percentage: %s (expected 0%%-100%%)", s)
+		}
+		return -1, percent, nil
+	}
+
+	count, err := strconv.Atoi(s)
+	if err != nil || count < 0 {
+		return 0, 0, fmt.Errorf("invalid max-failures value: %s (expected a non-negative number or a percentage like 10%%)", s)
+	}
+	return count, 0, nil
+}
+
+// NewFailureBudget creates a failure budget for a run with total tasks to run
+// Returns nil if neither --fail-fast nor --max-failures was given
+// --fail-fast is equivalent to --max-failures 0 (stop after the first failure)
+// maxAttempts is the number of attempts of a task in this run: retry.max for qsubsge, 1 for local
+func NewFailureBudget(maxFailures string, failFast, cancelRunning bool, total, maxAttempts int) (*FailureBudget, error) {
+	limit := -1
+	if maxFailures != "" {
+		count, percent, err := parseMaxFailures(maxFailures)
+		if err != nil {
+			return nil, err
+		}
+		if count >= 0 {
+			limit = count
+		} else {
+			limit = int(math.Floor(float64(total) * percent / 100.0))
+		}
+	}
+	if failFast {
+		limit = 0
+	}
+	if limit < 0 {
+		return nil, nil
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	return &FailureBudget{
+		limit:         limit,
+		cancelRunning: cancelRunning,
+		maxAttempts:   maxAttempts,
+		failed:        make(map[int]bool),
+		attempts:      make(map[int]int),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// RecordFailure records a failed task and returns true if the budget is now exceeded
+// A task that fails several times (retries) is only counted once
+func (b *FailureBudget) RecordFailure(N int) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failed[N] = true
+	if !b.exceeded && len(b.failed) > b.limit {
+		b.exceeded = true
+		close(b.done)
+		log.Printf("Failure budget exceeded: %d task(s) failed (limit: %d), stop dispatching new tasks", len(b.failed), b.limit)
+	}
+	return b.exceeded
+}
+
+// CheckTask reads the status of task N from local database and records it if it failed with no attempts left
+// Attempts are counted here rather than read from the retry column, which keeps growing across runs of the input file
+func (b *FailureBudget) CheckTask(dbObj *MySql, N int) {
+	if b == nil {
+		return
+	}
+	var status string
+	err := dbObj.Db.QueryRow("SELECT status FROM job WHERE subJob_num=?", N).Scan(&status)
+	if err != nil {
+		log.Printf("Warning: Could not check status of task %d for failure budget: %v", N, err)
+		return
+	}
+	if status != string(J_failed) {
+		return
+	}
+	b.mu.Lock()
+	b.attempts[N]++
+	exhausted := b.attempts[N] >= b.maxAttempts
+	b.mu.Unlock()
+	if exhausted {
+		b.RecordFailure(N)
+	}
+}
+
+// Exceeded reports whether the budget has been exceeded
+func (b *FailureBudget) Exceeded() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exceeded
+}
+
+// Done returns a channel that is closed when the budget is exceeded
+// For a nil budget the channel is never closed
+func (b *FailureBudget) Done() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.done
+}
+
+// CancelRunning reports whether in-flight tasks should be cancelled once the budget is exceeded
+func (b *FailureBudget) CancelRunning() bool {
+	return b != nil && b.cancelRunning
+}
+
+// Summary returns failed count and limit for reporting
+func (b *FailureBudget) Summary() (failed, limit int) {
+	if b == nil {
+		return 0, -1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.failed), b.limit
+}
@@ -68,6 +68,8 @@ func LoadConfig() (*Config, error) {
 		}
 		// Merge executable config (only non-empty values)
 		mergeConfig(config, &exeConfig)
+		// Admins are only taken from executable config so that users can't grant themselves access
+		config.Admins = exeConfig.Admins
 	} else {
 		// Config file doesn't exist, create a default one
 		// Create a default config for executable directory
@@ -172,8 +174,12 @@ func mergeConfig(target, source *Config) {
 	if source.MonitorUpdateInterval > 0 {
 		target.MonitorUpdateInterval = source.MonitorUpdateInterval
 	}
+	mergeNotifyConfig(&target.Notify, &source.Notify)
+	target.Hooks = target.Hooks.Merge(source.Hooks)
+	mergeProfiles(&target.Profiles, source.Profiles)
 	// Db and SgeEnv are NOT merged here - they should always use executable directory config
 	// to ensure all annotask instances use the same global database and SGE environment
+	// Admins is NOT merged here either - it is only read from executable directory config
 }
 
 // EnsureUserConfig creates user home config file if it doesn't exist
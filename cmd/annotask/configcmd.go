@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/akamensky/argparse"
+	"gopkg.in/yaml.v3"
+)
+
+// parseConfigArgs parses the arguments of a config subcommand, printing the help of the config module on -h
+func parseConfigArgs(parser *argparse.Parser, args []string) bool {
+	parseArgs := append([]string{"annotask"}, args...)
+	if err := parser.Parse(parseArgs); err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "help") {
+			printModuleHelp("config", nil)
+			return false
+		}
+		fmt.Print(parser.Usage(err))
+		os.Exit(1)
+	}
+	return true
+}
+
+// mustLoadConfig loads the effective config for the config subcommands that report it
+func mustLoadConfig() *Config {
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v\nRun annotask config validate to find the problem", err)
+	}
+	return config
+}
+
+// configShow prints the effective config, with --effective one setting per line with its source
+// A profile and flags of local/qsubsge may be given to see the values a run with them would use
+func configShow(args []string) {
+	parser := argparse.NewParser("annotask config show", "Show the effective config")
+	opt_effective := parser.Flag("", "effective", &argparse.Options{Help: "Show each setting with its source: default, system, user, profile or flag"})
+	opt_secrets := parser.Flag("", "show-secrets", &argparse.Options{Help: "Show webhook URLs, which usually embed access tokens"})
+	opt_project := parser.String("", "project", &argparse.Options{Help: "Project name as given to local/qsubsge"})
+	opt_queue := parser.String("", "queue", &argparse.Options{Help: "Queue name(s) as given to qsubsge"})
+	opt_sge_project := parser.String("P", "sge-project", &argparse.Options{Help: "SGE project as given to qsubsge"})
+	opt_l := parser.Int("l", "line", &argparse.Options{Help: "Lines per task as given to local/qsubsge"})
+	opt_cpu := parser.Int("", "cpu", &argparse.Options{Help: "CPUs per task as given to qsubsge"})
+	parser.String("", "profile", &argparse.Options{Help: "Resource profile as given to local/qsubsge"})
+	if !parseConfigArgs(parser, args) {
+		return
+	}
+	config := mustLoadConfig()
+
+	overrides := make(map[string]string)
+	profile, err := selectProfile(config, args)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if profile != nil {
+		for _, key := range profile.ConfigKeys() {
+			overrides[key] = SourceProfile + ":" + profileArg(args)
+		}
+	}
+	if *opt_project != "" {
+		config.Project, overrides["project"] = *opt_project, SourceFlag
+	}
+	if *opt_queue != "" {
+		config.Queue, overrides["queue"] = *opt_queue, SourceFlag
+	}
+	if *opt_sge_project != "" {
+		config.SgeProject, overrides["sge_project"] = *opt_sge_project, SourceFlag
+	}
+	if *opt_l > 0 {
+		config.Defaults.Line, overrides["defaults.line"] = *opt_l, SourceFlag
+	}
+	if *opt_cpu > 0 {
+		config.Defaults.CPU, overrides["defaults.cpu"] = *opt_cpu, SourceFlag
+	}
+
+	if !*opt_effective {
+		if len(overrides) > 0 {
+			log.Fatalf("Error: --profile and flags of local/qsubsge are only used with --effective")
+		}
+		data, err := yaml.Marshal(config)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		fmt.Print(string(data))
+		return
+	}
+
+	systemPath, userPath, err := configPaths()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	systemValues, err := readConfigValues(systemPath)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	userValues, err := readConfigValues(userPath)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	values, err := configValues(config, systemValues, userValues, overrides)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	writeConfigValues(os.Stdout, values, "", *opt_secrets)
+}
+
+// configGet prints the effective value of a key, or of all the settings under it (notify)
+func configGet(args []string) {
+	parser := argparse.NewParser("annotask config get", "Print the effective value of a key")
+	opt_key := parser.StringPositional(&argparse.Options{Required: true, Help: "Key, with dots for nested keys: retry.max"})
+	if !parseConfigArgs(parser, args) {
+		return
+	}
+	if _, ok := configField(*opt_key); !ok {
+		log.Fatalf("Error: unknown key %s", *opt_key)
+	}
+	values, err := loadConfigValues(mustLoadConfig())
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	for _, v := range values {
+		if v.Key == *opt_key {
+			fmt.Println(v.Value)
+			return
+		}
+	}
+	// A mapping like notify, or a setting left out because it is empty
+	for _, v := range values {
+		if strings.HasPrefix(v.Key, *opt_key+".") {
+			fmt.Printf("%s: %s\n", v.Key, v.Value)
+		}
+	}
+}
+
+// configSet sets a key in the user config, or in the system config with --system
+func configSet(args []string) {
+	parser := argparse.NewParser("annotask config set", "Set a key in the user config")
+	opt_key := parser.StringPositional(&argparse.Options{Required: true, Help: "Key, with dots for nested keys: retry.max"})
+	opt_value := parser.StringPositional(&argparse.Options{Required: true, Help: "Value, as YAML: lists are written as [a, b]"})
+	opt_system := parser.Flag("", "system", &argparse.Options{Help: "Set the key in the system config (next to the annotask executable)"})
+	if !parseConfigArgs(parser, args) {
+		return
+	}
+	systemPath, userPath, err := configPaths()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	path := userPath
+	if *opt_system {
+		path = systemPath
+	} else if systemOnlyKeys[strings.Split(*opt_key, ".")[0]] {
+		log.Fatalf("Error: %s is only read from the system config %s, set it there with --system", *opt_key, systemPath)
+	}
+	if err := setConfigValue(path, *opt_key, *opt_value); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	log.Printf("Set %s in %s", *opt_key, path)
+}
+
+// configValidate checks the config files for unknown keys and values of the wrong type
+func configValidate(args []string) {
+	parser := argparse.NewParser("annotask config validate", "Check the config files for unknown keys and values of the wrong type")
+	opt_file := parser.StringPositional(&argparse.Options{Help: "Config file to check (default: the system and user config)"})
+	if !parseConfigArgs(parser, args) {
+		return
+	}
+	systemPath, userPath, err := configPaths()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	files := []struct {
+		path   string
+		system bool
+	}{{systemPath, true}, {userPath, false}}
+	if *opt_file != "" {
+		files = files[:0]
+		files = append(files, struct {
+			path   string
+			system bool
+		}{*opt_file, *opt_file == systemPath})
+	}
+
+	failed := false
+	for _, file := range files {
+		if _, err := os.Stat(file.path); err != nil && *opt_file == "" {
+			continue
+		}
+		problems, warnings, err := validateConfigFile(file.path, file.system)
+		if err != nil {
+			fmt.Printf("%s: %v\n", file.path, err)
+			failed = true
+			continue
+		}
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", file.path, problem)
+		}
+		for _, warning := range warnings {
+			fmt.Printf("%s: %s (warning)\n", file.path, warning)
+		}
+		if len(problems) > 0 {
+			failed = true
+		} else if len(warnings) == 0 {
+			fmt.Printf("%s: ok\n", file.path)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// configPath prints the paths of the system and user config
+func configPath(args []string) {
+	parser := argparse.NewParser("annotask config path", "Print the paths of the config files")
+	if !parseConfigArgs(parser, args) {
+		return
+	}
+	systemPath, userPath, err := configPaths()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	for _, file := range []struct{ label, path string }{{SourceSystem, systemPath}, {SourceUser, userPath}} {
+		state := ""
+		if _, err := os.Stat(file.path); err != nil {
+			state = " (not found)"
+		}
+		fmt.Printf("%-7s %s%s\n", file.label, file.path, state)
+	}
+}
+
+// RunConfigModule runs the config module
+// It loads the config itself, so that a config file LoadConfig fails on can still be validated and fixed
+func RunConfigModule(args []string) {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" {
+		printModuleHelp("config", nil)
+		return
+	}
+	switch args[0] {
+	case "show":
+		configShow(args[1:])
+	case "get":
+		configGet(args[1:])
+	case "set":
+		configSet(args[1:])
+	case "validate":
+		configValidate(args[1:])
+	case "path":
+		configPath(args[1:])
+	default:
+		fmt.Printf("Error: unknown config command %q\n\n", args[0])
+		printModuleHelp("config", nil)
+		os.Exit(1)
+	}
+}
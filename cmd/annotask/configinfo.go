@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of configuration values, in increasing precedence
+const (
+	SourceDefault = "default"
+	SourceSystem  = "system"
+	SourceUser    = "user"
+	SourceProfile = "profile"
+	SourceFlag    = "flag"
+)
+
+// systemOnlyKeys are only read from the system config, LoadConfig ignores them in the user config
+var systemOnlyKeys = map[string]bool{"db": true, "sgeenv": true, "admins": true}
+
+// ConfigValue is a setting of the effective configuration, keyed like annotask.yaml with dots for nesting (retry.max)
+type ConfigValue struct {
+	Key    string
+	Value  string // YAML, lists and maps in flow style
+	Source string
+}
+
+// configPaths returns the paths of the system config (next to the executable) and the user config
+func configPaths() (systemPath, userPath string, err error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get current user: %v", err)
+	}
+	return filepath.Join(filepath.Dir(exePath), "annotask.yaml"), filepath.Join(usr.HomeDir, ".annotask", "annotask.yaml"), nil
+}
+
+// readConfigValues reads the values set in a config file, nil if the file doesn't exist
+func readConfigValues(path string) (map[string]*yaml.Node, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	values := make(map[string]*yaml.Node)
+	if len(doc.Content) > 0 {
+		flattenYAML(&doc, "", func(key string, value *yaml.Node) {
+			values[key] = value
+		})
+	}
+	return values, nil
+}
+
+// flattenYAML calls fn for each leaf of a YAML mapping in document order, with dotted keys
+// Lists are leaves, like in mergeConfig where a list replaces the lower-precedence list
+func flattenYAML(node *yaml.Node, prefix string, fn func(key string, value *yaml.Node)) {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		fn(prefix, node)
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		flattenYAML(node.Content[i+1], key, fn)
+	}
+}
+
+// isEmptyYAML checks if a value counts as unset: mergeConfig only merges non-empty strings, positive numbers and non-empty lists
+func isEmptyYAML(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Tag == "!!null" || node.Value == "" || node.Tag == "!!int" && strings.TrimLeft(node.Value, "0") == ""
+	case yaml.SequenceNode, yaml.MappingNode:
+		return len(node.Content) == 0
+	}
+	return false
+}
+
+// formatYAMLValue formats a value on one line
+func formatYAMLValue(node *yaml.Node) string {
+	if node.Kind == yaml.ScalarNode {
+		return node.Value
+	}
+	flow := *node
+	flow.Style = yaml.FlowStyle
+	data, err := yaml.Marshal(&flow)
+	if err != nil {
+		return "?"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// configValues returns the settings of the effective configuration with the source of each value
+// systemValues and userValues are the values set in the config files (see readConfigValues),
+// overrides the sources of keys overridden by a profile or command-line flags
+func configValues(config *Config, systemValues, userValues map[string]*yaml.Node, overrides map[string]string) ([]ConfigValue, error) {
+	var doc yaml.Node
+	if err := doc.Encode(config); err != nil {
+		return nil, err
+	}
+	var values []ConfigValue
+	flattenYAML(&doc, "", func(key string, value *yaml.Node) {
+		source := SourceDefault
+		switch {
+		case overrides[key] != "":
+			source = overrides[key]
+		case userValues[key] != nil && !isEmptyYAML(userValues[key]) && !systemOnlyKeys[key]:
+			source = SourceUser
+		case systemValues[key] != nil && !isEmptyYAML(systemValues[key]):
+			source = SourceSystem
+		}
+		values = append(values, ConfigValue{Key: key, Value: formatYAMLValue(value), Source: source})
+	})
+	return values, nil
+}
+
+// loadConfigValues returns the settings of the effective configuration with their sources, read from the config files
+func loadConfigValues(config *Config) ([]ConfigValue, error) {
+	systemPath, userPath, err := configPaths()
+	if err != nil {
+		return nil, err
+	}
+	systemValues, err := readConfigValues(systemPath)
+	if err != nil {
+		return nil, err
+	}
+	userValues, err := readConfigValues(userPath)
+	if err != nil {
+		return nil, err
+	}
+	return configValues(config, systemValues, userValues, nil)
+}
+
+// writeConfigValues writes the settings as a table of key, value and source
+// Webhook URLs usually embed access tokens and are hidden unless showSecrets is set
+func writeConfigValues(out io.Writer, values []ConfigValue, indent string, showSecrets bool) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%skey\tvalue\tsource\n", indent)
+	for _, v := range values {
+		value := v.Value
+		if !showSecrets && strings.HasPrefix(v.Key, "notify.webhooks") && value != "" && value != "[]" {
+			value = "(hidden)"
+		}
+		fmt.Fprintf(tw, "%s%s\t%s\t%s\n", indent, v.Key, orDash(value), v.Source)
+	}
+	return tw.Flush()
+}
+
+var yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// yamlFields returns the fields of a config struct by their annotask.yaml key
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i)
+		}
+	}
+	return fields
+}
+
+// isConfigStruct checks if values of type t are mappings whose keys are checked one by one
+func isConfigStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !reflect.PointerTo(t).Implements(yamlUnmarshalerType)
+}
+
+// configField returns the type of a config key (retry.max), false if annotask.yaml has no such key
+func configField(key string) (reflect.Type, bool) {
+	t := reflect.TypeOf(Config{})
+	for _, name := range strings.Split(key, ".") {
+		switch {
+		case isConfigStruct(t):
+			field, ok := yamlFields(t)[name]
+			if !ok {
+				return nil, false
+			}
+			t = field.Type
+		case t.Kind() == reflect.Map:
+			t = t.Elem()
+		default:
+			return nil, false
+		}
+	}
+	return t, true
+}
+
+// joinKey joins a config key and the key of a nested value
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// suggestKey returns the key of struct type t closest to a mistyped key, empty if none is close
+func suggestKey(t reflect.Type, key string) string {
+	best, bestDist := "", 3
+	for name := range yamlFields(t) {
+		if d := editDistance(strings.ToLower(key), name); d < bestDist || d == bestDist && name < best {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance of two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// describeType describes the values a config setting of type t takes
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64:
+		return "an integer"
+	case reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			return "a list of strings"
+		}
+		return "a list"
+	}
+	return "a mapping"
+}
+
+// validateConfigNode checks a config value against type t, returning its unknown keys and values of the wrong type
+// yaml.Unmarshal silently ignores unknown keys, so a mistyped key would otherwise go unnoticed
+func validateConfigNode(node *yaml.Node, t reflect.Type, key string) []string {
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return nil
+		}
+		node = node.Content[0]
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return nil
+	}
+	var problems []string
+	switch {
+	case isConfigStruct(t) && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i].Value
+			field, ok := fields[name]
+			if !ok {
+				problem := fmt.Sprintf("line %d: unknown key %s", node.Content[i].Line, joinKey(key, name))
+				if suggestion := suggestKey(t, name); suggestion != "" {
+					problem += fmt.Sprintf(" (did you mean %s?)", joinKey(key, suggestion))
+				}
+				problems = append(problems, problem)
+				continue
+			}
+			problems = append(problems, validateConfigNode(node.Content[i+1], field.Type, joinKey(key, name))...)
+		}
+		return problems
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			problems = append(problems, validateConfigNode(node.Content[i+1], t.Elem(), joinKey(key, node.Content[i].Value))...)
+		}
+		return problems
+	case t.Kind() == reflect.Slice && isConfigStruct(t.Elem()) && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			problems = append(problems, validateConfigNode(item, t.Elem(), fmt.Sprintf("%s[%d]", key, i))...)
+		}
+		return problems
+	}
+	if err := node.Decode(reflect.New(t).Interface()); err != nil {
+		return []string{fmt.Sprintf("line %d: %s: %s is not %s", node.Line, key, formatYAMLValue(node), describeType(t))}
+	}
+	return nil
+}
+
+// validateConfigFile checks a config file for unknown keys and values of the wrong type
+// warnings are settings that are valid but ignored, like db in the user config
+func validateConfigFile(path string, system bool) (problems, warnings []string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		if root.Tag == "!!null" {
+			return nil, nil, nil
+		}
+		return []string{fmt.Sprintf("line %d: the config must be a mapping of keys to values", root.Line)}, nil, nil
+	}
+	problems = validateConfigNode(&doc, reflect.TypeOf(Config{}), "")
+	if len(problems) == 0 {
+		var config Config
+		if err := doc.Decode(&config); err == nil {
+			for name, p := range config.Profiles {
+				if err := p.Validate(); err != nil {
+					problems = append(problems, fmt.Sprintf("profiles.%s.%v", name, err))
+				}
+			}
+			sort.Strings(problems)
+		}
+	}
+	if !system {
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if key := root.Content[i].Value; systemOnlyKeys[key] {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s is only read from the system config, it is ignored here", root.Content[i].Line, key))
+			}
+		}
+	}
+	return problems, warnings, nil
+}
+
+// setConfigValue sets a key of a config file to value, parsed as YAML
+// The file is edited as a YAML tree, keeping its comments and the order of the other keys
+func setConfigValue(path, key, value string) error {
+	t, ok := configField(key)
+	if !ok {
+		return fmt.Errorf("unknown key %s", key)
+	}
+	valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: ""}
+	if value != "" {
+		var valueDoc yaml.Node
+		if err := yaml.Unmarshal([]byte(value), &valueDoc); err != nil {
+			return fmt.Errorf("invalid value %q: %v", value, err)
+		}
+		if len(valueDoc.Content) > 0 {
+			valueNode = valueDoc.Content[0]
+		}
+	}
+	if problems := validateConfigNode(valueNode, t, key); len(problems) > 0 {
+		return fmt.Errorf("%s", strings.TrimPrefix(problems[0], "line 1: "))
+	}
+
+	var doc yaml.Node
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if doc.Content[0].Kind == yaml.ScalarNode && doc.Content[0].Tag == "!!null" {
+		doc.Content[0] = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", HeadComment: doc.Content[0].HeadComment}
+	}
+	mapping := doc.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s is not a mapping of keys to values", path)
+	}
+
+	names := strings.Split(key, ".")
+	for i, name := range names {
+		last := i == len(names)-1
+		index := -1
+		for j := 0; j+1 < len(mapping.Content); j += 2 {
+			if mapping.Content[j].Value == name {
+				index = j + 1
+			}
+		}
+		if index < 0 {
+			child := valueNode
+			if !last {
+				child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, child)
+			mapping = child
+			continue
+		}
+		old := mapping.Content[index]
+		if last || old.Kind != yaml.MappingNode {
+			child := valueNode
+			if !last {
+				child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			child.HeadComment, child.LineComment, child.FootComment = old.HeadComment, old.LineComment, old.FootComment
+			mapping.Content[index] = child
+			mapping = child
+			continue
+		}
+		mapping = old
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(yamlIndent(data))
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	data = out.Bytes()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// yamlIndent returns the indentation of nested keys in a YAML file, 4 (as written by yaml.Marshal) if it has none
+func yamlIndent(data []byte) int {
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if indent := len(line) - len(trimmed); indent > 0 && trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			return indent
+		}
+	}
+	return 4
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Markers used to find the output of the last attempt in .o/.e files
+// Local mode appends every attempt to the same .o/.e files
+const (
+	// Written by the generated script to stdout (see GenerateShell)
+	scriptStartMarker = "========== start at :"
+	// Written by RunCommand to stderr before each attempt
+	attemptStartMarker = "========== annotask attempt start at :"
+)
+
+// maxLogScanBytes limits how much of a .o/.e file is scanned for patterns (the tail is used)
+const maxLogScanBytes = 16 * 1024 * 1024
+
+// SuccessCriteria defines extra checks a task must pass to be considered successful,
+// in addition to the .sign file written by the generated script
+type SuccessCriteria struct {
+	// Files (or glob patterns) that must exist and be non-empty
+	RequireOutputs []string `json:"require_outputs,omitempty"`
+	// Exit codes treated as success (default: only 0)
+	OkExitCodes []int `json:"ok_exit_codes,omitempty"`
+	// Regexes that must appear in the task's .o or .e output
+	RequirePatterns []string `json:"require_patterns,omitempty"`
+	// Regexes that must not appear in the task's .o or .e output
+	RejectPatterns []string `json:"reject_patterns,omitempty"`
+}
+
+// newSuccessCriteria builds run-level criteria from command line flags
+// Returns nil if no criteria flag was given
+func newSuccessCriteria(outputs []string, okExitCodes string, requirePatterns, rejectPatterns []string) (*SuccessCriteria, error) {
+	criteria := &SuccessCriteria{}
+	for _, output := range outputs {
+		criteria.RequireOutputs = append(criteria.RequireOutputs, splitList(output)...)
+	}
+	if okExitCodes != "" {
+		codes, err := parseExitCodes(okExitCodes)
+		if err != nil {
+			return nil, err
+		}
+		criteria.OkExitCodes = codes
+	}
+	criteria.RequirePatterns = append(criteria.RequirePatterns, requirePatterns...)
+	criteria.RejectPatterns = append(criteria.RejectPatterns, rejectPatterns...)
+
+	if err := criteria.Validate(); err != nil {
+		return nil, err
+	}
+	if criteria.IsEmpty() {
+		return nil, nil
+	}
+	return criteria, nil
+}
+
+// IsEmpty reports whether no check is defined
+func (c *SuccessCriteria) IsEmpty() bool {
+	return c == nil || (len(c.RequireOutputs) == 0 && len(c.OkExitCodes) == 0 &&
+		len(c.RequirePatterns) == 0 && len(c.RejectPatterns) == 0)
+}
+
+// Validate checks that all regexes compile
+func (c *SuccessCriteria) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, pattern := range append(append([]string{}, c.RequirePatterns...), c.RejectPatterns...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Merge combines run-level criteria with per-task criteria
+// Outputs and patterns are added up, per-task exit codes replace run-level exit codes
+func (c *SuccessCriteria) Merge(task SuccessCriteria) SuccessCriteria {
+	var merged SuccessCriteria
+	if c != nil {
+		merged.RequireOutputs = append(merged.RequireOutputs, c.RequireOutputs...)
+		merged.OkExitCodes = append(merged.OkExitCodes, c.OkExitCodes...)
+		merged.RequirePatterns = append(merged.RequirePatterns, c.RequirePatterns...)
+		merged.RejectPatterns = append(merged.RejectPatterns, c.RejectPatterns...)
+	}
+	merged.RequireOutputs = append(merged.RequireOutputs, task.RequireOutputs...)
+	if len(task.OkExitCodes) > 0 {
+		merged.OkExitCodes = append([]int{}, task.OkExitCodes...)
+	}
+	merged.RequirePatterns = append(merged.RequirePatterns, task.RequirePatterns...)
+	merged.RejectPatterns = append(merged.RejectPatterns, task.RejectPatterns...)
+	return merged
+}
+
+// ExitCodeOK reports whether exit code counts as success
+func (c *SuccessCriteria) ExitCodeOK(exitCode int) bool {
+	if c == nil || len(c.OkExitCodes) == 0 {
+		return exitCode == 0
+	}
+	for _, code := range c.OkExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Check runs output file and log pattern checks
+// Relative output paths are resolved against workDir (current directory if empty)
+// Returns an empty string if all checks pass, otherwise the reason of the first failed check
+func (c *SuccessCriteria) Check(workDir, outFile, errFile string) string {
+	if c.IsEmpty() {
+		return ""
+	}
+	if reason := c.checkOutputs(workDir); reason != "" {
+		return reason
+	}
+	return c.checkLogs(outFile, errFile)
+}
+
+// checkOutputs checks that every required output exists and is non-empty
+func (c *SuccessCriteria) checkOutputs(workDir string) string {
+	for _, output := range c.RequireOutputs {
+		pattern := output
+		if workDir != "" && !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(workDir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			return fmt.Sprintf("required output missing: %s", output)
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return fmt.Sprintf("required output missing: %s", match)
+			}
+			if info.IsDir() {
+				entries, err := os.ReadDir(match)
+				if err != nil || len(entries) == 0 {
+					return fmt.Sprintf("required output is empty: %s", match)
+				}
+			} else if info.Size() == 0 {
+				return fmt.Sprintf("required output is empty: %s", match)
+			}
+		}
+	}
+	return ""
+}
+
+// checkLogs checks require/reject patterns against the last attempt's .o and .e output
+func (c *SuccessCriteria) checkLogs(outFile, errFile string) string {
+	if len(c.RequirePatterns) == 0 && len(c.RejectPatterns) == 0 {
+		return ""
+	}
+	output := lastAttemptOutput(outFile) + "\n" + lastAttemptOutput(errFile)
+
+	for _, pattern := range c.RejectPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			continue // Validated on load
+		}
+		if match := re.FindString(output); match != "" {
+			return fmt.Sprintf("rejected pattern %q found in output: %s", pattern, strings.TrimSpace(match))
+		}
+	}
+	for _, pattern := range c.RequirePatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			continue
+		}
+		if !re.MatchString(output) {
+			return fmt.Sprintf("required pattern %q not found in output", pattern)
+		}
+	}
+	return ""
+}
+
+// lastAttemptOutput returns the content of a .o/.e file written by the last attempt
+// Content before the last start marker belongs to earlier attempts and is dropped
+// Returns an empty string if the file doesn't exist
+func lastAttemptOutput(path string) string {
+	if path == "" {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// Only read the tail of very large files
+	if info, err := f.Stat(); err == nil && info.Size() > maxLogScanBytes {
+		f.Seek(info.Size()-maxLogScanBytes, io.SeekStart)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return ""
+	}
+	content := string(data)
+
+	start := strings.LastIndex(content, attemptStartMarker)
+	if idx := strings.LastIndex(content, scriptStartMarker); idx > start {
+		start = idx
+	}
+	if start >= 0 {
+		content = content[start:]
+	}
+	return content
+}
+
+// findSGELogFile returns the path of an SGE output file for a job
+// stream is "o" or "e". SGE generates output files in different formats depending on version:
+// - Format 1: {job_name}.o.{jobID} (with dot separator)
+// - Format 2: {job_name}.o{jobID} (without dot separator)
+// Returns Format 1 if neither exists
+func findSGELogFile(subShellPath, stream, jobID string) string {
+	subShellDir := filepath.Dir(subShellPath)
+	subShellBase := filepath.Base(subShellPath)
+	logFile := filepath.Join(subShellDir, fmt.Sprintf("%s.%s.%s", subShellBase, stream, jobID))
+	if _, err := os.Stat(logFile); os.IsNotExist(err) {
+		logFileAlt := filepath.Join(subShellDir, fmt.Sprintf("%s.%s%s", subShellBase, stream, jobID))
+		if _, err := os.Stat(logFileAlt); err == nil {
+			logFile = logFileAlt
+		}
+	}
+	return logFile
+}
+
+// taskLogFiles returns the .o/.e files of the last attempt of a task based on its mode and taskid
+func taskLogFiles(subShellPath, mode, taskid string) (string, string) {
+	if mode == string(ModeQsubSge) {
+		if taskid == "" {
+			return "", ""
+		}
+		return findSGELogFile(subShellPath, "o", taskid), findSGELogFile(subShellPath, "e", taskid)
+	}
+	return subShellPath + ".o", subShellPath + ".e"
+}
+
+// writeSignFile writes the .sign file for a task judged successful by criteria
+// (e.g. exit code allowed by ok_exit_codes, where the generated script didn't write it)
+func writeSignFile(subShellPath string) error {
+	return os.WriteFile(subShellPath+".sign", []byte("LLAP\n"), 0644)
+}
+
+// removeSignFile removes a stale .sign file for a task that failed its criteria
+// so that the .sign file stays the source of truth on rerun
+func removeSignFile(subShellPath string) {
+	if err := os.Remove(subShellPath + ".sign"); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not remove %s.sign: %v", subShellPath, err)
+	}
+}
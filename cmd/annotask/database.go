@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -40,26 +41,7 @@ func InitGlobalDB(dbPath string) (*GlobalDB, error) {
 	globalDB := &GlobalDB{Db: conn}
 
 	// Create table
-	sql_table := `
-	CREATE TABLE IF NOT EXISTS tasks(
-		Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-		usrID TEXT NOT NULL,
-		project TEXT NOT NULL,
-		module TEXT NOT NULL,
-		mode TEXT NOT NULL,
-		starttime datetime NOT NULL,
-		endtime datetime,
-		shellPath TEXT NOT NULL,
-		totalTasks integer DEFAULT 0,
-		pendingTasks integer DEFAULT 0,
-		failedTasks integer DEFAULT 0,
-		runningTasks integer DEFAULT 0,
-		finishedTasks integer DEFAULT 0,
-		status TEXT DEFAULT 'running',
-		node TEXT,
-		UNIQUE(usrID, project, module, starttime)
-	);
-	`
+	sql_table := fmt.Sprintf(globalTasksTable, "tasks")
 	_, err = conn.Exec(sql_table)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create table: %v", err)
@@ -105,14 +87,150 @@ func InitGlobalDB(dbPath string) (*GlobalDB, error) {
 		}
 	}
 
-	_, err = conn.Exec(sql_table)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create table: %v", err)
+	// Migrate: add usage columns if they don't exist
+	for _, colName := range []string{"cpuHours", "memHours"} {
+		var exists bool
+		err = conn.QueryRow("SELECT COUNT(*) FROM pragma_table_info('tasks') WHERE name=?", colName).Scan(&exists)
+		if err == nil && !exists {
+			_, err = conn.Exec(fmt.Sprintf("ALTER TABLE tasks ADD COLUMN %s REAL DEFAULT 0", colName))
+			if err != nil {
+				log.Printf("Warning: Could not add %s column: %v", colName, err)
+			}
+		}
+	}
+
+	// Migrate: add command, workdir and params columns if they don't exist
+	for _, colName := range []string{"command", "workdir", "params"} {
+		var exists bool
+		err = conn.QueryRow("SELECT COUNT(*) FROM pragma_table_info('tasks') WHERE name=?", colName).Scan(&exists)
+		if err == nil && !exists {
+			_, err = conn.Exec(fmt.Sprintf("ALTER TABLE tasks ADD COLUMN %s TEXT", colName))
+			if err != nil {
+				log.Printf("Warning: Could not add %s column: %v", colName, err)
+			}
+		}
+	}
+
+	// Migrate: key runs by a generated run ID instead of UNIQUE(usrID, project, module, starttime)
+	if err := migrateRunIDs(conn); err != nil {
+		log.Printf("Warning: Could not migrate tasks table to run IDs: %v", err)
 	}
 
 	return globalDB, nil
 }
 
+// globalTasksTable is the schema of the global tasks table, %s is the table name
+// Each run is identified by runID (a ULID), also recorded in the runs table of its local database
+const globalTasksTable = `
+	CREATE TABLE IF NOT EXISTS %s(
+		Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		runID TEXT UNIQUE,
+		usrID TEXT NOT NULL,
+		project TEXT NOT NULL,
+		module TEXT NOT NULL,
+		mode TEXT NOT NULL,
+		starttime datetime NOT NULL,
+		endtime datetime,
+		shellPath TEXT NOT NULL,
+		totalTasks integer DEFAULT 0,
+		pendingTasks integer DEFAULT 0,
+		failedTasks integer DEFAULT 0,
+		runningTasks integer DEFAULT 0,
+		finishedTasks integer DEFAULT 0,
+		status TEXT DEFAULT 'running',
+		node TEXT,
+		pid INTEGER,
+		cpuHours REAL DEFAULT 0,
+		memHours REAL DEFAULT 0,
+		command TEXT,
+		workdir TEXT,
+		params TEXT
+	);
+	`
+
+// migrateRunIDs rebuilds a tasks table created with UNIQUE(usrID, project, module, starttime),
+// which made runs started in the same second overwrite each other, and assigns run IDs to old runs
+func migrateRunIDs(conn *sql.DB) error {
+	var schema string
+	if err := conn.QueryRow("SELECT sql FROM sqlite_master WHERE type='table' AND name='tasks'").Scan(&schema); err != nil {
+		return err
+	}
+	var runIDExists bool
+	if err := conn.QueryRow("SELECT COUNT(*) FROM pragma_table_info('tasks') WHERE name='runID'").Scan(&runIDExists); err != nil {
+		return err
+	}
+
+	if !runIDExists || strings.Contains(strings.ReplaceAll(schema, " ", ""), "UNIQUE(usrID,project,module,starttime)") {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("DROP TABLE IF EXISTS tasks_new"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(globalTasksTable, "tasks_new")); err != nil {
+			return err
+		}
+		// Copy the columns both tables have
+		rows, err := tx.Query("SELECT name FROM pragma_table_info('tasks') WHERE name IN (SELECT name FROM pragma_table_info('tasks_new'))")
+		if err != nil {
+			return err
+		}
+		var columns []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			columns = append(columns, name)
+		}
+		rows.Close()
+		columnList := strings.Join(columns, ", ")
+		for _, stmt := range []string{
+			fmt.Sprintf("INSERT INTO tasks_new(%s) SELECT %s FROM tasks", columnList, columnList),
+			"DROP TABLE tasks",
+			"ALTER TABLE tasks_new RENAME TO tasks",
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Migrated tasks table of the global database to run IDs")
+	}
+
+	// Runs recorded by older versions get a run ID from their start time
+	rows, err := conn.Query("SELECT Id, starttime FROM tasks WHERE runID IS NULL")
+	if err != nil {
+		return err
+	}
+	ids := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var starttime string
+		if err := rows.Scan(&id, &starttime); err != nil {
+			rows.Close()
+			return err
+		}
+		t, ok := parseDBTime(starttime)
+		if !ok {
+			t = time.Now()
+		}
+		ids[id] = newRunID(t)
+	}
+	rows.Close()
+	for id, runID := range ids {
+		if _, err := conn.Exec("UPDATE tasks SET runID=? WHERE Id=? AND runID IS NULL", runID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (sqObj *MySql) Crt_tb() {
 	// create table if not exists
 	// First, check if old table exists and migrate
@@ -133,13 +251,42 @@ func (sqObj *MySql) Crt_tb() {
 		mem integer DEFAULT 1,
 		h_vmem integer DEFAULT 1,
 		taskid TEXT,
-		node TEXT
+		node TEXT,
+		h_rt integer DEFAULT 0,
+		directives TEXT,
+		reason TEXT,
+		cmdHash TEXT,
+		doneHash TEXT,
+		cpuTime REAL DEFAULT 0,
+		memTime REAL DEFAULT 0
 	);
 	`
 	_, err := sqObj.Db.Exec(sql_job_table)
 	if err != nil {
 		panic(err)
 	}
+
+	// Runs of this input file, linking the local database to the records of the global database
+	sql_runs_table := `
+	CREATE TABLE IF NOT EXISTS runs(
+		runID TEXT NOT NULL PRIMARY KEY,
+		starttime datetime NOT NULL,
+		mode TEXT,
+		node TEXT,
+		pid integer
+	);
+	`
+	_, err = sqObj.Db.Exec(sql_runs_table)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RecordLocalRun records a run of this input file in the runs table
+func (sqObj *MySql) RecordLocalRun(runID string, startTime time.Time, mode JobMode, node string, pid int) error {
+	_, err := sqObj.Db.Exec("INSERT INTO runs(runID, starttime, mode, node, pid) VALUES(?, ?, ?, ?, ?)",
+		runID, startTime.Format("2006-01-02 15:04:05"), string(mode), node, pid)
+	return err
 }
 
 func (sqObj *MySql) migrateTable() {
@@ -167,6 +314,13 @@ func (sqObj *MySql) migrateTable() {
 		"h_vmem": "integer DEFAULT 1",
 		"taskid": "TEXT",
 		"node":   "TEXT",
+		"h_rt":   "integer DEFAULT 0",
+		"directives": "TEXT",
+		"reason":     "TEXT",
+		"cmdHash":    "TEXT",
+		"doneHash":   "TEXT",
+		"cpuTime":    "REAL DEFAULT 0",
+		"memTime":    "REAL DEFAULT 0",
 	}
 
 	for colName, colDef := range columns {
@@ -190,7 +344,14 @@ func (sqObj *MySql) UpdateModeForUnfinished(mode JobMode) {
 
 // CheckSignFilesAndUpdateStatus checks .sign files for all tasks and updates their status
 // Tasks with .sign files are marked as finished, others are marked as pending
-func CheckSignFilesAndUpdateStatus(dbObj *MySql) error {
+// If success criteria are defined (run-level or per-task directives), tasks with .sign files
+// must also pass them, otherwise they are marked as failed with a reason and their .sign file is removed
+// Tasks declaring outputs (#@annotask output= or --manifest) are also checked Make-style:
+// if outputs are newer than inputs and the command is unchanged, the task is up to date even without
+// a .sign file (which is written back); otherwise its .sign file is removed so the task runs again
+// Relative output paths in criteria are resolved against workDir
+// The decision for each task is made by decideTask, shared with --dry-run
+func CheckSignFilesAndUpdateStatus(dbObj *MySql, criteria *SuccessCriteria, workDir string) error {
 	tx, err := dbObj.Db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %v", err)
@@ -198,7 +359,7 @@ func CheckSignFilesAndUpdateStatus(dbObj *MySql) error {
 	defer tx.Rollback()
 
 	// Query all tasks
-	rows, err := tx.Query("SELECT subJob_num, shellPath, status FROM job")
+	rows, err := tx.Query("SELECT subJob_num, shellPath, status, retry, mode, taskid, directives, cmdHash, doneHash FROM job")
 	if err != nil {
 		return fmt.Errorf("failed to query tasks: %v", err)
 	}
@@ -207,50 +368,84 @@ func CheckSignFilesAndUpdateStatus(dbObj *MySql) error {
 	now := time.Now().Format("2006-01-02 15:04:05")
 	var finishedCount int
 	var pendingCount int
+	var failedCount int
+	var upToDateCount int
 
 	for rows.Next() {
-		var subJobNum int
-		var shellPath string
-		var currentStatus string
+		var rec TaskRecord
+		var mode, taskid, directives, cmdHash, doneHash sql.NullString
 
-		err := rows.Scan(&subJobNum, &shellPath, &currentStatus)
+		err := rows.Scan(&rec.N, &rec.ShellPath, &rec.Status, &rec.Retry, &mode, &taskid, &directives, &cmdHash, &doneHash)
 		if err != nil {
 			log.Printf("Warning: Failed to scan task: %v", err)
 			continue
 		}
+		rec.Mode, rec.TaskID, rec.CmdHash, rec.DoneHash = mode.String, taskid.String, cmdHash.String, doneHash.String
+		rec.Directives = decodeDirectives(directives.String)
+		// Tasks selected by annotask rerun run again even if their outputs are up to date,
+		// tasks left out of it keep their status
+		rec.Forced = rerunSelection.Contains(rec.N)
+		rec.Excluded = rerunSelection != nil && !rec.Forced
+		signFile := fmt.Sprintf("%s.sign", rec.ShellPath)
+		_, signErr := os.Stat(signFile)
+		rec.HasSign = signErr == nil
+
+		action, reason := decideTask(rec, criteria, workDir)
+		switch action {
+		case TaskUpToDate:
+			if err := writeSignFile(rec.ShellPath); err != nil {
+				log.Printf("Warning: Could not write %s: %v", signFile, err)
+				action = TaskPending
+			} else {
+				log.Printf("Task %d is up to date (outputs newer than inputs), skipping", rec.N)
+				upToDateCount++
+			}
+		case TaskOutOfDate:
+			log.Printf("Task %d is out of date, will run again: %s", rec.N, reason)
+			removeSignFile(rec.ShellPath)
+		case TaskCriteriaFailed:
+			// Record as failed and remove .sign so the task runs again
+			removeSignFile(rec.ShellPath)
+		}
 
-		// Check if .sign file exists
-		signFile := fmt.Sprintf("%s.sign", shellPath)
-		if _, statErr := os.Stat(signFile); statErr == nil {
-			// .sign file exists, task is finished
-			if currentStatus != string(J_finished) {
-				_, err = tx.Exec(`
-					UPDATE job 
-					SET status=?, endtime=?, exitCode=? 
-					WHERE subJob_num=?
-				`, J_finished, now, 0, subJobNum)
-				if err != nil {
-					log.Printf("Warning: Failed to update task %d to finished: %v", subJobNum, err)
-				} else {
-					finishedCount++
-				}
+		status, retry := taskStatusAfterCheck(rec, action)
+		switch {
+		case action == TaskCriteriaFailed:
+			_, err = tx.Exec(`
+				UPDATE job 
+				SET status=?, endtime=?, exitCode=?, reason=?, retry=? 
+				WHERE subJob_num=?
+			`, status, now, 1, reason, retry, rec.N)
+			if err != nil {
+				log.Printf("Warning: Failed to update task %d to failed: %v", rec.N, err)
+			} else {
+				log.Printf("Task %d has .sign file but failed success criteria: %s", rec.N, reason)
+				failedCount++
+			}
+		case string(status) == rec.Status:
+			// Unchanged
+		case status == J_finished:
+			_, err = tx.Exec(`
+				UPDATE job 
+				SET status=?, endtime=?, exitCode=?, reason=NULL, doneHash=cmdHash 
+				WHERE subJob_num=?
+			`, status, now, 0, rec.N)
+			if err != nil {
+				log.Printf("Warning: Failed to update task %d to finished: %v", rec.N, err)
+			} else {
+				finishedCount++
 			}
-		} else {
-			// .sign file doesn't exist, task should be pending
-			// Update to pending regardless of current status (because .sign file is the source of truth)
-			if currentStatus != string(J_pending) {
-				// Reset retry to 1 when re-running tasks (for both local and qsubsge modes)
-				// This ensures that when re-running failed tasks, retry starts from 1
-				_, err = tx.Exec(`
-					UPDATE job 
-					SET status=?, endtime=NULL, exitCode=NULL, taskid=NULL, retry=1 
-					WHERE subJob_num=?
-				`, J_pending, subJobNum)
-				if err != nil {
-					log.Printf("Warning: Failed to update task %d to pending: %v", subJobNum, err)
-				} else {
-					pendingCount++
-				}
+		case status == J_pending:
+			// .sign file is the source of truth: tasks without it run again, counting their retries from 1
+			_, err = tx.Exec(`
+				UPDATE job 
+				SET status=?, endtime=NULL, exitCode=NULL, taskid=NULL, reason=NULL, retry=? 
+				WHERE subJob_num=?
+			`, status, retry, rec.N)
+			if err != nil {
+				log.Printf("Warning: Failed to update task %d to pending: %v", rec.N, err)
+			} else {
+				pendingCount++
 			}
 		}
 	}
@@ -263,6 +458,12 @@ func CheckSignFilesAndUpdateStatus(dbObj *MySql) error {
 	if finishedCount > 0 || pendingCount > 0 {
 		log.Printf("Updated %d tasks to finished, %d tasks to pending based on .sign files", finishedCount, pendingCount)
 	}
+	if failedCount > 0 {
+		log.Printf("Updated %d tasks to failed based on success criteria", failedCount)
+	}
+	if upToDateCount > 0 {
+		log.Printf("%d tasks are up to date based on declared outputs", upToDateCount)
+	}
 
 	return nil
 }
@@ -317,9 +518,9 @@ func GetTaskStats(dbObj *MySql) (total, pending, failed, running, finished int,
 	return
 }
 
-// UpdateGlobalTaskRecord updates or creates a task record in global database
+// UpdateGlobalTaskRecord updates or creates the record of run runID in global database
 // Uses transaction to ensure atomicity and prevent race conditions
-func UpdateGlobalTaskRecord(globalDB *GlobalDB, usrID, project, module, mode, shellPath string, startTime time.Time, total, pending, failed, running, finished int, node string, pid int) error {
+func UpdateGlobalTaskRecord(globalDB *GlobalDB, runID, usrID, project, module, mode, shellPath string, startTime time.Time, total, pending, failed, running, finished int, node string, pid int) error {
 	startTimeStr := startTime.Format("2006-01-02 15:04:05")
 
 	// Use transaction to ensure atomicity of UPDATE + INSERT operation
@@ -334,8 +535,8 @@ func UpdateGlobalTaskRecord(globalDB *GlobalDB, usrID, project, module, mode, sh
 	result, err := tx.Exec(`
 		UPDATE tasks SET 
 			pendingTasks=?, failedTasks=?, runningTasks=?, finishedTasks=?, totalTasks=?, node=?, pid=?
-		WHERE usrID=? AND project=? AND module=? AND starttime=?
-	`, pending, failed, running, finished, total, node, pid, usrID, project, module, startTimeStr)
+		WHERE runID=?
+	`, pending, failed, running, finished, total, node, pid, runID)
 	if err != nil {
 		return fmt.Errorf("failed to update task record: %v", err)
 	}
@@ -353,12 +554,11 @@ func UpdateGlobalTaskRecord(globalDB *GlobalDB, usrID, project, module, mode, sh
 		} else if failed > 0 {
 			status = "failed"
 		}
-		// Use INSERT OR REPLACE to handle race condition where another process might have inserted
-		// This is safer than plain INSERT when there's a UNIQUE constraint
+		// Run IDs are unique, so runs started in the same second never replace each other
 		_, err = tx.Exec(`
-			INSERT OR REPLACE INTO tasks(usrID, project, module, mode, starttime, shellPath, totalTasks, pendingTasks, failedTasks, runningTasks, finishedTasks, status, node, pid)
-			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, usrID, project, module, mode, startTimeStr, shellPath, total, pending, failed, running, finished, status, node, pid)
+			INSERT INTO tasks(runID, usrID, project, module, mode, starttime, shellPath, totalTasks, pendingTasks, failedTasks, runningTasks, finishedTasks, status, node, pid)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, runID, usrID, project, module, mode, startTimeStr, shellPath, total, pending, failed, running, finished, status, node, pid)
 		if err != nil {
 			return fmt.Errorf("failed to insert task record: %v", err)
 		}
@@ -373,12 +573,20 @@ func UpdateGlobalTaskRecord(globalDB *GlobalDB, usrID, project, module, mode, sh
 }
 
 // UpdateGlobalTaskStatus updates the status field in global database
-func UpdateGlobalTaskStatus(globalDB *GlobalDB, usrID, project, module string, startTime time.Time, status string) error {
-	startTimeStr := startTime.Format("2006-01-02 15:04:05")
-	_, err := globalDB.Db.Exec(`
-		UPDATE tasks SET status=?
-		WHERE usrID=? AND project=? AND module=? AND starttime=?
-	`, status, usrID, project, module, startTimeStr)
+func UpdateGlobalTaskStatus(globalDB *GlobalDB, runID, status string) error {
+	_, err := globalDB.Db.Exec("UPDATE tasks SET status=? WHERE runID=?", status, runID)
+	return err
+}
+
+// UpdateGlobalTaskUsage updates the CPU-hours and memory-hours (GB-hours) used by a run
+func UpdateGlobalTaskUsage(globalDB *GlobalDB, runID string, cpuHours, memHours float64) error {
+	_, err := globalDB.Db.Exec("UPDATE tasks SET cpuHours=?, memHours=? WHERE runID=?", cpuHours, memHours, runID)
+	return err
+}
+
+// UpdateGlobalTaskParams records the command line, working directory and parameters (JSON) of a run
+func UpdateGlobalTaskParams(globalDB *GlobalDB, runID, command, workDir, params string) error {
+	_, err := globalDB.Db.Exec("UPDATE tasks SET command=?, workdir=?, params=? WHERE runID=?", command, workDir, params, runID)
 	return err
 }
 
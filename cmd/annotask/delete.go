@@ -613,7 +613,7 @@ func RunDeleteModule(config *Config, args []string) {
 	deleteParser := argparse.NewParser("annotask delete", "Delete task records from global database")
 	opt_project := deleteParser.String("p", "project", &argparse.Options{Required: false, Help: "Project name"})
 	opt_module := deleteParser.String("m", "module", &argparse.Options{Help: "Module (shell path basename without extension)"})
-	opt_id := deleteParser.Int("k", "id", &argparse.Options{Help: "Task ID (from stat -p output)"})
+	opt_id := deleteParser.String("k", "id", &argparse.Options{Help: "Task ID or run ID (from stat -p output)"})
 
 	// Prepend program name for argparse.Parse (it expects os.Args-like format)
 	parseArgs := append([]string{"annotask"}, args...)
@@ -630,8 +630,11 @@ func RunDeleteModule(config *Config, args []string) {
 	}
 
 	taskID := 0
-	if opt_id != nil && *opt_id > 0 {
-		taskID = *opt_id
+	if opt_id != nil && *opt_id != "" {
+		taskID, err = resolveRunRef(globalDB, GetCurrentUserID(), *opt_id)
+		if err != nil {
+			log.Fatalf("Delete command failed: %v", err)
+		}
 		// When using -k/--id, project and module are not required
 		err = RunDeleteCommand(globalDB, "", "", taskID)
 		if err != nil {
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// directivePrefix marks a per-task directive line in the input file, e.g.
+//
+//	#@annotask require_output=/data/sample1.bam
+//	samtools sort -o /data/sample1.bam sample1.sam
+//
+// Directive lines are not counted by -l/--line and apply to the task containing the next command line
+const directivePrefix = "#@annotask"
+
+// TaskDirectives holds per-task settings declared by directive lines in the input file
+// Stored as JSON in the directives column of the job table
+type TaskDirectives struct {
+	Criteria SuccessCriteria `json:"criteria,omitempty"`
+	// Declared inputs and outputs (files or glob patterns) for up-to-date checks on rerun
+	Inputs  []string `json:"inputs,omitempty"`
+	Outputs []string `json:"outputs,omitempty"`
+	// Hooks run around the task: directive lines, then manifest, then config
+	Hooks *TaskHooks `json:"hooks,omitempty"`
+}
+
+// isDirectiveLine checks if an input line is an annotask directive
+func isDirectiveLine(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), directivePrefix)
+}
+
+// parseDirectiveLine parses "#@annotask key=value" into key and value
+// The value is the rest of the line after the first '=', so it may contain spaces (e.g. regexes)
+func parseDirectiveLine(line string) (string, string, error) {
+	body := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), directivePrefix))
+	parts := strings.SplitN(body, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", "", fmt.Errorf("invalid directive (expected %s key=value): %s", directivePrefix, strings.TrimSpace(line))
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
+
+// Apply applies one directive line to the task directives
+func (d *TaskDirectives) Apply(line string) error {
+	key, value, err := parseDirectiveLine(line)
+	if err != nil {
+		return err
+	}
+
+	switch key {
+	case "input":
+		d.Inputs = append(d.Inputs, splitList(value)...)
+	case "output":
+		d.Outputs = append(d.Outputs, splitList(value)...)
+	case "require_output":
+		d.Criteria.RequireOutputs = append(d.Criteria.RequireOutputs, splitList(value)...)
+	case "ok_exit_codes":
+		codes, err := parseExitCodes(value)
+		if err != nil {
+			return err
+		}
+		d.Criteria.OkExitCodes = codes
+	case "require_pattern":
+		d.Criteria.RequirePatterns = append(d.Criteria.RequirePatterns, value)
+	case "reject_pattern":
+		d.Criteria.RejectPatterns = append(d.Criteria.RejectPatterns, value)
+	case "pre":
+		d.setHooks(d.hooks().Merge(TaskHooks{Pre: value}))
+	case "post":
+		d.setHooks(d.hooks().Merge(TaskHooks{Post: value}))
+	case "on_failure":
+		d.setHooks(d.hooks().Merge(TaskHooks{OnFailure: value}))
+	default:
+		return fmt.Errorf("unknown directive key: %s", key)
+	}
+	return d.Criteria.Validate()
+}
+
+// IsEmpty reports whether no directive was set
+func (d *TaskDirectives) IsEmpty() bool {
+	return d.Criteria.IsEmpty() && len(d.Inputs) == 0 && len(d.Outputs) == 0 && d.Hooks == nil
+}
+
+// ApplyManifest adds inputs and outputs declared for the task in a manifest file
+func (d *TaskDirectives) ApplyManifest(entry ManifestEntry) {
+	d.Inputs = append(d.Inputs, entry.Input...)
+	d.Outputs = append(d.Outputs, entry.Output...)
+	d.DefaultHooks(entry.TaskHooks)
+}
+
+// DefaultHooks sets the given hooks for those not already set for the task
+func (d *TaskDirectives) DefaultHooks(hooks TaskHooks) {
+	d.setHooks(hooks.Merge(d.hooks()))
+}
+
+func (d *TaskDirectives) setHooks(hooks TaskHooks) {
+	if hooks.IsEmpty() {
+		d.Hooks = nil
+		return
+	}
+	d.Hooks = &hooks
+}
+
+// hooks returns the hooks of the task (empty if none is set)
+func (d *TaskDirectives) hooks() TaskHooks {
+	if d.Hooks == nil {
+		return TaskHooks{}
+	}
+	return *d.Hooks
+}
+
+// encodeDirectives serializes task directives for the job table (empty string if nothing is set)
+func encodeDirectives(d *TaskDirectives) string {
+	if d == nil || d.IsEmpty() {
+		return ""
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// decodeDirectives parses task directives stored in the job table
+func decodeDirectives(s string) TaskDirectives {
+	var d TaskDirectives
+	if s == "" {
+		return d
+	}
+	if err := json.Unmarshal([]byte(s), &d); err != nil {
+		return TaskDirectives{}
+	}
+	return d
+}
+
+// splitList splits a comma-separated list, trimming whitespace and dropping empty items
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// parseExitCodes parses a comma-separated list of exit codes, e.g. "0,3"
+func parseExitCodes(s string) ([]int, error) {
+	var codes []int
+	for _, item := range splitList(s) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 0 || code > 255 {
+			return nil, fmt.Errorf("invalid exit code: %s (expected 0-255)", item)
+		}
+		codes = append(codes, code)
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("empty exit code list")
+	}
+	return codes, nil
+}
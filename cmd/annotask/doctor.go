@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/akamensky/argparse"
+	"github.com/dgruber/drmaa"
+)
+
+// Results of a doctor check
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "FAIL"
+)
+
+// doctorReport collects the results of annotask doctor
+type doctorReport struct {
+	out      io.Writer
+	failures int
+	warnings int
+}
+
+func (r *doctorReport) section(title string) {
+	fmt.Fprintf(r.out, "\n%s\n", title)
+}
+
+func (r *doctorReport) check(result, format string, args ...interface{}) {
+	switch result {
+	case checkFail:
+		r.failures++
+	case checkWarn:
+		r.warnings++
+	}
+	fmt.Fprintf(r.out, "  [%-4s] %s\n", result, fmt.Sprintf(format, args...))
+}
+
+// networkFilesystems are filesystem magic numbers (statfs f_type on Linux) of network and cluster filesystems,
+// where SQLite's WAL mode is not safe: its shared-memory index only works between processes on one host
+var networkFilesystems = map[int64]string{
+	0x6969:     "nfs",
+	0xFF534D42: "cifs",
+	0xFE534D42: "smb2",
+	0x517B:     "smb",
+	0x0BD00BD0: "lustre",
+	0x47504653: "gpfs",
+	0x00C36400: "ceph",
+	0x19830326: "beegfs",
+	0x65735546: "fuse",
+	0x013111A8: "ibrix",
+	0xAAD7AAEA: "panfs",
+}
+
+// networkFilesystem returns the name of the network filesystem path is on, empty for local filesystems
+func networkFilesystem(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", err
+	}
+	return networkFilesystems[int64(st.Type)], nil
+}
+
+// checkConfigFiles reports the config files and the effective configuration with the source of each value
+func checkConfigFiles(r *doctorReport, config *Config) {
+	r.section("Config")
+	systemPath, userPath, err := configPaths()
+	if err != nil {
+		r.check(checkFail, "could not locate config files: %v", err)
+		return
+	}
+	for _, file := range []struct{ label, path string }{{SourceSystem, systemPath}, {SourceUser, userPath}} {
+		if _, err := os.Stat(file.path); err != nil {
+			r.check(checkOK, "%s config %s not found, not loaded", file.label, file.path)
+			continue
+		}
+		problems, warnings, err := validateConfigFile(file.path, file.label == SourceSystem)
+		if err != nil {
+			r.check(checkFail, "%s config %s: %v", file.label, file.path, err)
+			continue
+		}
+		r.check(checkOK, "%s config %s loaded", file.label, file.path)
+		for _, problem := range append(problems, warnings...) {
+			r.check(checkWarn, "%s: %s", file.path, problem)
+		}
+	}
+
+	values, err := loadConfigValues(config)
+	if err != nil {
+		r.check(checkFail, "could not read effective config: %v", err)
+		return
+	}
+	fmt.Fprintln(r.out)
+	writeConfigValues(r.out, values, "  ", false)
+}
+
+// checkGlobalDB checks that the global database can be written and is on a filesystem where WAL mode is safe
+func checkGlobalDB(r *doctorReport, dbPath string) {
+	r.section("Global database")
+	dir := filepath.Dir(dbPath)
+	if _, err := os.Stat(dir); err != nil {
+		r.check(checkFail, "directory %s does not exist: %v", dir, err)
+		return
+	}
+	probe, err := os.CreateTemp(dir, ".annotask-doctor-*")
+	if err != nil {
+		r.check(checkFail, "directory %s is not writable: %v", dir, err)
+	} else {
+		probe.Close()
+		os.Remove(probe.Name())
+		r.check(checkOK, "directory %s is writable", dir)
+	}
+
+	if fs, err := networkFilesystem(dir); err != nil {
+		r.check(checkWarn, "could not determine filesystem of %s: %v", dir, err)
+	} else if fs != "" {
+		r.check(checkFail, "%s is on %s, SQLite WAL mode is not safe on network filesystems; set db to a local path in the system config", dir, fs)
+	} else {
+		r.check(checkOK, "%s is on a local filesystem (WAL mode safe)", dir)
+	}
+
+	if _, err := os.Stat(dbPath); err != nil {
+		r.check(checkWarn, "%s does not exist yet, it is created by the first run", dbPath)
+		return
+	}
+	conn, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
+	if err != nil {
+		r.check(checkFail, "could not open %s: %v", dbPath, err)
+		return
+	}
+	defer conn.Close()
+	var journalMode string
+	if err := conn.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		r.check(checkFail, "could not read %s: %v", dbPath, err)
+		return
+	}
+	if journalMode == "wal" {
+		r.check(checkOK, "%s is readable, journal mode %s", dbPath, journalMode)
+	} else {
+		r.check(checkWarn, "%s is readable, journal mode %s (expected wal)", dbPath, journalMode)
+	}
+	// BEGIN IMMEDIATE takes the write lock without changing anything
+	c, err := conn.Conn(context.Background())
+	if err == nil {
+		_, err = c.ExecContext(context.Background(), "BEGIN IMMEDIATE")
+		if err == nil {
+			c.ExecContext(context.Background(), "ROLLBACK")
+		}
+		c.Close()
+	}
+	if err != nil {
+		r.check(checkFail, "%s is not writable: %v", dbPath, err)
+	} else {
+		r.check(checkOK, "%s is writable", dbPath)
+	}
+}
+
+// loadedLibrary returns the path of a shared library loaded by this process (Linux only), empty if not found
+func loadedLibrary(name string) string {
+	f, err := os.Open("/proc/self/maps")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 6 && strings.Contains(filepath.Base(fields[5]), name) {
+			return fields[5]
+		}
+	}
+	return ""
+}
+
+// checkSGE checks the SGE environment: settings.sh, libdrmaa, a DRMAA session and the node restriction
+func checkSGE(r *doctorReport, config *Config) {
+	r.section("SGE")
+	if config.SgeEnv != "" {
+		if _, err := os.Stat(config.SgeEnv); err != nil {
+			r.check(checkWarn, "configured sgeenv %s does not exist, auto-detection is used", config.SgeEnv)
+		} else {
+			r.check(checkOK, "configured sgeenv %s exists", config.SgeEnv)
+		}
+	} else {
+		r.check(checkOK, "sgeenv not configured, settings.sh is auto-detected")
+	}
+
+	sgeReady := true
+	if err := detectAndSetSGERoot(config.SgeEnv); err != nil {
+		sgeReady = false
+		r.check(checkFail, "SGE environment: %v", err)
+	} else {
+		r.check(checkOK, "SGE_ROOT=%s SGE_CELL=%s", os.Getenv("SGE_ROOT"), orDash(os.Getenv("SGE_CELL")))
+	}
+
+	// libdrmaa is linked at build time, the process wouldn't have started without it
+	if lib := loadedLibrary("libdrmaa"); lib != "" {
+		r.check(checkOK, "libdrmaa loaded from %s", lib)
+	} else {
+		r.check(checkOK, "libdrmaa loaded")
+	}
+	if path := os.Getenv("DRMAA_LIBRARY_PATH"); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			r.check(checkWarn, "DRMAA_LIBRARY_PATH %s does not exist", path)
+		}
+	}
+
+	if sgeReady {
+		session, err := drmaa.MakeSession()
+		if err != nil {
+			r.check(checkFail, "DRMAA session: %v", err)
+		} else {
+			system, _ := session.GetDrmSystem()
+			r.check(checkOK, "DRMAA session opened (%s)", orDash(system))
+			session.Exit()
+		}
+	} else {
+		r.check(checkFail, "DRMAA session not tried, SGE environment is not set")
+	}
+
+	if _, err := exec.LookPath("qconf"); err != nil {
+		r.check(checkWarn, "qconf not found in PATH, queues and SGE projects are not checked before runs")
+	} else {
+		r.check(checkOK, "qconf found")
+	}
+
+	if err := CheckNode(config.Node); err != nil {
+		r.check(checkFail, "%v", err)
+	} else if len(config.Node) == 0 {
+		r.check(checkOK, "no node restriction for qsubsge")
+	} else {
+		hostname, _ := os.Hostname()
+		r.check(checkOK, "node %s may submit qsubsge jobs", hostname)
+	}
+}
+
+// RunDoctorModule runs the doctor module
+func RunDoctorModule(config *Config, args []string) {
+	parser := argparse.NewParser("annotask doctor", "Diagnose the config, global database and SGE environment")
+	opt_no_sge := parser.Flag("", "no-sge", &argparse.Options{Help: "Skip the SGE checks (local mode only)"})
+
+	parseArgs := append([]string{"annotask"}, args...)
+	if err := parser.Parse(parseArgs); err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "help") {
+			printModuleHelp("doctor", config)
+			return
+		}
+		fmt.Print(parser.Usage(err))
+		os.Exit(1)
+	}
+
+	r := &doctorReport{out: os.Stdout}
+	fmt.Printf("annotask v%s\n", Version)
+	checkConfigFiles(r, config)
+	checkGlobalDB(r, config.Db)
+	if !*opt_no_sge {
+		checkSGE(r, config)
+	}
+
+	fmt.Printf("\n%d failure(s), %d warning(s)\n", r.failures, r.warnings)
+	if r.failures > 0 {
+		os.Exit(1)
+	}
+}
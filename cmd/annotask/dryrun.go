@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DryRunTask is a task of an input file as a run would handle it, reported by --dry-run
+type DryRunTask struct {
+	Num        int
+	FirstLine  int // 0 for tasks only in the local database
+	LastLine   int
+	Command    string
+	Run        bool
+	Reason     string
+	NativeSpec string // qsubsge only, for tasks that would be submitted
+}
+
+// dryRunFields are the columns of the --dry-run table
+var dryRunFields = []outputField[DryRunTask]{
+	{"task", func(t *DryRunTask) interface{} { return t.Num }},
+	{"lines", func(t *DryRunTask) interface{} {
+		if t.FirstLine == 0 {
+			return nil
+		}
+		if t.FirstLine == t.LastLine {
+			return fmt.Sprintf("%d", t.FirstLine)
+		}
+		return fmt.Sprintf("%d-%d", t.FirstLine, t.LastLine)
+	}},
+	{"action", func(t *DryRunTask) interface{} {
+		if t.Run {
+			return "run"
+		}
+		return "skip"
+	}},
+	{"reason", func(t *DryRunTask) interface{} { return t.Reason }},
+	{"command", func(t *DryRunTask) interface{} { return nullIfEmpty(commandPreview(t.Command)) }},
+}
+
+// nativeSpecField is the extra --dry-run column of qsubsge mode
+var nativeSpecField = outputField[DryRunTask]{"nativeSpec", func(t *DryRunTask) interface{} { return nullIfEmpty(t.NativeSpec) }}
+
+// commandPreview shortens the command of a task to its first line
+func commandPreview(cmd string) string {
+	lines := strings.Split(strings.TrimRight(cmd, "\n"), "\n")
+	first := strings.TrimSpace(lines[0])
+	if len(first) > 60 {
+		first = first[:57] + "..."
+	}
+	switch {
+	case len(lines) == 2:
+		first += " (+1 line)"
+	case len(lines) > 2:
+		first += fmt.Sprintf(" (+%d lines)", len(lines)-1)
+	}
+	return first
+}
+
+// dryRunJob is the record of a task in the local database
+type dryRunJob struct {
+	shellPath, status, mode string
+	taskid, reason          string
+	directives              string
+	cmdHash, doneHash       string
+	retry                   int
+	mem, h_vmem             float64
+	h_rt                    int64
+}
+
+// loadDryRunJobs reads the tasks of an existing local database without changing it
+// Returns nil if the input file hasn't been run yet
+func loadDryRunJobs(dbPath string) (map[int]*dryRunJob, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, nil
+	}
+	conn, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local database: %v", err)
+	}
+	defer conn.Close()
+	rows, err := conn.Query(`SELECT subJob_num, shellPath, status, retry, mode, taskid, reason, directives, cmdHash, doneHash, mem, h_vmem, h_rt FROM job`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tasks of %s: %v", dbPath, err)
+	}
+	defer rows.Close()
+	jobs := make(map[int]*dryRunJob)
+	for rows.Next() {
+		var N int
+		var job dryRunJob
+		var mode, taskid, reason, directives, cmdHash, doneHash sql.NullString
+		var mem, h_vmem sql.NullFloat64
+		var h_rt sql.NullInt64
+		if err := rows.Scan(&N, &job.shellPath, &job.status, &job.retry, &mode, &taskid, &reason, &directives, &cmdHash, &doneHash, &mem, &h_vmem, &h_rt); err != nil {
+			return nil, fmt.Errorf("failed to scan task: %v", err)
+		}
+		job.mode, job.taskid, job.reason = mode.String, taskid.String, reason.String
+		job.directives, job.cmdHash, job.doneHash = directives.String, cmdHash.String, doneHash.String
+		job.mem, job.h_vmem, job.h_rt = mem.Float64, h_vmem.Float64, h_rt.Int64
+		jobs[N] = &job
+	}
+	return jobs, rows.Err()
+}
+
+// planTask returns the job row of task N as Creat_tb would leave it and what the run would do with it (decideTask)
+// job is nil for tasks not in the local database yet, directives is nil for tasks not in the input file any more
+func planTask(N int, job *dryRunJob, cmd string, directives *TaskDirectives, subShellPath string, mode JobMode, criteria *SuccessCriteria, workDir string) (TaskRecord, TaskAction, string) {
+	rec := TaskRecord{N: N, ShellPath: fmt.Sprintf("%s/task_%04d.sh", subShellPath, N), Status: string(J_pending), Mode: string(mode)}
+	if job != nil {
+		rec.ShellPath, rec.Status, rec.TaskID, rec.Reason, rec.Retry = job.shellPath, job.status, job.taskid, job.reason, job.retry
+		rec.DoneHash = job.doneHash
+		if job.status == string(J_finished) {
+			// UpdateModeForUnfinished only changes the mode of unfinished tasks
+			rec.Mode = job.mode
+		}
+	}
+	changed := false
+	if directives != nil {
+		rec.Directives, rec.CmdHash = *directives, commandHash(cmd)
+		changed = job != nil && commandChanged(job.cmdHash, rec.CmdHash)
+	} else {
+		rec.Directives, rec.CmdHash = decodeDirectives(job.directives), job.cmdHash
+	}
+	// Creat_tb removes the .sign file of a task whose command changed
+	_, signErr := os.Stat(rec.ShellPath + ".sign")
+	rec.HasSign = signErr == nil && !changed
+
+	action, reason := decideTask(rec, criteria, workDir)
+	switch {
+	case action == TaskCriteriaFailed:
+		reason = "failed success criteria: " + reason
+	case action == TaskOutOfDate:
+		reason = "out of date: " + reason
+	case action == TaskPending && job == nil:
+		reason = "new task"
+	case action == TaskPending && changed:
+		reason = "command changed"
+	}
+	return rec, action, reason
+}
+
+// dryRun reports how an input file would be run: how its lines group into tasks and which tasks would run or be skipped
+// For qsubsge mode the DRMAA native specification of each task to submit is reported too
+// Nothing is submitted or written, the local database is only read
+func dryRun(out io.Writer, opts runOptions, hooks TaskHooks) error {
+	mode, criteria := opts.Mode, opts.Criteria
+	shellAbsPath, _ := filepath.Abs(opts.Infile)
+	subShellPath := shellAbsPath + ".shell"
+	dbPath := shellAbsPath + ".db"
+	jobs, err := loadDryRunJobs(dbPath)
+	if err != nil {
+		return err
+	}
+
+	// Same directory as the run resolves relative paths in success criteria and declared outputs against
+	workDir, _ := os.Getwd()
+	if mode == ModeQsubSge {
+		workDir = subShellPath
+	}
+
+	// plan decides whether task t would run, and for qsubsge mode the native specification it would be submitted with
+	plan := func(t *DryRunTask, job *dryRunJob, cmd string, directives *TaskDirectives) {
+		rec, action, reason := planTask(t.Num, job, cmd, directives, subShellPath, mode, criteria, workDir)
+		t.Run, t.Reason = action.Run(), reason
+		if !t.Run || mode != ModeQsubSge {
+			return
+		}
+		_, retry := taskStatusAfterCheck(rec, action)
+		var storedMem, storedHvmem float64
+		var storedHrt int64
+		if job != nil {
+			storedMem, storedHvmem, storedHrt = job.mem, job.h_vmem, job.h_rt
+		}
+		taskMem, taskHvmem, taskTimeout := attemptResources(retry, storedMem, storedHvmem, storedHrt, opts.Mem, opts.HVmem, opts.UserSetMem, opts.UserSetHvmem, opts.Timeout)
+		t.NativeSpec = sgeNativeSpec(opts.CPU, taskMem, taskHvmem, opts.UserSetMem, opts.UserSetHvmem, opts.Queue, opts.SgeProject, opts.ParallelEnvMode, opts.Hostname, taskTimeout)
+	}
+
+	f, err := os.Open(shellAbsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var tasks []DryRunTask
+	commandLines := 0
+	err = readInputTasks(f, opts.Line, func(task InputTask) {
+		if entry, ok := opts.Manifest[task.N]; ok {
+			task.Directives.ApplyManifest(entry)
+		}
+		task.Directives.DefaultHooks(hooks)
+		cmd := strings.TrimRight(task.Command, "\n")
+		commandLines += strings.Count(cmd, "\n") + 1
+		t := DryRunTask{Num: task.N, FirstLine: task.FirstLine, LastLine: task.LastLine, Command: cmd}
+		plan(&t, jobs[task.N], cmd, task.Directives)
+		tasks = append(tasks, t)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", shellAbsPath, err)
+	}
+	// Unfinished tasks left in the database from a longer version of the input file are run too
+	for N := len(tasks) + 1; jobs[N] != nil; N++ {
+		t := DryRunTask{Num: N}
+		plan(&t, jobs[N], "", nil)
+		if t.Run {
+			t.Reason = "not in input file, " + t.Reason
+		}
+		tasks = append(tasks, t)
+	}
+
+	toRun := 0
+	for _, t := range tasks {
+		if t.Run {
+			toRun++
+		}
+	}
+
+	fmt.Fprintf(out, "Dry run of %s (%s mode), nothing is submitted and no run is recorded\n", shellAbsPath, mode)
+	fmt.Fprintf(out, "%d command line(s) grouped by -l %d into %d task(s)\n", commandLines, opts.Line, len(tasks)-countMissing(tasks))
+	if jobs == nil {
+		fmt.Fprintf(out, "%s does not exist yet, all tasks are new\n", dbPath)
+	}
+	fmt.Fprintln(out)
+	fields := dryRunFields
+	if mode == ModeQsubSge {
+		fields = append(fields[:len(fields):len(fields)], nativeSpecField)
+	}
+	if err := writeRows(out, tasks, fields, FormatTable); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\n%d task(s) would run, %d skipped\n", toRun, len(tasks)-toRun)
+	return nil
+}
+
+// countMissing counts the tasks only in the local database
+func countMissing(tasks []DryRunTask) int {
+	n := 0
+	for _, t := range tasks {
+		if t.FirstLine == 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types written to {input}.events.jsonl
+const (
+	EventRunStart  = "run_start"
+	EventRunEnd    = "run_end"
+	EventSubmitted = "submitted" // qsubsge: job submitted to SGE
+	EventRunning   = "running"   // local: process started, qsubsge: job seen running
+	EventFinished  = "finished"
+	EventFailed    = "failed"
+	EventRetried   = "retried"   // A failed task is dispatched again
+	EventEscalated = "escalated" // Memory or h_rt increased for the next retry
+	EventCancelled = "cancelled" // Task killed because the failure budget was exceeded
+)
+
+// EventResources are the resources requested for a task
+type EventResources struct {
+	CPU    int     `json:"cpu,omitempty"`
+	Mem    float64 `json:"mem,omitempty"`    // GB
+	HVmem  float64 `json:"h_vmem,omitempty"` // GB
+	HRT    int64   `json:"h_rt,omitempty"`   // Seconds
+	Queue  string  `json:"queue,omitempty"`
+	PEMode string  `json:"pe_mode,omitempty"`
+}
+
+// TaskEvent is one line of the event log
+type TaskEvent struct {
+	Time      string          `json:"time"`
+	Event     string          `json:"event"`
+	Task      int             `json:"task,omitempty"`
+	Attempt   int             `json:"attempt,omitempty"`
+	Mode      string          `json:"mode,omitempty"`
+	TaskID    string          `json:"taskid,omitempty"` // PID (local) or SGE job ID (qsubsge)
+	Node      string          `json:"node,omitempty"`
+	ExitCode  *int            `json:"exitCode,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Duration  float64         `json:"duration,omitempty"` // Seconds
+	Resources *EventResources `json:"resources,omitempty"`
+	Previous  *EventResources `json:"previous,omitempty"` // Resources before escalation
+	Summary   *EventSummary   `json:"summary,omitempty"`  // run_start / run_end only
+}
+
+// EventSummary holds task counts of run_start and run_end events
+type EventSummary struct {
+	Project  string `json:"project"`
+	Module   string `json:"module"`
+	Status   string `json:"status,omitempty"`
+	Total    int    `json:"total"`
+	ToRun    int    `json:"toRun,omitempty"`
+	Finished int    `json:"finished"`
+	Failed   int    `json:"failed"`
+	Pending  int    `json:"pending"`
+}
+
+// EventLog appends task state transitions to {input}.events.jsonl as they happen
+// A nil *EventLog discards all events
+type EventLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	attempts map[int]int
+}
+
+// eventLog is the event log of the current run, set by runTasks
+var eventLog *EventLog
+
+// OpenEventLog opens (appends to) the event log file
+func OpenEventLog(path string) (*EventLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %v", err)
+	}
+	return &EventLog{file: f, attempts: make(map[int]int)}, nil
+}
+
+// Close closes the event log file
+func (l *EventLog) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+}
+
+// Emit writes one event, filling in the time
+func (l *EventLog) Emit(event TaskEvent) {
+	if l == nil {
+		return
+	}
+	event.Time = time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Warning: Could not encode event: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Warning: Could not write event log: %v", err)
+	}
+}
+
+// StartAttempt counts a new attempt of task N in this run and returns its number (starting at 1)
+// A retried event is written for every attempt after the first
+func (l *EventLog) StartAttempt(N int, mode JobMode) int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	l.attempts[N]++
+	attempt := l.attempts[N]
+	l.mu.Unlock()
+	if attempt > 1 {
+		l.Emit(TaskEvent{Event: EventRetried, Task: N, Attempt: attempt, Mode: string(mode)})
+	}
+	return attempt
+}
+
+// Attempt returns the current attempt number of task N
+func (l *EventLog) Attempt(N int) int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.attempts[N]
+}
+
+// exitCodePtr returns a pointer to an exit code for TaskEvent
+func exitCodePtr(code int) *int {
+	return &code
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestEntry declares inputs, outputs and hooks of one task in a manifest file
+type ManifestEntry struct {
+	Input     []string `yaml:"input"`
+	Output    []string `yaml:"output"`
+	TaskHooks `yaml:",inline"`
+}
+
+// Manifest maps task number to its declared inputs, outputs and hooks, e.g.
+//
+//	1:
+//	  input: [/data/sample1.fq.gz]
+//	  output: [/data/sample1.bam]
+//	2:
+//	  input: [/data/sample2.fq.gz]
+//	  output: [/data/sample2.bam]
+//	  on_failure: rm -rf /scratch/sample2
+type Manifest map[int]ManifestEntry
+
+// LoadManifest loads a manifest file (YAML). Returns nil if path is empty
+func LoadManifest(path string) (Manifest, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest file: %v", err)
+	}
+	var manifest Manifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest file: %v", err)
+	}
+	return manifest, nil
+}
+
+// commandHash returns the hash of a task's command text, used to detect changed commands on rerun
+func commandHash(cmd string) string {
+	sum := sha256.Sum256([]byte(strings.TrimRight(cmd, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// expandPaths resolves declared paths (or glob patterns) against workDir
+// Returns an error naming the first path that doesn't match any file
+func expandPaths(paths []string, workDir string) ([]string, error) {
+	var result []string
+	for _, path := range paths {
+		pattern := path
+		if workDir != "" && !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(workDir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) == 0 {
+			return nil, fmt.Errorf("%s does not exist", path)
+		}
+		result = append(result, matches...)
+	}
+	return result, nil
+}
+
+// outputsUpToDate checks Make-style freshness: every output exists and the oldest output
+// is not older than the newest input
+// Returns false and the reason if the task needs to run
+func outputsUpToDate(inputs, outputs []string, workDir string) (bool, string) {
+	outputFiles, err := expandPaths(outputs, workDir)
+	if err != nil {
+		return false, fmt.Sprintf("output %v", err)
+	}
+	inputFiles, err := expandPaths(inputs, workDir)
+	if err != nil {
+		return false, fmt.Sprintf("input %v", err)
+	}
+
+	var oldestOutput time.Time
+	var oldestOutputPath string
+	for i, path := range outputFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, fmt.Sprintf("output %s does not exist", path)
+		}
+		if i == 0 || info.ModTime().Before(oldestOutput) {
+			oldestOutput = info.ModTime()
+			oldestOutputPath = path
+		}
+	}
+
+	for _, path := range inputFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, fmt.Sprintf("input %s does not exist", path)
+		}
+		if info.ModTime().After(oldestOutput) {
+			return false, fmt.Sprintf("input %s is newer than output %s", path, oldestOutputPath)
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hookTimeout limits how long a post or on_failure hook may run
+const hookTimeout = 10 * time.Minute
+
+// TaskHooks are shell commands run around each task
+// pre runs in the generated script before the command (on the execution node), a failing pre hook fails the task
+// post and on_failure are run by annotask after the task finished or failed
+type TaskHooks struct {
+	Pre       string `yaml:"pre,omitempty" json:"pre,omitempty"`
+	Post      string `yaml:"post,omitempty" json:"post,omitempty"`
+	OnFailure string `yaml:"on_failure,omitempty" json:"on_failure,omitempty"`
+}
+
+// IsEmpty reports whether no hook is set
+func (h TaskHooks) IsEmpty() bool {
+	return h.Pre == "" && h.Post == "" && h.OnFailure == ""
+}
+
+// Merge returns the hooks with non-empty hooks of other taking precedence
+func (h TaskHooks) Merge(other TaskHooks) TaskHooks {
+	if other.Pre != "" {
+		h.Pre = other.Pre
+	}
+	if other.Post != "" {
+		h.Post = other.Post
+	}
+	if other.OnFailure != "" {
+		h.OnFailure = other.OnFailure
+	}
+	return h
+}
+
+// preHookScript returns the part of a generated script that runs the pre hook of task N
+// Hook variables are only set in the subshell the hook runs in, not for the task's command
+// The mode and attempt come from the environment annotask starts the script with (hookEnv), as $JOB_ID is
+// also set for a local run inside an SGE job or qrsh session; the PID of a local task is the script's own $$
+func preHookScript(shellPath string, N int, pre string) string {
+	if pre == "" {
+		return ""
+	}
+	shell := shellQuote(shellPath)
+	var sb strings.Builder
+	sb.WriteString("(\n")
+	fmt.Fprintf(&sb, "export ANNOTASK_HOOK=pre ANNOTASK_TASK=%d ANNOTASK_TASK_NAME=%s ANNOTASK_SHELL=%s\n", N, shellQuote(getFilePrefix(shellPath)), shell)
+	sb.WriteString("export ANNOTASK_ATTEMPT=${ANNOTASK_ATTEMPT:-1} ANNOTASK_MODE=${ANNOTASK_MODE:-local} ANNOTASK_NODE=$(hostname)\n")
+	fmt.Fprintf(&sb, "if [ \"$ANNOTASK_MODE\" = %s ]; then export ANNOTASK_JOB_ID=$JOB_ID ANNOTASK_STDOUT=%s.o$JOB_ID ANNOTASK_STDERR=%s.e$JOB_ID\n", ModeQsubSge, shell, shell)
+	fmt.Fprintf(&sb, "else export ANNOTASK_JOB_ID=$$ ANNOTASK_STDOUT=%s.o ANNOTASK_STDERR=%s.e; fi\n", shell, shell)
+	sb.WriteString(strings.TrimRight(pre, "\n"))
+	sb.WriteString("\n) || { rc=$?; echo \"========== annotask pre hook failed with exit code $rc ==========\" 1>&2; exit $rc; }\n")
+	return sb.String()
+}
+
+// shellQuote quotes s for use as a single word in sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// hookEnv returns the environment passed to a task so its pre hook knows the mode and attempt number
+func hookEnv(mode JobMode, attempt int) []string {
+	return []string{"ANNOTASK_MODE=" + string(mode), "ANNOTASK_ATTEMPT=" + strconv.Itoa(attempt)}
+}
+
+// TaskHookContext describes a completed task attempt for post and on_failure hooks
+type TaskHookContext struct {
+	Task      int
+	ShellPath string
+	Attempt   int
+	Mode      JobMode
+	JobID     string // PID (local) or SGE job ID (qsubsge)
+	Node      string
+	ExitCode  int
+	Reason    string
+	Stdout    string
+	Stderr    string
+}
+
+// RunCompletion runs the post hook if the task succeeded, otherwise the on_failure hook
+// Hook output is appended to the task's .o/.e files, a failing hook is only logged and doesn't change the task status
+func (h TaskHooks) RunCompletion(success bool, c TaskHookContext) {
+	name, command := "post", h.Post
+	status := string(J_finished)
+	if !success {
+		name, command = "on_failure", h.OnFailure
+		status = string(J_failed)
+	}
+	if command == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"ANNOTASK_HOOK="+name,
+		"ANNOTASK_TASK="+strconv.Itoa(c.Task),
+		"ANNOTASK_TASK_NAME="+getFilePrefix(c.ShellPath),
+		"ANNOTASK_SHELL="+c.ShellPath,
+		"ANNOTASK_ATTEMPT="+strconv.Itoa(c.Attempt),
+		"ANNOTASK_MODE="+string(c.Mode),
+		"ANNOTASK_JOB_ID="+c.JobID,
+		"ANNOTASK_NODE="+c.Node,
+		"ANNOTASK_STATUS="+status,
+		"ANNOTASK_EXIT_CODE="+strconv.Itoa(c.ExitCode),
+		"ANNOTASK_REASON="+c.Reason,
+		"ANNOTASK_STDOUT="+c.Stdout,
+		"ANNOTASK_STDERR="+c.Stderr,
+	)
+	cmd.Dir = filepath.Dir(c.ShellPath)
+	if c.Mode == ModeLocal {
+		// Local tasks run in the current directory
+		cmd.Dir = ""
+	}
+	if f, err := os.OpenFile(c.Stdout, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err == nil {
+		defer f.Close()
+		cmd.Stdout = f
+	}
+	if f, err := os.OpenFile(c.Stderr, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err == nil {
+		defer f.Close()
+		fmt.Fprintf(f, "========== annotask %s hook at : %s ==========\n", name, time.Now().Format("2006/01/02 15:04:05"))
+		cmd.Stderr = f
+	}
+	if err := cmd.Run(); err != nil {
+		log.Printf("Warning: %s hook of task %d failed: %v", name, c.Task, err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -24,15 +25,40 @@ func runLocalMode(config *Config, args []string) {
 		}
 	}
 
+	// The profile changes the defaults of the flags, explicit flags still win
+	profile, err := selectProfile(config, args)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
 	parser := argparse.NewParser("annotask local", "Run tasks locally")
 	opt_i := parser.String("i", "infile", &argparse.Options{Required: true, Help: "Input shell command file (one command per line or grouped by -l)"})
 	opt_l := parser.Int("l", "line", &argparse.Options{Default: config.Defaults.Line, Help: fmt.Sprintf("Number of lines to group as one task (default: %d)", config.Defaults.Line)})
-	opt_t := parser.Int("t", "thread", &argparse.Options{Default: 10, Help: "Max concurrent tasks to run (default: 10)"})
+	opt_t := parser.Int("t", "thread", &argparse.Options{Default: profileThreads(profile), Help: fmt.Sprintf("Max concurrent tasks to run (default: %d)", profileThreads(profile))})
 	opt_project := parser.String("", "project", &argparse.Options{Default: config.Project, Help: fmt.Sprintf("Project name (default: %s)", config.Project)})
+	opt_timeout := parser.String("", "timeout", &argparse.Options{Required: false, Help: "Wall-clock limit per task, the process group is killed when it elapses. Supports: 3600, 90m, 2h, 1h30m, 01:30:00"})
+	opt_fail_fast := parser.Flag("", "fail-fast", &argparse.Options{Help: "Stop dispatching new tasks after the first failed task (same as --max-failures 0)"})
+	opt_max_failures := parser.String("", "max-failures", &argparse.Options{Required: false, Help: "Stop dispatching new tasks when more than N tasks (or P% of tasks) have failed. Supports: 5, 10%"})
+	opt_cancel_running := parser.Flag("", "cancel-running", &argparse.Options{Help: "Also cancel running tasks when the failure budget is exceeded"})
+	opt_require_output := parser.StringList("", "require-output", &argparse.Options{Help: "Output file (or glob) every task must leave non-empty to be successful. Repeatable or comma-separated"})
+	opt_ok_exit_codes := parser.String("", "ok-exit-codes", &argparse.Options{Required: false, Help: "Exit codes treated as success, comma-separated (default: 0)"})
+	opt_require_pattern := parser.StringList("", "require-pattern", &argparse.Options{Help: "Regex that must appear in the task's .o/.e output. Repeatable"})
+	opt_reject_pattern := parser.StringList("", "reject-pattern", &argparse.Options{Help: "Regex that must not appear in the task's .o/.e output. Repeatable"})
+	opt_manifest := parser.String("", "manifest", &argparse.Options{Help: "YAML file declaring inputs/outputs (and hooks) per task number, tasks with up-to-date outputs are skipped"})
+	opt_metrics_listen := parser.String("", "metrics-listen", &argparse.Options{Help: "Serve Prometheus metrics of this run on this address (e.g. :9101)"})
+	opt_notify_cmd := parser.String("", "notify-cmd", &argparse.Options{Help: "Shell command run on notifications, the summary is passed on stdin"})
+	opt_notify_email := parser.StringList("", "notify-email", &argparse.Options{Help: "Email address notifications are sent to with sendmail. Repeatable or comma-separated"})
+	opt_notify_webhook := parser.StringList("", "notify-webhook", &argparse.Options{Help: "Webhook URL notifications are posted to (Slack, DingTalk, WeCom or generic JSON). Repeatable"})
+	opt_notify_events := parser.String("", "notify-events", &argparse.Options{Help: "When to notify, comma-separated: complete, failed, first_failure, threshold (default: complete,first_failure,threshold)"})
+	opt_notify_threshold := parser.String("", "notify-threshold", &argparse.Options{Help: "Notify when N tasks (or P% of tasks) have failed. Supports: 5, 10%"})
+	opt_wait := parser.Flag("", "wait", &argparse.Options{Help: "If another annotask process is running the input file, wait for it instead of exiting"})
+	opt_force := parser.Flag("", "force", &argparse.Options{Help: "Run even if the pre-flight check of the task scripts finds errors"})
+	parser.String("", "profile", &argparse.Options{Help: "Named resource profile from the config (profiles:), flags given explicitly take precedence"})
+	opt_dry_run := parser.Flag("", "dry-run", &argparse.Options{Help: "Show how the input file groups into tasks and which tasks would run, without running or recording anything"})
 
 	// Prepend program name for argparse.Parse (it expects os.Args-like format)
 	parseArgs := append([]string{"annotask"}, args...)
-	err := parser.Parse(parseArgs)
+	err = parser.Parse(parseArgs)
 	if err != nil {
 		// If help is requested, show module help instead of just parser usage
 		errStr := err.Error()
@@ -48,14 +74,108 @@ func runLocalMode(config *Config, args []string) {
 	// Use placeholder values (won't be used in local mode)
 	mem := 1.0
 	h_vmem := 1.0
+
+	// Parse timeout value (0 means no limit)
+	var timeout time.Duration
+	if *opt_timeout == "" && profile != nil {
+		*opt_timeout = profile.Timeout
+	}
+	if opt_timeout != nil && *opt_timeout != "" {
+		timeout, err = parseDurationString(*opt_timeout)
+		if err != nil {
+			log.Fatalf("Error parsing --timeout value: %v", err)
+		}
+	}
+	// Validate failure budget early, the budget itself is created in runTasks once the number of tasks is known
+	if *opt_max_failures != "" {
+		if _, _, err := parseMaxFailures(*opt_max_failures); err != nil {
+			log.Fatalf("Error parsing --max-failures value: %v", err)
+		}
+	}
+
+	// Run-level success criteria (per-task criteria come from #@annotask directives in the input file)
+	criteria, err := newSuccessCriteria(*opt_require_output, *opt_ok_exit_codes, *opt_require_pattern, *opt_reject_pattern)
+	if err != nil {
+		log.Fatalf("Error parsing success criteria: %v", err)
+	}
+	manifest, err := LoadManifest(*opt_manifest)
+	if err != nil {
+		log.Fatalf("Error loading manifest: %v", err)
+	}
+	config.Notify, err = applyNotifyFlags(config.Notify, *opt_notify_cmd, *opt_notify_email, *opt_notify_webhook, *opt_notify_events, *opt_notify_threshold)
+	if err != nil {
+		log.Fatalf("Error parsing notify options: %v", err)
+	}
+	if *opt_metrics_listen != "" && !*opt_dry_run {
+		shellAbsPath, _ := filepath.Abs(*opt_i)
+		err = startMetricsServer(*opt_metrics_listen, GetCurrentUserID(), *opt_project, getFilePrefix(shellAbsPath), shellAbsPath)
+		if err != nil {
+			log.Fatalf("Error starting metrics server: %v", err)
+		}
+	}
+
 	// Local mode doesn't use DRMAA, so mem/h_vmem/queue/sge-project/mode/hostname flags are not relevant
-	// Build command string from original args
-	command := "annotask local " + strings.Join(args, " ")
-	runTasks(config, *opt_i, *opt_l, *opt_t, *opt_project, ModeLocal, config.Defaults.CPU, mem, h_vmem, false, false, "", "", "pe_smp", command, "")
+	opts := runOptions{
+		Infile:          *opt_i,
+		Line:            *opt_l,
+		Thread:          *opt_t,
+		Project:         *opt_project,
+		Mode:            ModeLocal,
+		Command:         formatCommand("local", args),
+		CPU:             config.Defaults.CPU,
+		Mem:             mem,
+		HVmem:           h_vmem,
+		ParallelEnvMode: "pe_smp",
+		Timeout:         timeout,
+		MaxFailures:     *opt_max_failures,
+		FailFast:        *opt_fail_fast,
+		CancelRunning:   *opt_cancel_running,
+		Criteria:        criteria,
+		Manifest:        manifest,
+		WaitLock:        *opt_wait,
+		Force:           *opt_force,
+	}
+	if *opt_dry_run {
+		if err := dryRun(os.Stdout, opts, config.Hooks); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	runTasks(config, opts)
+}
+
+// runOptions are the settings of a run, filled in from the flags of annotask local and qsubsge (and so of annotask rerun)
+type runOptions struct {
+	Infile  string
+	Line    int // Lines grouped as one task (-l)
+	Thread  int // Max concurrent tasks (-t)
+	Project string
+	Mode    JobMode
+	Command string // Command line of the run, recorded in the global database
+
+	// Resources of each task, only requested from SGE in qsubsge mode
+	CPU                      int
+	Mem, HVmem               float64 // GB
+	UserSetMem, UserSetHvmem bool    // Mem and HVmem were set explicitly (flags or profile)
+	Queue                    string
+	SgeProject               string
+	ParallelEnvMode          string // pe_smp or num_proc
+	Hostname                 string // Execution hosts (qsubsge --hostname)
+	Timeout                  time.Duration
+
+	// Failure budget (--max-failures / --fail-fast / --cancel-running) and success criteria
+	MaxFailures             string
+	FailFast, CancelRunning bool
+	Criteria                *SuccessCriteria
+	Manifest                Manifest
+
+	WaitLock bool // --wait: wait for another process holding the input lock
+	Force    bool // --force: run despite pre-flight errors
 }
 
 // runTasks is the common function to run tasks in both modes
-func runTasks(config *Config, infile string, line, thread int, project string, mode JobMode, cpu int, mem, h_vmem float64, userSetMem, userSetHvmem bool, queue string, sgeProject string, parallelEnvMode string, command string, hostname string) {
+func runTasks(config *Config, opts runOptions) {
+	infile, mode, project, command := opts.Infile, opts.Mode, opts.Project, opts.Command
 
 	// Initialize global DB
 	globalDB, err := InitGlobalDB(config.Db)
@@ -68,35 +188,132 @@ func runTasks(config *Config, infile string, line, thread int, project string, m
 	usrID := GetCurrentUserID()
 	shellAbsPath, _ := filepath.Abs(infile)
 	module := getFilePrefix(shellAbsPath)
+
+	// Only one annotask process may run an input file at a time, others would race on {input}.db and the .shell scripts
+	// annotask rerun takes the lock itself before resetting the tasks (rerunLock)
+	lockHost, _ := os.Hostname()
+	inputLock := rerunLock
+	var locked *LockedError
+	if inputLock == nil {
+		inputLock, err = acquireInputLock(shellAbsPath, LockHolder{Host: lockHost, PID: os.Getpid(), Command: command}, opts.WaitLock)
+	}
+	if errors.As(err, &locked) {
+		msg := fmt.Sprintf("Error: %s is already being run by another annotask process", infile)
+		if locked.Holder != nil {
+			msg += fmt.Sprintf(" (%s)", locked.Holder)
+			if locked.Holder.Command != "" {
+				msg += "\n  " + locked.Holder.Command
+			}
+		}
+		msg += "\nWait for it to finish with --wait"
+		if locked.Holder != nil && locked.Holder.RunID != "" {
+			msg += ", or stop it with: annotask delete -k " + locked.Holder.RunID
+		}
+		log.Fatal(msg)
+	} else if err != nil {
+		log.Printf("Warning: Running %s without lock: %v", infile, err)
+	}
+	defer inputLock.Release()
+
+	// The run starts once the lock is held, with --wait that may be much later
 	startTime := time.Now()
+	runID := newRunID(startTime)
+	inputLock.SetHolder(LockHolder{Host: lockHost, PID: os.Getpid(), RunID: runID, Command: command})
 
-	dbObj := Creat_tb(infile, line, mode)
+	dbObj := Creat_tb(infile, opts.Line, mode, opts.Manifest, config.Hooks)
+
+	// Relative paths in success criteria are resolved against the directory tasks run in:
+	// current directory for local mode, {script}.shell for qsubsge mode (jobs run with -cwd there)
+	workDir, _ := os.Getwd()
+	if mode == ModeQsubSge {
+		workDir = shellAbsPath + ".shell"
+	}
 
 	// Check .sign files and update task status before starting
-	// Tasks with .sign files are marked as finished, others are marked as pending
-	err = CheckSignFilesAndUpdateStatus(dbObj)
+	// Tasks with .sign files are marked as finished (if they pass success criteria), others are marked as pending
+	err = CheckSignFilesAndUpdateStatus(dbObj, opts.Criteria, workDir)
 	if err != nil {
 		log.Printf("Warning: Failed to check sign files: %v", err)
 	}
 
-	need2run := GetNeed2Run(dbObj)
+	need2run := rerunSelection.Filter(GetNeed2Run(dbObj))
 	fmt.Println(need2run)
 
+	// Pre-flight check before anything is dispatched or recorded, typos are cheaper to fix now than after queueing
+	if len(need2run) > 0 {
+		issues, err := preflightTasks(dbObj, need2run, mode, opts.Queue, opts.SgeProject, workDir)
+		if err != nil {
+			log.Printf("Warning: Pre-flight check failed: %v", err)
+		}
+		if errorCount := logPreflightIssues(issues); errorCount > 0 {
+			if !opts.Force {
+				inputLock.Release()
+				log.Fatalf("Error: Pre-flight check found %d error(s), fix them or run again with --force", errorCount)
+			}
+			log.Printf("Warning: Pre-flight check found %d error(s), running anyway (--force)", errorCount)
+		}
+	}
+
+	// Task state transitions are appended to {input}.events.jsonl as they happen
+	eventLog, err = OpenEventLog(shellAbsPath + ".events.jsonl")
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	defer eventLog.Close()
+	total, pending, failed, running, finished, _ := GetTaskStats(dbObj)
+	eventLog.Emit(TaskEvent{Event: EventRunStart, Mode: string(mode), Summary: &EventSummary{
+		Project: project, Module: module, Total: total, ToRun: len(need2run), Finished: finished, Failed: failed, Pending: pending,
+	}})
+
+	// Failure budget (--fail-fast / --max-failures), percentages are relative to the tasks to run now
+	// qsubsge tasks are retried up to retry.max times, they only count as failed once no attempt is left
+	maxAttempts := 1
+	if mode == ModeQsubSge {
+		maxAttempts = config.Retry.Max
+	}
+	budget, err := NewFailureBudget(opts.MaxFailures, opts.FailFast, opts.CancelRunning, len(need2run), maxAttempts)
+	if err != nil {
+		log.Fatalf("Invalid failure budget: %v", err)
+	}
+
 	// Immediately insert task record into global database
 	// This ensures the task appears in the database right away
-	total, pending, failed, running, finished, _ := GetTaskStats(dbObj)
 	node := GetNodeName(string(mode), config, dbObj)
 	pid := os.Getpid() // Get main process PID
-	err = UpdateGlobalTaskRecord(globalDB, usrID, project, module, string(mode), shellAbsPath, startTime, total, pending, failed, running, finished, node, pid)
+	err = UpdateGlobalTaskRecord(globalDB, runID, usrID, project, module, string(mode), shellAbsPath, startTime, total, pending, failed, running, finished, node, pid)
 	if err != nil {
 		log.Printf("Warning: Failed to create initial task record in global DB: %v", err)
 	}
+	if err := dbObj.RecordLocalRun(runID, startTime, mode, node, pid); err != nil {
+		log.Printf("Warning: Could not record run %s in local database: %v", runID, err)
+	}
+	// The command line and parameters are kept so the run can be repeated (annotask rerun) and audited
+	params, err := encodeRunParams(config, opts)
+	if err != nil {
+		log.Printf("Warning: Could not encode run parameters: %v", err)
+	}
+	cwd, _ := os.Getwd()
+	if err := UpdateGlobalTaskParams(globalDB, runID, command, cwd, params); err != nil {
+		log.Printf("Warning: Could not record parameters of the run: %v", err)
+	}
+
+	// CPU-hours and memory-hours of this run, updated with the global record
+	runUsage, err = NewUsageRecorder(globalDB, dbObj, runID)
+	if err != nil {
+		log.Printf("Warning: Usage accounting disabled: %v", err)
+	}
+
+	// Notifications (notify config and --notify-* flags) on task failures and run completion
+	runNotifier, err = NewNotifier(config.Notify, len(need2run), dbObj, usrID, project, module, shellAbsPath, mode, node, startTime)
+	if err != nil {
+		log.Printf("Warning: Notifications disabled: %v", err)
+	}
 
 	// Start task status monitor goroutine
 	ctx, cancel := context.WithCancel(context.Background())
 	var wg sync.WaitGroup
 	wg.Add(1)
-	go MonitorTaskStatus(ctx, dbObj, globalDB, usrID, project, module, string(mode), shellAbsPath, startTime, config, &wg, command)
+	go MonitorTaskStatus(ctx, dbObj, globalDB, runID, usrID, project, module, string(mode), shellAbsPath, startTime, config, &wg, command)
 
 	// Create write_pool at runTasks level to ensure it outlives all goroutines
 	// This prevents WaitGroup reuse issues when monitoring loops continue after IlterCommand returns
@@ -131,16 +348,16 @@ func runTasks(config *Config, infile string, line, thread int, project string, m
 	if mode == ModeQsubSge {
 		maxRetries := config.Retry.Max
 		for retryCount := 0; retryCount < maxRetries; retryCount++ {
-			IlterCommand(ctx, dbObj, thread, need2run, mode, cpu, mem, h_vmem, userSetMem, userSetHvmem, queue, sgeProject, parallelEnvMode, write_pool, hostname)
-			need2run = GetNeed2Run(dbObj)
-			if len(need2run) == 0 {
+			IlterCommand(ctx, dbObj, need2run, opts, write_pool, budget)
+			need2run = rerunSelection.Filter(GetNeed2Run(dbObj))
+			if len(need2run) == 0 || budget.Exceeded() {
 				break
 			}
 			time.Sleep(2 * time.Second)
 		}
 	} else {
-		// Local mode: run once without retry (hostname is not used in local mode)
-		IlterCommand(ctx, dbObj, thread, need2run, mode, cpu, mem, h_vmem, userSetMem, userSetHvmem, queue, sgeProject, parallelEnvMode, write_pool, "")
+		// Local mode: run once without retry
+		IlterCommand(ctx, dbObj, need2run, opts, write_pool, budget)
 	}
 
 	// Wait for all database write operations to complete
@@ -156,33 +373,51 @@ func runTasks(config *Config, infile string, line, thread int, project string, m
 	total, pending, failed, running, finished, _ = GetTaskStats(dbObj)
 	node = GetNodeName(string(mode), config, dbObj)
 	pid = os.Getpid() // Get main process PID
-	UpdateGlobalTaskRecord(globalDB, usrID, project, module, string(mode), shellAbsPath, startTime, total, pending, failed, running, finished, node, pid)
+	UpdateGlobalTaskRecord(globalDB, runID, usrID, project, module, string(mode), shellAbsPath, startTime, total, pending, failed, running, finished, node, pid)
+	runUsage.Update(dbObj)
 	// Update endtime
-	startTimeStr := startTime.Format("2006-01-02 15:04:05")
 	endTimeStr := endTime.Format("2006-01-02 15:04:05")
-	_, err = globalDB.Db.Exec("UPDATE tasks SET endtime=? WHERE usrID=? AND project=? AND module=? AND starttime=?",
-		endTimeStr, usrID, project, module, startTimeStr)
+	_, err = globalDB.Db.Exec("UPDATE tasks SET endtime=? WHERE runID=?", endTimeStr, runID)
 	if err != nil {
 		log.Printf("Warning: Could not update endtime: %v", err)
 	}
 
 	// Update module status based on final task results
-	// Check if there are any failed tasks (exitCode != 0)
+	// Check if there are any failed tasks
 	var failedCount int
-	err = dbObj.Db.QueryRow("SELECT COUNT(*) FROM job WHERE exitCode!=0").Scan(&failedCount)
+	runStatus := "completed"
+	runReason := ""
+	if budget.Exceeded() {
+		runReason = "failure budget exceeded"
+	}
+	err = dbObj.Db.QueryRow("SELECT COUNT(*) FROM job WHERE status=?", J_failed).Scan(&failedCount)
 	if err != nil {
 		log.Printf("Warning: Could not check failed tasks count: %v", err)
 	} else {
-		if failedCount > 0 {
-			if updateErr := UpdateGlobalTaskStatus(globalDB, usrID, project, module, startTime, "failed"); updateErr != nil {
-				log.Printf("Warning: Could not update module status to failed: %v", updateErr)
+		if failedCount > 0 || budget.Exceeded() {
+			runStatus = "failed"
+			if updateErr := UpdateGlobalTaskStatus(globalDB, runID, runStatus); updateErr != nil {
+				log.Printf("Warning: Could not update module status to %s: %v", runStatus, updateErr)
 			}
 		} else {
-			if updateErr := UpdateGlobalTaskStatus(globalDB, usrID, project, module, startTime, "completed"); updateErr != nil {
+			if updateErr := UpdateGlobalTaskStatus(globalDB, runID, "completed"); updateErr != nil {
 				log.Printf("Warning: Could not update module status to completed: %v", updateErr)
 			}
 		}
 	}
 
+	if budget.Exceeded() {
+		budgetFailed, budgetLimit := budget.Summary()
+		os.Stderr.WriteString(fmt.Sprintf("Failure budget exceeded: %d task(s) failed (limit: %d), %d task(s) not run\n", budgetFailed, budgetLimit, pending))
+	}
+
+	eventLog.Emit(TaskEvent{Event: EventRunEnd, Mode: string(mode), Reason: runReason, Duration: endTime.Sub(startTime).Seconds(), Summary: &EventSummary{
+		Project: project, Module: module, Status: runStatus, Total: total, Finished: finished, Failed: failed, Pending: pending,
+	}})
+
+	runNotifier.RunEnd(runStatus, runReason)
+
+	// CheckExitCode exits the process, deferred calls don't run
+	inputLock.Release()
 	CheckExitCode(dbObj)
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// LockHolder is the process holding the lock of an input file, recorded in {input}.lock
+type LockHolder struct {
+	Host    string `json:"host"`
+	PID     int    `json:"pid"`
+	RunID   string `json:"runId,omitempty"`
+	Since   string `json:"since"`
+	Command string `json:"command,omitempty"`
+}
+
+func (h *LockHolder) String() string {
+	s := fmt.Sprintf("pid %d on %s", h.PID, orDash(h.Host))
+	if h.RunID != "" {
+		s += ", run " + h.RunID
+	}
+	if h.Since != "" {
+		s += ", since " + h.Since
+	}
+	return s
+}
+
+// InputLock is an exclusive lock (flock) on {input}.lock, held while an input file is run
+// The lock is released by the OS if the process dies, so a stale holder record never blocks a run
+type InputLock struct {
+	file *os.File
+}
+
+// LockedError is returned when another process holds the lock of an input file
+type LockedError struct {
+	Path   string
+	Holder *LockHolder // nil if the holder record couldn't be read
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("%s is locked by another annotask process", e.Path)
+	}
+	return fmt.Sprintf("%s is locked by annotask %s", e.Path, e.Holder)
+}
+
+// acquireInputLock locks {shellPath}.lock and writes holder into it
+// If another process holds the lock, a *LockedError is returned, or with wait the call blocks until it is released
+func acquireInputLock(shellPath string, holder LockHolder, wait bool) (*InputLock, error) {
+	path := shellPath + ".lock"
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		current := readLockHolder(file)
+		if !wait {
+			file.Close()
+			return nil, &LockedError{Path: path, Holder: current}
+		}
+		if current != nil {
+			log.Printf("Waiting for %s to be released by annotask %s", path, current)
+		} else {
+			log.Printf("Waiting for %s to be released", path)
+		}
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+
+	l := &InputLock{file: file}
+	l.SetHolder(holder)
+	return l, nil
+}
+
+// SetHolder replaces the holder record of the lock, e.g. once the run ID of the holder is known
+func (l *InputLock) SetHolder(holder LockHolder) {
+	if l == nil || l.file == nil {
+		return
+	}
+	holder.Since = time.Now().Format("2006-01-02 15:04:05")
+	data, _ := json.Marshal(holder)
+	if err := l.file.Truncate(0); err == nil {
+		_, err = l.file.WriteAt(append(data, '\n'), 0)
+		if err != nil {
+			log.Printf("Warning: Could not write lock holder to %s: %v", l.file.Name(), err)
+		}
+	}
+}
+
+// readLockHolder reads the holder record of a lock file, nil if there is none
+func readLockHolder(file *os.File) *LockHolder {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<16))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var holder LockHolder
+	if err := json.Unmarshal(data, &holder); err != nil {
+		return nil
+	}
+	return &holder
+}
+
+// Release clears the holder record and unlocks the lock file
+// A nil or released *InputLock does nothing
+func (l *InputLock) Release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+}
@@ -6,15 +6,25 @@ import (
 	"os"
 )
 
+// Version is the version of annotask, also recorded in the parameters of each run
+const Version = "1.9.7"
+
 // printModuleList prints list of available modules
 func printModuleList() {
-	fmt.Println("annotask - parallel task v1.9.7")
+	fmt.Println("annotask - parallel task v" + Version)
 	fmt.Println()
 	fmt.Println("Available modules:")
 	fmt.Println("    local             Run tasks locally (default module)")
 	fmt.Println("    qsubsge           Submit tasks to qsub SGE system")
 	fmt.Println("    stat              Query task status from global database")
 	fmt.Println("    delete            Delete task records from global database")
+	fmt.Println("    top               Live terminal dashboard of runs and tasks")
+	fmt.Println("    serve             Serve a read-only web dashboard and JSON API")
+	fmt.Println("    reconcile         Mark runs whose annotask process died as interrupted")
+	fmt.Println("    report            Report CPU-hours and memory-hours by project, module, user or month")
+	fmt.Println("    rerun             Rerun failed or selected tasks of a run")
+	fmt.Println("    doctor            Diagnose the config, global database and SGE environment")
+	fmt.Println("    config            Show, check and edit the config files")
 	fmt.Println()
 	fmt.Println("Usage:")
 	fmt.Println("    annotask                    Show this help")
@@ -39,6 +49,25 @@ func printModuleHelp(module string, config *Config) {
 		fmt.Println("    -l, --line        Number of lines to group as one task (default: 1)")
 		fmt.Println("    -t, --thread      Max concurrent tasks to run (default: 10)")
 		fmt.Println("    --project         Project name (default: default)")
+		fmt.Println("    --timeout         Wall-clock limit per task, kills the task's process group when exceeded. Supports: 3600, 90m, 2h, 01:30:00")
+		fmt.Println("    --fail-fast       Stop dispatching new tasks after the first failed task")
+		fmt.Println("    --max-failures    Stop dispatching new tasks when more than N tasks (or P%) have failed. Supports: 5, 10%")
+		fmt.Println("    --cancel-running  Also kill running tasks when the failure budget is exceeded")
+		fmt.Println("    --require-output  Output file (or glob) every task must leave non-empty. Repeatable or comma-separated")
+		fmt.Println("    --ok-exit-codes   Exit codes treated as success, comma-separated (default: 0)")
+		fmt.Println("    --require-pattern Regex that must appear in the task's .o/.e output. Repeatable")
+		fmt.Println("    --reject-pattern  Regex that must not appear in the task's .o/.e output. Repeatable")
+		fmt.Println("    --manifest        YAML file declaring inputs/outputs (and hooks) per task number, tasks with up-to-date outputs are skipped")
+		fmt.Println("    --metrics-listen  Serve Prometheus metrics of this run on this address (e.g. :9101)")
+		fmt.Println("    --notify-cmd      Shell command run on notifications, the summary is passed on stdin")
+		fmt.Println("    --notify-email    Email address notified via sendmail. Repeatable or comma-separated")
+		fmt.Println("    --notify-webhook  Webhook URL to post notifications to (Slack, DingTalk, WeCom or generic JSON). Repeatable")
+		fmt.Println("    --notify-events   When to notify: complete, failed, first_failure, threshold (default: complete,first_failure,threshold)")
+		fmt.Println("    --notify-threshold Notify when N tasks (or P%) have failed. Supports: 5, 10%")
+		fmt.Println("    --wait            If another annotask process is running the input file, wait for it instead of exiting")
+		fmt.Println("    --force           Run even if the pre-flight check of the task scripts finds errors")
+		fmt.Println("    --profile         Named resource profile from the config (profiles:), explicit flags take precedence")
+		fmt.Println("    --dry-run         Show how the input file groups into tasks and which tasks would run, without running anything")
 	case "qsubsge":
 		fmt.Println("annotask qsubsge - Submit tasks to qsub SGE system")
 		fmt.Println()
@@ -58,25 +87,195 @@ func printModuleHelp(module string, config *Config) {
 		fmt.Println("    -P, --sge-project  SGE project name for resource quota management (default: from config)")
 		fmt.Println("    --mode             Parallel environment mode: pe_smp (use -pe smp X) or num_proc (use -l p=X, default)")
 		fmt.Println("    --hostname         Specify hostname(s) for job execution. Supports single hostname or comma-separated list (e.g., node1 or node1,node2). Maps to -l h=hostname in SGE")
+		fmt.Println("    --timeout          Wall-clock limit per task (maps to -l h_rt=HH:MM:SS, increased by 125% on retry if exceeded). Supports: 3600, 90m, 2h, 01:30:00")
+		fmt.Println("    --fail-fast        Stop dispatching new tasks (and retries) after the first failed task")
+		fmt.Println("    --max-failures     Stop dispatching new tasks when more than N tasks (or P%) have failed. Supports: 5, 10%")
+		fmt.Println("    --cancel-running   Also terminate running SGE jobs when the failure budget is exceeded")
+		fmt.Println("    --require-output   Output file (or glob) every task must leave non-empty, relative to {input}.shell. Repeatable or comma-separated")
+		fmt.Println("    --ok-exit-codes    Exit codes treated as success, comma-separated (default: 0)")
+		fmt.Println("    --require-pattern  Regex that must appear in the job's .o/.e output. Repeatable")
+		fmt.Println("    --reject-pattern   Regex that must not appear in the job's .o/.e output. Repeatable")
+		fmt.Println("    --manifest         YAML file declaring inputs/outputs (and hooks) per task number, tasks with up-to-date outputs are skipped")
+		fmt.Println("    --metrics-listen   Serve Prometheus metrics of this run on this address (e.g. :9101)")
+		fmt.Println("    --notify-cmd       Shell command run on notifications, the summary is passed on stdin")
+		fmt.Println("    --notify-email     Email address notified via sendmail. Repeatable or comma-separated")
+		fmt.Println("    --notify-webhook   Webhook URL to post notifications to (Slack, DingTalk, WeCom or generic JSON). Repeatable")
+		fmt.Println("    --notify-events    When to notify: complete, failed, first_failure, threshold (default: complete,first_failure,threshold)")
+		fmt.Println("    --notify-threshold Notify when N tasks (or P%) have failed. Supports: 5, 10%")
+		fmt.Println("    --wait             If another annotask process is running the input file, wait for it instead of exiting")
+		fmt.Println("    --force            Run even if the pre-flight check of the task scripts or the queue/project finds errors")
+		fmt.Println("    --profile          Named resource profile from the config (profiles:): cpu, mem, h_vmem, queue, sge_project, line, thread, timeout. Explicit flags take precedence")
+		fmt.Println("    --dry-run          Show how the input file groups into tasks, which tasks would run and their qsub options, without submitting anything")
 	case "stat":
 		fmt.Println("annotask stat - Query task status from global database")
 		fmt.Println()
 		fmt.Println("USAGE:")
-		fmt.Println("    annotask stat [-p|--project <project>]")
+		fmt.Println("    annotask stat [-p|--project <project>] [filters] [--sort <field>] [--limit <n>] [--format table|json|csv|tsv] [--fields <fields>]")
+		fmt.Println("    annotask stat -k|--id <id> --tasks [--failed] [--status <status>] [--format table|json|csv|tsv] [--fields <fields>]")
 		fmt.Println()
 		fmt.Println("OPTIONS:")
 		fmt.Println("    -h, --help        Print help information")
 		fmt.Println("    -p, --project     Filter by project name")
+		fmt.Println("    --format          Output format: table (default), json, csv or tsv")
+		fmt.Println("    --fields          Comma-separated fields to output, e.g. id,module,status,failed")
+		fmt.Println("                      Fields: id,user,project,module,mode,status,total,pending,running,failed,finished,")
+		fmt.Println("                      starttime,endtime,elapsed,node,pid,cpuHours,memHours,shellPath")
+		fmt.Println("    --status          Filter by run status: running, completed, failed, interrupted (comma-separated)")
+		fmt.Println("    --since           Only runs started at or after this time: 2024-12-01, '2024-12-01 08:00', or 7d/12h/30m ago")
+		fmt.Println("    --until           Only runs started before this time (a date alone includes that day)")
+		fmt.Println("    --module          Filter by module name glob, e.g. 'align*'")
+		fmt.Println("    --mode            Filter by mode: local or qsubsge")
+		fmt.Println("    --node            Filter by node (glob) annotask ran on")
+		fmt.Println("    --user            Show usage of this user instead of the current user (admins only)")
+		fmt.Println("    --all-users       Show usage of all users per user and project: runs, active runs,")
+		fmt.Println("                      running/pending/failed tasks, CPU-hours (admins only)")
+		fmt.Println("    --sort            Sort by field[:asc|desc], e.g. starttime:desc, failed:desc, elapsed")
+		fmt.Println("    --limit           Show at most N runs")
+		fmt.Println("    -k, --id          Only show the run with this ID or run ID (or a unique prefix of it)")
+		fmt.Println("    --tasks           List the tasks of the run given by -k/--id (--status then filters tasks:")
+		fmt.Println("                      pending, running, failed, finished). Fields: task,status,retry,taskid,node,")
+		fmt.Println("                      exitCode,starttime,endtime,duration,mem,h_vmem,reason,shellPath,stderr")
+		fmt.Println("    --failed          With --tasks, only list failed tasks (same as --status failed)")
 	case "delete":
 		fmt.Println("annotask delete - Delete task records from global database")
 		fmt.Println()
 		fmt.Println("USAGE:")
 		fmt.Println("    annotask delete -p|--project <project> [-m|--module <module>]")
+		fmt.Println("    annotask delete -k|--id <id>")
 		fmt.Println()
 		fmt.Println("OPTIONS:")
 		fmt.Println("    -h, --help        Print help information")
 		fmt.Println("    -p, --project     Project name (required)")
 		fmt.Println("    -m, --module      Module (shell path basename without extension)")
+		fmt.Println("    -k, --id          Task ID or run ID (from stat -p output)")
+	case "top":
+		fmt.Println("annotask top - Live terminal dashboard of runs and tasks")
+		fmt.Println()
+		fmt.Println("USAGE:")
+		fmt.Println("    annotask top [-p|--project <project>] [-k|--id <id>] [-n|--interval <interval>]")
+		fmt.Println()
+		fmt.Println("OPTIONS:")
+		fmt.Println("    -h, --help        Print help information")
+		fmt.Println("    -p, --project     Only show runs of this project")
+		fmt.Println("    -k, --id          Show tasks of the run with this ID or run ID (from annotask stat -p)")
+		fmt.Println("    -n, --interval    Refresh interval (default: 2s)")
+		fmt.Println()
+		fmt.Println("KEYS:")
+		fmt.Println("    up/down, j/k      Select run or task")
+		fmt.Println("    enter             Show tasks of the selected run")
+		fmt.Println("    f                 Toggle failed tasks only")
+		fmt.Println("    b, esc            Back to run list")
+		fmt.Println("    q                 Quit")
+	case "serve":
+		fmt.Println("annotask serve - Serve a read-only web dashboard and JSON API")
+		fmt.Println()
+		fmt.Println("USAGE:")
+		fmt.Println("    annotask serve [--listen <addr>] [--all-users]")
+		fmt.Println()
+		fmt.Println("OPTIONS:")
+		fmt.Println("    -h, --help        Print help information")
+		fmt.Println("    --listen          Address to listen on (default: :8080)")
+		fmt.Println("    --all-users       Serve runs of all users (default: only the current user)")
+		fmt.Println()
+		fmt.Println("API:")
+		fmt.Println("    GET /api/projects                          Project summaries")
+		fmt.Println("    GET /api/runs[?project=&status=]           Runs")
+		fmt.Println("    GET /api/runs/{id}                         Run and its tasks")
+		fmt.Println("    GET /api/runs/{id}/tasks/{num}             Task and its attempts")
+		fmt.Println("    GET /api/runs/{id}/tasks/{num}/log         Log tail (?stream=o|e&attempt=<jobid>&lines=200)")
+		fmt.Println("    GET /metrics                               Prometheus metrics of the latest run of each module")
+	case "reconcile":
+		fmt.Println("annotask reconcile - Mark runs whose annotask process died as interrupted")
+		fmt.Println()
+		fmt.Println("USAGE:")
+		fmt.Println("    annotask reconcile [-p|--project <project>] [-k|--id <id>] [-n|--dry-run] [--no-ssh]")
+		fmt.Println()
+		fmt.Println("OPTIONS:")
+		fmt.Println("    -h, --help        Print help information")
+		fmt.Println("    -p, --project     Only check runs of this project")
+		fmt.Println("    -k, --id          Only check the run with this ID or run ID")
+		fmt.Println("    -n, --dry-run     Only report stale runs, don't change the databases")
+		fmt.Println("    --no-ssh          Don't check runs recorded on other nodes via SSH")
+		fmt.Println()
+		fmt.Println("Runs recorded as running whose annotask process (pid on node) is gone are marked interrupted,")
+		fmt.Println("their running tasks are marked Failed, and SGE jobs they left behind are listed for qdel.")
+	case "report":
+		fmt.Println("annotask report - Report CPU-hours and memory-hours by project, module, user or month")
+		fmt.Println()
+		fmt.Println("USAGE:")
+		fmt.Println("    annotask report [--by project,module,user,month] [-p <project>] [--since <time>] [--until <time>]")
+		fmt.Println("                    [--user <user>|--all-users] [--format table|csv|tsv|markdown|json]")
+		fmt.Println()
+		fmt.Println("OPTIONS:")
+		fmt.Println("    -h, --help        Print help information")
+		fmt.Println("    --by              Group by: project, module, user, month (comma-separated, default: project)")
+		fmt.Println("    -p, --project     Only runs of this project")
+		fmt.Println("    --module          Only runs of modules matching this glob")
+		fmt.Println("    --since           Only runs started at or after this time: 2024-12-01, '2024-12-01 08:00', or 30d ago")
+		fmt.Println("    --until           Only runs started before this time (a date alone includes that day)")
+		fmt.Println("    --user            Report runs of this user (admins only)")
+		fmt.Println("    --all-users       Report runs of all users (admins only)")
+		fmt.Println("    --format          Output format: table (default), csv, tsv, markdown or json")
+		fmt.Println()
+		fmt.Println("cpu_hours is the sum of wall time x CPU slots of every task attempt; mem_hours (GB-hours) uses the")
+		fmt.Println("memory requested from SGE (vf, else h_vmem, else peak maxvmem) or the peak RSS of local tasks.")
+	case "rerun":
+		fmt.Println("annotask rerun - Rerun failed or selected tasks of a run")
+		fmt.Println()
+		fmt.Println("USAGE:")
+		fmt.Println("    annotask rerun -k|--id <id> [--failed|--tasks <list>] [--mem <mem>] [--h_vmem <h_vmem>] [--queue <queue>]")
+		fmt.Println()
+		fmt.Println("OPTIONS:")
+		fmt.Println("    -h, --help        Print help information")
+		fmt.Println("    -k, --id          ID or run ID of the run (from annotask stat)")
+		fmt.Println("    --failed          Rerun the failed tasks (default)")
+		fmt.Println("    --tasks           Rerun these tasks, even if they finished: 3,17,40-55")
+		fmt.Println("    --mem             Override the virtual memory (vf) per task (qsubsge only)")
+		fmt.Println("    --h_vmem          Override the hard virtual memory limit per task (qsubsge only)")
+		fmt.Println("    --queue           Override the queue(s) (qsubsge only)")
+		fmt.Println()
+		fmt.Println("The run is resumed with its original command line, in the directory it was started in.")
+		fmt.Println("Only the selected tasks run, other unfinished tasks are left as they are.")
+	case "doctor":
+		fmt.Println("annotask doctor - Diagnose the config, global database and SGE environment")
+		fmt.Println()
+		fmt.Println("USAGE:")
+		fmt.Println("    annotask doctor [--no-sge]")
+		fmt.Println()
+		fmt.Println("OPTIONS:")
+		fmt.Println("    -h, --help        Print help information")
+		fmt.Println("    --no-sge          Skip the SGE checks (local mode only)")
+		fmt.Println()
+		fmt.Println("Reports the config files loaded and the effective config with the source of each value,")
+		fmt.Println("checks that the global database is writable and on a local filesystem (SQLite WAL mode),")
+		fmt.Println("and that settings.sh resolves, a DRMAA session opens and this node may run qsubsge.")
+		fmt.Println("Exits with status 1 if a check fails.")
+	case "config":
+		fmt.Println("annotask config - Show, check and edit the config files")
+		fmt.Println()
+		fmt.Println("USAGE:")
+		fmt.Println("    annotask config show [--effective] [--show-secrets] [--profile <name>] [--project <p>] [--queue <q>] [-P <sge_project>] [-l <n>] [--cpu <n>]")
+		fmt.Println("    annotask config get <key>")
+		fmt.Println("    annotask config set <key> <value> [--system]")
+		fmt.Println("    annotask config validate [file]")
+		fmt.Println("    annotask config path")
+		fmt.Println()
+		fmt.Println("COMMANDS:")
+		fmt.Println("    show              Print the effective config (system config merged with the user config)")
+		fmt.Println("    get               Print the effective value of a key, e.g. retry.max")
+		fmt.Println("    set               Set a key in the user config, keeping its comments")
+		fmt.Println("    validate          Check the config files for unknown keys and values of the wrong type")
+		fmt.Println("    path              Print the paths of the system and user config")
+		fmt.Println()
+		fmt.Println("OPTIONS:")
+		fmt.Println("    -h, --help        Print help information")
+		fmt.Println("    --effective       show: one setting per line with its source (default, system, user, profile or flag)")
+		fmt.Println("    --show-secrets    show: print webhook URLs, hidden by default")
+		fmt.Println("    --profile, --project, --queue, -P/--sge-project, -l/--line, --cpu")
+		fmt.Println("                      show --effective: values as given to local/qsubsge, reported with source flag")
+		fmt.Println("    --system          set: write to the system config next to the executable (db, sgeenv, admins)")
+		fmt.Println()
+		fmt.Println("Values of set are parsed as YAML: annotask config set node \"[login01, login02]\"")
 	default:
 		fmt.Printf("Unknown module: %s\n", module)
 		fmt.Println()
@@ -86,7 +285,7 @@ func printModuleHelp(module string, config *Config) {
 
 // isModuleName checks if the argument is a module name
 func isModuleName(arg string) bool {
-	modules := []string{"local", "qsubsge", "stat", "delete"}
+	modules := []string{"local", "qsubsge", "stat", "delete", "top", "serve", "reconcile", "report", "rerun", "doctor", "config"}
 	for _, m := range modules {
 		if arg == m {
 			return true
@@ -110,6 +309,12 @@ func main() {
 		return
 	}
 
+	// The config module loads the config itself, so that a config file that fails to load can be validated and fixed
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		RunConfigModule(os.Args[2:])
+		return
+	}
+
 	// Load configuration
 	config, err := LoadConfig()
 	if err != nil {
@@ -145,6 +350,24 @@ func main() {
 			case "delete":
 				RunDeleteModule(config, os.Args[2:])
 				return
+			case "top":
+				RunTopModule(config, os.Args[2:])
+				return
+			case "serve":
+				RunServeModule(config, os.Args[2:])
+				return
+			case "reconcile":
+				RunReconcileModule(config, os.Args[2:])
+				return
+			case "report":
+				RunReportModule(config, os.Args[2:])
+				return
+			case "rerun":
+				RunRerunModule(config, os.Args[2:])
+				return
+			case "doctor":
+				RunDoctorModule(config, os.Args[2:])
+				return
 			case "qsubsge":
 				// QsubSge mode as subcommand
 				runQsubSgeMode(config, os.Args[2:])
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// taskDurationBuckets are the upper bounds (seconds) of the task duration histogram
+var taskDurationBuckets = []float64{10, 60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400}
+
+// durationHistogram is a cumulative histogram of task durations
+type durationHistogram struct {
+	counts []uint64 // Per bucket (not cumulative), one extra for +Inf
+	sum    float64
+	count  uint64
+}
+
+func newDurationHistogram() *durationHistogram {
+	return &durationHistogram{counts: make([]uint64, len(taskDurationBuckets)+1)}
+}
+
+// observe adds one duration in seconds
+func (h *durationHistogram) observe(seconds float64) {
+	i := sort.SearchFloat64s(taskDurationBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// TaskMetrics collects counters and task durations of the current annotask process for /metrics
+// Task status gauges are read from the local database when scraped
+type TaskMetrics struct {
+	mu                 sync.Mutex
+	submissions        map[string]uint64 // By mode
+	attempted          map[int]bool      // Tasks started by this process, to count retries
+	retries            uint64
+	oomEscalations     uint64
+	timeoutEscalations uint64
+	drmaaErrors        uint64
+	durations          map[string]*durationHistogram // By result: finished or failed
+}
+
+// processMetrics collects metrics of the current process, served by --metrics-listen
+var processMetrics = newTaskMetrics()
+
+func newTaskMetrics() *TaskMetrics {
+	return &TaskMetrics{
+		submissions: make(map[string]uint64),
+		attempted:   make(map[int]bool),
+		durations:   make(map[string]*durationHistogram),
+	}
+}
+
+// RecordSubmission records a started (local) or submitted (qsubsge) task
+// Starting a task again in the same process counts as a retry
+func (m *TaskMetrics) RecordSubmission(mode JobMode, N int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.submissions[string(mode)]++
+	if m.attempted[N] {
+		m.retries++
+	}
+	m.attempted[N] = true
+}
+
+// RecordOOMEscalation records a memory increase after a task was killed by the memory limit
+func (m *TaskMetrics) RecordOOMEscalation() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.oomEscalations++
+}
+
+// RecordTimeoutEscalation records an h_rt increase after a task was killed by the wall-clock limit
+func (m *TaskMetrics) RecordTimeoutEscalation() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeoutEscalations++
+}
+
+// RecordDRMAAError records a failed DRMAA call
+func (m *TaskMetrics) RecordDRMAAError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drmaaErrors++
+}
+
+// ObserveDuration records the duration of a completed task attempt
+func (m *TaskMetrics) ObserveDuration(finished bool, d time.Duration) {
+	result := "failed"
+	if finished {
+		result = "finished"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.durations[result]
+	if !ok {
+		h = newDurationHistogram()
+		m.durations[result] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// startMetricsServer serves /metrics of the current run on addr in the background
+// Returns an error if addr can't be listened on
+func startMetricsServer(addr, usrID, project, module, shellPath string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		processMetrics.write(newMetricsWriter(w), usrID, project, module, shellPath)
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Warning: Metrics server stopped: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%s/metrics", displayAddr(addr))
+	return nil
+}
+
+// write writes task status gauges from the local database and the process counters
+func (m *TaskMetrics) write(mw *metricsWriter, usrID, project, module, shellPath string) {
+	labels := []string{"user", usrID, "project", project, "module", module}
+
+	if dbObj, err := openLocalDB(shellPath); err == nil {
+		total, pending, failed, running, finished, err := GetTaskStats(dbObj)
+		dbObj.Db.Close()
+		if err == nil {
+			writeTaskGauges(mw, []taskCounts{{labels, total, pending, running, failed, finished}})
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mw.header("annotask_task_submissions_total", "counter", "Tasks started (local) or submitted to SGE (qsubsge) by this process")
+	modes := make([]string, 0, len(m.submissions))
+	for mode := range m.submissions {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for _, mode := range modes {
+		mw.sample("annotask_task_submissions_total", withLabels(labels, "mode", mode), float64(m.submissions[mode]))
+	}
+	mw.header("annotask_task_retries_total", "counter", "Tasks started again after a failed attempt by this process")
+	mw.sample("annotask_task_retries_total", labels, float64(m.retries))
+	mw.header("annotask_oom_escalations_total", "counter", "Memory increases after tasks were killed by the memory limit")
+	mw.sample("annotask_oom_escalations_total", labels, float64(m.oomEscalations))
+	mw.header("annotask_timeout_escalations_total", "counter", "h_rt increases after tasks were killed by the wall-clock limit")
+	mw.sample("annotask_timeout_escalations_total", labels, float64(m.timeoutEscalations))
+	mw.header("annotask_drmaa_errors_total", "counter", "Failed DRMAA calls (session, job template, submission, status)")
+	mw.sample("annotask_drmaa_errors_total", labels, float64(m.drmaaErrors))
+
+	writeDurationHeader(mw)
+	for _, result := range []string{"finished", "failed"} {
+		if h, ok := m.durations[result]; ok {
+			writeDurationHistogram(mw, withLabels(labels, "result", result), h)
+		}
+	}
+}
+
+// taskCounts holds task counts of one run with its labels
+type taskCounts struct {
+	labels                                    []string
+	total, pending, running, failed, finished int
+}
+
+// writeTaskGauges writes the task status gauges of runs
+func writeTaskGauges(mw *metricsWriter, runs []taskCounts) {
+	mw.header("annotask_tasks", "gauge", "Number of tasks by status")
+	for _, run := range runs {
+		mw.sample("annotask_tasks", withLabels(run.labels, "status", "pending"), float64(run.pending))
+		mw.sample("annotask_tasks", withLabels(run.labels, "status", "running"), float64(run.running))
+		mw.sample("annotask_tasks", withLabels(run.labels, "status", "failed"), float64(run.failed))
+		mw.sample("annotask_tasks", withLabels(run.labels, "status", "finished"), float64(run.finished))
+	}
+	mw.header("annotask_tasks_total", "gauge", "Total number of tasks")
+	for _, run := range runs {
+		mw.sample("annotask_tasks_total", run.labels, float64(run.total))
+	}
+}
+
+func writeDurationHeader(mw *metricsWriter) {
+	mw.header("annotask_task_duration_seconds", "histogram", "Wall-clock duration of completed task attempts")
+}
+
+// writeDurationHistogram writes the _bucket, _sum and _count series of a histogram
+func writeDurationHistogram(mw *metricsWriter, labels []string, h *durationHistogram) {
+	var cumulative uint64
+	for i, bound := range taskDurationBuckets {
+		cumulative += h.counts[i]
+		mw.sample("annotask_task_duration_seconds_bucket", withLabels(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(cumulative))
+	}
+	mw.sample("annotask_task_duration_seconds_bucket", withLabels(labels, "le", "+Inf"), float64(h.count))
+	mw.sample("annotask_task_duration_seconds_sum", labels, h.sum)
+	mw.sample("annotask_task_duration_seconds_count", labels, float64(h.count))
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	w       io.Writer
+	headers map[string]bool
+}
+
+func newMetricsWriter(w io.Writer) *metricsWriter {
+	return &metricsWriter{w: w, headers: make(map[string]bool)}
+}
+
+// header writes the HELP and TYPE lines of a metric once
+func (mw *metricsWriter) header(name, metricType, help string) {
+	if mw.headers[name] {
+		return
+	}
+	mw.headers[name] = true
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// sample writes one sample, labels are given as name/value pairs
+func (mw *metricsWriter) sample(name string, labels []string, value float64) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labels) > 0 {
+		sb.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(&sb, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		sb.WriteString("}")
+	}
+	fmt.Fprintf(mw.w, "%s %s\n", sb.String(), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// withLabels returns a copy of labels with extra name/value pairs appended
+func withLabels(labels []string, extra ...string) []string {
+	return append(append(make([]string, 0, len(labels)+len(extra)), labels...), extra...)
+}
+
+// escapeLabelValue escapes backslash, double quote and newline in label values
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -11,7 +11,7 @@ import (
 )
 
 // MonitorTaskStatus monitors database and outputs task status changes to log file
-func MonitorTaskStatus(ctx context.Context, dbObj *MySql, globalDB *GlobalDB, usrID, project, module, mode, shellPath string, startTime time.Time, config *Config, wg *sync.WaitGroup, command string) {
+func MonitorTaskStatus(ctx context.Context, dbObj *MySql, globalDB *GlobalDB, runID, usrID, project, module, mode, shellPath string, startTime time.Time, config *Config, wg *sync.WaitGroup, command string) {
 	defer wg.Done()
 
 	// Open log file: shellPath.log (e.g., test.sh.log)
@@ -142,10 +142,11 @@ func MonitorTaskStatus(ctx context.Context, dbObj *MySql, globalDB *GlobalDB, us
 			if err == nil {
 				node := GetNodeName(mode, config, dbObj)
 				pid := os.Getpid() // Get main process PID
-				err = UpdateGlobalTaskRecord(globalDB, usrID, project, module, mode, shellPath, startTime, total, pending, failed, running, finished, node, pid)
+				err = UpdateGlobalTaskRecord(globalDB, runID, usrID, project, module, mode, shellPath, startTime, total, pending, failed, running, finished, node, pid)
 				if err != nil {
 					log.Printf("Error updating global DB: %v", err)
 				}
+				runUsage.Update(dbObj)
 			}
 		}
 	}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification events
+const (
+	NotifyComplete     = "complete"      // Every run end
+	NotifyFailed       = "failed"        // Run end, only if the run failed
+	NotifyFirstFailure = "first_failure" // First failed task of the run
+	NotifyThreshold    = "threshold"     // Number of failed tasks reached notify.threshold
+)
+
+// defaultNotifyEvents are used when notify.events is not configured
+var defaultNotifyEvents = []string{NotifyComplete, NotifyFirstFailure, NotifyThreshold}
+
+const (
+	notifyTimeout        = 60 * time.Second // Per notification command, sendmail call or webhook request
+	notifyMaxFailedTasks = 20               // Failed tasks listed in a notification
+	defaultSendmail      = "/usr/sbin/sendmail"
+)
+
+// NotifyWebhook is an HTTP endpoint notifications are posted to
+// Type is slack, dingtalk, wecom or generic, detected from the URL host if empty
+type NotifyWebhook struct {
+	URL  string `yaml:"url"`
+	Type string `yaml:"type,omitempty"`
+}
+
+// NotifyConfig configures notifications on run completion and task failures
+type NotifyConfig struct {
+	Events    []string        `yaml:"events,omitempty"`
+	Threshold string          `yaml:"threshold,omitempty"` // Failed tasks, number or percentage of tasks to run
+	Command   string          `yaml:"command,omitempty"`   // Run with sh -c, the message is passed on stdin
+	Email     []string        `yaml:"email,omitempty"`
+	From      string          `yaml:"from,omitempty"`
+	Sendmail  string          `yaml:"sendmail,omitempty"` // Default: /usr/sbin/sendmail, then sendmail in PATH
+	Webhooks  []NotifyWebhook `yaml:"webhooks,omitempty"`
+}
+
+// HasChannels reports whether any notification channel is configured
+func (c NotifyConfig) HasChannels() bool {
+	return c.Command != "" || len(c.Email) > 0 || len(c.Webhooks) > 0
+}
+
+// mergeNotifyConfig merges non-empty values of source into target
+func mergeNotifyConfig(target, source *NotifyConfig) {
+	if len(source.Events) > 0 {
+		target.Events = source.Events
+	}
+	if source.Threshold != "" {
+		target.Threshold = source.Threshold
+	}
+	if source.Command != "" {
+		target.Command = source.Command
+	}
+	if len(source.Email) > 0 {
+		target.Email = source.Email
+	}
+	if source.From != "" {
+		target.From = source.From
+	}
+	if source.Sendmail != "" {
+		target.Sendmail = source.Sendmail
+	}
+	if len(source.Webhooks) > 0 {
+		target.Webhooks = source.Webhooks
+	}
+}
+
+// applyNotifyFlags returns the notify config with --notify-* flags applied
+// --notify-cmd, --notify-events and --notify-threshold replace config values, emails and webhooks are added
+func applyNotifyFlags(config NotifyConfig, command string, emails, webhooks []string, events, threshold string) (NotifyConfig, error) {
+	if command != "" {
+		config.Command = command
+	}
+	for _, email := range emails {
+		config.Email = append(config.Email, splitList(email)...)
+	}
+	for _, hook := range webhooks {
+		config.Webhooks = append(config.Webhooks, NotifyWebhook{URL: hook})
+	}
+	if events != "" {
+		config.Events = splitList(events)
+	}
+	if threshold != "" {
+		config.Threshold = threshold
+	}
+	return config, validateNotifyConfig(config)
+}
+
+// validateNotifyConfig checks events, threshold and webhooks of a notify config
+func validateNotifyConfig(config NotifyConfig) error {
+	for _, event := range config.Events {
+		switch event {
+		case NotifyComplete, NotifyFailed, NotifyFirstFailure, NotifyThreshold:
+		default:
+			return fmt.Errorf("invalid notify event: %s (expected %s, %s, %s or %s)", event, NotifyComplete, NotifyFailed, NotifyFirstFailure, NotifyThreshold)
+		}
+	}
+	if config.Threshold != "" {
+		count, _, err := parseMaxFailures(config.Threshold)
+		if err != nil {
+			return fmt.Errorf("invalid notify threshold: %v", err)
+		}
+		if count == 0 {
+			return fmt.Errorf("invalid notify threshold: %s (expected at least 1 task)", config.Threshold)
+		}
+	}
+	for _, hook := range config.Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL: %s", hook.URL)
+		}
+		switch webhookType(hook) {
+		case "slack", "dingtalk", "wecom", "generic":
+		default:
+			return fmt.Errorf("invalid webhook type: %s (expected slack, dingtalk, wecom or generic)", hook.Type)
+		}
+	}
+	return nil
+}
+
+// webhookType returns the payload format of a webhook
+func webhookType(hook NotifyWebhook) string {
+	if hook.Type != "" {
+		return strings.ToLower(hook.Type)
+	}
+	u, err := url.Parse(hook.URL)
+	if err != nil {
+		return "generic"
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case strings.HasSuffix(host, "slack.com"):
+		return "slack"
+	case strings.HasSuffix(host, "dingtalk.com"):
+		return "dingtalk"
+	case host == "qyapi.weixin.qq.com":
+		return "wecom"
+	}
+	return "generic"
+}
+
+// NotifyFailedTask is a failed task listed in a notification
+type NotifyFailedTask struct {
+	Task      int    `json:"task"`
+	ShellPath string `json:"shellPath"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// NotifyMessage is the content of one notification, also the payload of generic webhooks
+type NotifyMessage struct {
+	Event       string             `json:"event"`
+	Subject     string             `json:"subject"`
+	Text        string             `json:"text"`
+	Time        string             `json:"time"`
+	User        string             `json:"user"`
+	Project     string             `json:"project"`
+	Module      string             `json:"module"`
+	Input       string             `json:"input"`
+	Mode        string             `json:"mode"`
+	Node        string             `json:"node"`
+	Status      string             `json:"status"`
+	Reason      string             `json:"reason,omitempty"` // Why the run failed, e.g. failure budget exceeded
+	Elapsed     float64            `json:"elapsed"`          // Seconds
+	Total       int                `json:"total"`
+	Finished    int                `json:"finished"`
+	Failed      int                `json:"failed"`
+	Running     int                `json:"running"`
+	Pending     int                `json:"pending"`
+	FailedTasks []NotifyFailedTask `json:"failedTasks"`
+}
+
+// Notifier sends notifications of the current run
+// A nil *Notifier sends nothing
+type Notifier struct {
+	config    NotifyConfig
+	events    map[string]bool
+	threshold int // Failed tasks that trigger a threshold notification, 0 for none
+	dbObj     *MySql
+	base      NotifyMessage // Run information shared by all messages
+	startTime time.Time
+
+	mu            sync.Mutex
+	failed        map[int]bool
+	firstSent     bool
+	thresholdSent bool
+	sending       sync.WaitGroup
+}
+
+// runNotifier is the notifier of the current run, set by runTasks
+var runNotifier *Notifier
+
+// NewNotifier creates a notifier for a run with toRun tasks to run
+// Returns nil if no notification channel is configured
+func NewNotifier(config NotifyConfig, toRun int, dbObj *MySql, usrID, project, module, input string, mode JobMode, node string, startTime time.Time) (*Notifier, error) {
+	if !config.HasChannels() {
+		return nil, nil
+	}
+	if err := validateNotifyConfig(config); err != nil {
+		return nil, err
+	}
+	events := config.Events
+	if len(events) == 0 {
+		events = defaultNotifyEvents
+	}
+	n := &Notifier{
+		config:    config,
+		events:    make(map[string]bool),
+		dbObj:     dbObj,
+		startTime: startTime,
+		failed:    make(map[int]bool),
+		base: NotifyMessage{
+			User: usrID, Project: project, Module: module, Input: input, Mode: string(mode), Node: node,
+		},
+	}
+	for _, event := range events {
+		n.events[event] = true
+	}
+	if config.Threshold != "" && n.events[NotifyThreshold] {
+		count, percent, _ := parseMaxFailures(config.Threshold)
+		if count > 0 {
+			n.threshold = count
+		} else {
+			n.threshold = int(math.Max(1, math.Ceil(float64(toRun)*percent/100.0)))
+		}
+	}
+	return n, nil
+}
+
+// CheckTask reads the status of task N from local database and notifies on the first failure
+// or when the number of failed tasks reaches the threshold
+// A task that fails several times (retries) is only counted once
+func (n *Notifier) CheckTask(dbObj *MySql, N int) {
+	if n == nil {
+		return
+	}
+	var status string
+	err := dbObj.Db.QueryRow("SELECT status FROM job WHERE subJob_num=?", N).Scan(&status)
+	if err != nil {
+		log.Printf("Warning: Could not check status of task %d for notifications: %v", N, err)
+		return
+	}
+	if status != string(J_failed) {
+		return
+	}
+
+	n.mu.Lock()
+	n.failed[N] = true
+	failedCount := len(n.failed)
+	sendFirst := n.events[NotifyFirstFailure] && !n.firstSent
+	n.firstSent = true
+	sendThreshold := n.threshold > 0 && failedCount >= n.threshold && !n.thresholdSent
+	if sendThreshold {
+		n.thresholdSent = true
+	}
+	n.mu.Unlock()
+
+	if sendFirst {
+		var reason sql.NullString
+		dbObj.Db.QueryRow("SELECT reason FROM job WHERE subJob_num=?", N).Scan(&reason)
+		subject := fmt.Sprintf("[annotask] %s/%s: task %d failed", n.base.Project, n.base.Module, N)
+		if reason.String != "" {
+			subject += " (" + reason.String + ")"
+		}
+		n.send(NotifyFirstFailure, subject, "running")
+	}
+	if sendThreshold {
+		subject := fmt.Sprintf("[annotask] %s/%s: %d tasks failed (threshold: %d)", n.base.Project, n.base.Module, failedCount, n.threshold)
+		n.send(NotifyThreshold, subject, "running")
+	}
+}
+
+// RunEnd sends the completion notification and waits until all notifications are sent
+// reason is empty unless the run was stopped early, e.g. "failure budget exceeded"
+func (n *Notifier) RunEnd(status, reason string) {
+	if n == nil {
+		return
+	}
+	if n.events[NotifyComplete] || (n.events[NotifyFailed] && status != "completed") {
+		subject := fmt.Sprintf("[annotask] %s/%s %s", n.base.Project, n.base.Module, status)
+		if reason != "" {
+			subject += " (" + reason + ")"
+		}
+		n.base.Reason = reason
+		n.send(NotifyComplete, subject, status)
+	}
+	n.sending.Wait()
+}
+
+// send builds a message from the current task counts and sends it to all channels in the background
+func (n *Notifier) send(event, subject, status string) {
+	msg := n.base
+	msg.Event = event
+	msg.Subject = subject
+	msg.Status = status
+	msg.Time = time.Now().Format("2006-01-02 15:04:05")
+	msg.Elapsed = time.Since(n.startTime).Round(time.Second).Seconds()
+	msg.Total, msg.Pending, msg.Failed, msg.Running, msg.Finished, _ = GetTaskStats(n.dbObj)
+	msg.FailedTasks = loadFailedTasks(n.dbObj)
+	msg.Text = formatNotifyText(msg)
+
+	if n.config.Command != "" {
+		n.deliver("command", func() error { return runNotifyCommand(n.config.Command, msg) })
+	}
+	if len(n.config.Email) > 0 {
+		n.deliver("email", func() error { return sendNotifyEmail(n.config, msg) })
+	}
+	for _, hook := range n.config.Webhooks {
+		hook := hook
+		n.deliver("webhook "+hook.URL, func() error { return postWebhook(hook, msg) })
+	}
+}
+
+// deliver runs one delivery in the background, failures are only logged
+func (n *Notifier) deliver(channel string, fn func() error) {
+	n.sending.Add(1)
+	go func() {
+		defer n.sending.Done()
+		if err := fn(); err != nil {
+			log.Printf("Warning: Could not send %s notification: %v", channel, err)
+		}
+	}()
+}
+
+// loadFailedTasks returns the failed tasks of a run, ordered by task number
+func loadFailedTasks(dbObj *MySql) []NotifyFailedTask {
+	tasks := []NotifyFailedTask{}
+	rows, err := dbObj.Db.Query("SELECT subJob_num, shellPath, reason FROM job WHERE status=? ORDER BY subJob_num", J_failed)
+	if err != nil {
+		log.Printf("Warning: Could not query failed tasks: %v", err)
+		return tasks
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var task NotifyFailedTask
+		var reason sql.NullString
+		if err := rows.Scan(&task.Task, &task.ShellPath, &reason); err != nil {
+			break
+		}
+		task.Reason = reason.String
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// formatNotifyText formats a message as plain text, with a summary like CheckExitCode prints
+func formatNotifyText(msg NotifyMessage) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s\n\n", msg.Subject)
+	fmt.Fprintf(&sb, "User: %s\nProject: %s\nModule: %s\nInput: %s\nMode: %s\nNode: %s\n", msg.User, msg.Project, msg.Module, msg.Input, msg.Mode, msg.Node)
+	if msg.Reason != "" {
+		fmt.Fprintf(&sb, "Reason: %s\n", msg.Reason)
+	}
+	fmt.Fprintf(&sb, "Elapsed: %s\n\n", time.Duration(msg.Elapsed)*time.Second)
+	fmt.Fprintf(&sb, "All works: %d\nSuccessed: %d\nError: %d\n", msg.Total, msg.Finished, msg.Failed)
+	if msg.Running > 0 || msg.Pending > 0 {
+		fmt.Fprintf(&sb, "Running: %d\nPending: %d\n", msg.Running, msg.Pending)
+	}
+	if len(msg.FailedTasks) > 0 {
+		sb.WriteString("Err Shells:\n")
+		for i, task := range msg.FailedTasks {
+			if i == notifyMaxFailedTasks {
+				fmt.Fprintf(&sb, "... and %d more\n", len(msg.FailedTasks)-notifyMaxFailedTasks)
+				break
+			}
+			if task.Reason != "" {
+				fmt.Fprintf(&sb, "%d\t%s\t%s\n", task.Task, task.ShellPath, task.Reason)
+			} else {
+				fmt.Fprintf(&sb, "%d\t%s\n", task.Task, task.ShellPath)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// runNotifyCommand runs the notify command with sh -c, the message text is passed on stdin
+// and run information in ANNOTASK_* environment variables
+func runNotifyCommand(command string, msg NotifyMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = strings.NewReader(msg.Text)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"ANNOTASK_EVENT="+msg.Event,
+		"ANNOTASK_SUBJECT="+msg.Subject,
+		"ANNOTASK_STATUS="+msg.Status,
+		"ANNOTASK_USER="+msg.User,
+		"ANNOTASK_PROJECT="+msg.Project,
+		"ANNOTASK_MODULE="+msg.Module,
+		"ANNOTASK_INPUT="+msg.Input,
+		"ANNOTASK_MODE="+msg.Mode,
+		"ANNOTASK_NODE="+msg.Node,
+		"ANNOTASK_TOTAL="+strconv.Itoa(msg.Total),
+		"ANNOTASK_FINISHED="+strconv.Itoa(msg.Finished),
+		"ANNOTASK_FAILED="+strconv.Itoa(msg.Failed),
+		"ANNOTASK_RUNNING="+strconv.Itoa(msg.Running),
+		"ANNOTASK_PENDING="+strconv.Itoa(msg.Pending),
+	)
+	return cmd.Run()
+}
+
+// sendNotifyEmail sends the message with sendmail -t
+func sendNotifyEmail(config NotifyConfig, msg NotifyMessage) error {
+	sendmail := config.Sendmail
+	if sendmail == "" {
+		sendmail = defaultSendmail
+		if _, err := os.Stat(sendmail); err != nil {
+			if sendmail, err = exec.LookPath("sendmail"); err != nil {
+				return fmt.Errorf("sendmail not found (set notify.sendmail)")
+			}
+		}
+	}
+
+	var mail bytes.Buffer
+	fmt.Fprintf(&mail, "To: %s\r\n", strings.Join(config.Email, ", "))
+	if config.From != "" {
+		fmt.Fprintf(&mail, "From: %s\r\n", config.From)
+	}
+	fmt.Fprintf(&mail, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	mail.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	mail.WriteString(msg.Text)
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, sendmail, "-t", "-i")
+	cmd.Stdin = &mail
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v %s", sendmail, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// webhookPayload returns the JSON body posted to a webhook
+func webhookPayload(hookType string, msg NotifyMessage) interface{} {
+	switch hookType {
+	case "slack":
+		return map[string]string{"text": msg.Text}
+	case "dingtalk", "wecom":
+		return map[string]interface{}{
+			"msgtype": "text",
+			"text":    map[string]string{"content": msg.Text},
+		}
+	}
+	return msg
+}
+
+// postWebhook posts the message to a webhook
+// DingTalk and WeCom report errors in the body with HTTP 200, so errcode is checked too
+func postWebhook(hook NotifyWebhook, msg NotifyMessage) error {
+	body, err := json.Marshal(webhookPayload(webhookType(hook), msg))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(hook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	var result struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if json.Unmarshal(respBody, &result) == nil && result.ErrCode != 0 {
+		return fmt.Errorf("errcode %d: %s", result.ErrCode, result.ErrMsg)
+	}
+	return nil
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/seqyuan/annotask/pkg/gpool"
+)
+
+// PreflightIssue is a problem found by the pre-flight check, Task is 0 for problems of the whole run
+type PreflightIssue struct {
+	Task    int
+	Warning bool // Warnings are reported but don't abort the run
+	Message string
+}
+
+func (i PreflightIssue) String() string {
+	s := "run"
+	if i.Task > 0 {
+		s = fmt.Sprintf("task %d", i.Task)
+	}
+	if i.Warning {
+		s += " (warning)"
+	}
+	return s + ": " + i.Message
+}
+
+// shellBuiltins are bash builtins and keywords that are not looked up in PATH
+var shellBuiltins = map[string]bool{
+	":": true, ".": true, "[": true, "[[": true, "]]": true, "alias": true, "bg": true, "bind": true, "break": true,
+	"builtin": true, "caller": true, "cd": true, "command": true, "compgen": true, "complete": true, "continue": true,
+	"declare": true, "dirs": true, "disown": true, "echo": true, "enable": true, "eval": true, "exec": true, "exit": true,
+	"export": true, "false": true, "fc": true, "fg": true, "getopts": true, "hash": true, "help": true, "history": true,
+	"jobs": true, "kill": true, "let": true, "local": true, "logout": true, "mapfile": true, "popd": true, "printf": true,
+	"pushd": true, "pwd": true, "read": true, "readarray": true, "readonly": true, "return": true, "set": true,
+	"shift": true, "shopt": true, "source": true, "suspend": true, "test": true, "times": true, "trap": true,
+	"true": true, "type": true, "typeset": true, "ulimit": true, "umask": true, "unalias": true, "unset": true, "wait": true,
+}
+
+// commandPrefixes are keywords and builtins followed by the command they run
+var commandPrefixes = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "do": true, "while": true, "until": true, "!": true,
+	"time": true, "{": true, "command": true, "exec": true, "builtin": true, "nohup": true, "env": true,
+}
+
+// nonCommandWords start or end compound commands, the words after them are not commands
+var nonCommandWords = map[string]bool{
+	"fi": true, "done": true, "esac": true, "}": true, "for": true, "select": true, "function": true, "in": true,
+}
+
+// envCommands change the environment of the task (usually shell functions set up by the login profile),
+// commands run after them may only be found on the PATH they set
+var envCommands = map[string]bool{"module": true, "ml": true, "conda": true, "mamba": true, "source": true, ".": true}
+
+// exportCommands are builtins whose arguments may be assignments (export PATH=...)
+var exportCommands = map[string]bool{"export": true, "declare": true, "typeset": true, "local": true, "readonly": true}
+
+// scriptInterpreters run the script given as their first argument, which must exist
+var scriptInterpreters = map[string]bool{
+	"sh": true, "bash": true, "python": true, "python2": true, "python3": true, "perl": true, "Rscript": true, "ruby": true, "node": true,
+}
+
+// pathTestCommands take paths that need not exist
+var pathTestCommands = map[string]bool{"[": true, "[[": true, "test": true, "echo": true, "printf": true}
+
+// shellOperators are the multi-character operators of the shell, longest first
+var shellOperators = []string{"&>>", "<<<", "&&", "||", ";;", "|&", "<<", ">>", "&>", ">&", "<&", ">|"}
+
+// shellToken is a word or operator of a task command
+type shellToken struct {
+	text    string
+	op      bool // Operator: ; & | && || ;; ( ) newline or a redirection
+	dynamic bool // Word depends on expansion ($, backquotes or globs), its value is unknown before running
+}
+
+// tokenizeShell splits a task command into words and operators
+// It covers the common cases of command lines, not the full shell grammar; here-document bodies are skipped
+func tokenizeShell(cmd string) []shellToken {
+	var tokens []shellToken
+	var word strings.Builder
+	inWord, dynamic := false, false
+	var heredocs []string // Delimiters of here-documents starting after the current line
+	flush := func() {
+		if inWord {
+			tokens = append(tokens, shellToken{text: word.String(), dynamic: dynamic})
+		}
+		word.Reset()
+		inWord, dynamic = false, false
+	}
+	runes := []rune(cmd)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case r == '\'':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '\''; i++ {
+				word.WriteRune(runes[i])
+			}
+		case r == '"':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '$' || runes[i] == '`' {
+					dynamic = true
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				word.WriteRune(runes[i])
+			}
+		case r == '`':
+			inWord, dynamic = true, true
+			for i++; i < len(runes) && runes[i] != '`'; i++ {
+			}
+		case r == '$' && i+1 < len(runes) && runes[i+1] == '(':
+			// Command substitution, skipped up to the matching parenthesis
+			inWord, dynamic = true, true
+			depth := 0
+			for i++; i < len(runes); i++ {
+				if runes[i] == '(' {
+					depth++
+				} else if runes[i] == ')' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		case r == '$' || r == '*' || r == '?' || r == '[' && inWord:
+			word.WriteRune(r)
+			inWord, dynamic = true, true
+		case r == '#' && !inWord:
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+		case r == '\n':
+			flush()
+			tokens = append(tokens, shellToken{text: "\n", op: true})
+			// Skip the bodies of here-documents started on this line
+			for _, delim := range heredocs {
+				for i+1 < len(runes) {
+					end := i + 1
+					for end < len(runes) && runes[end] != '\n' {
+						end++
+					}
+					line := strings.TrimSpace(string(runes[i+1 : end]))
+					i = end
+					if line == delim {
+						break
+					}
+				}
+			}
+			heredocs = nil
+		case r == ' ' || r == '\t':
+			flush()
+		case strings.ContainsRune(";&|()<>", r):
+			// A file descriptor number directly before a redirection belongs to it (2>&1)
+			if (r == '<' || r == '>') && inWord && strings.Trim(word.String(), "0123456789") == "" && !dynamic {
+				word.Reset()
+				inWord = false
+			}
+			flush()
+			op := string(r)
+			for _, candidate := range shellOperators {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			i += len(op) - 1
+			tokens = append(tokens, shellToken{text: op, op: true})
+			if op == "<<" {
+				// The next word is the here-document delimiter
+				j := i + 1
+				for j < len(runes) && (runes[j] == ' ' || runes[j] == '\t' || runes[j] == '-') {
+					j++
+				}
+				start := j
+				for j < len(runes) && !strings.ContainsRune(" \t\n;&|<>()", runes[j]) {
+					j++
+				}
+				heredocs = append(heredocs, strings.Trim(string(runes[start:j]), `'"\`))
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	flush()
+	return tokens
+}
+
+// isRedirection checks if an operator token redirects input or output
+func isRedirection(op string) bool {
+	return strings.ContainsAny(op, "<>")
+}
+
+// isAssignment checks if a word is a variable assignment like NAME=value
+func isAssignment(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	if !ok || name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// taskReferences are the executables and paths a task command refers to
+type taskReferences struct {
+	Commands  []string // Words in command position
+	Functions []string // Shell functions defined in the task
+	Scripts   []string // Absolute scripts run by an interpreter (python3 /path/script.py)
+	Inputs    []string // Absolute files read with <
+	Paths     []string // Other absolute paths in arguments
+	Dirs      []string // Absolute directories changed into with cd
+	Mkdirs    []string // Absolute directories created with mkdir
+	// The task sources a file, loads modules, activates a conda environment or sets PATH,
+	// so commands missing from the current PATH may still be found when it runs
+	ChangesEnv bool
+}
+
+// scanTaskReferences finds the commands and absolute paths of a task command
+// Tasks using case statements are only scanned for paths, as their patterns look like commands
+func scanTaskReferences(cmd string) taskReferences {
+	var refs taskReferences
+	tokens := tokenizeShell(cmd)
+	checkCommands := true
+	expectCommand := true
+	skipSegment := false
+	var current string // Command of the current simple command
+	argNum := 0
+	// Directory the task is in after its cd commands, relative to the run's directory; unknown after cd to a dynamic path
+	cwd, cwdKnown := "", true
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.op {
+			if isRedirection(tok.text) {
+				// The next word is the redirection target, not an argument or command
+				if i+1 < len(tokens) && !tokens[i+1].op {
+					i++
+					target := tokens[i]
+					if !target.dynamic && filepath.IsAbs(target.text) {
+						if tok.text == "<" {
+							refs.Inputs = append(refs.Inputs, target.text)
+						} else if !strings.Contains(tok.text, "<") {
+							refs.Paths = append(refs.Paths, target.text)
+						}
+					}
+				}
+				continue
+			}
+			if tok.text == "(" && i+1 < len(tokens) && tokens[i+1].text == ")" && current != "" && argNum == 0 {
+				// name() { ... } defines a function
+				refs.Functions = append(refs.Functions, current)
+				if n := len(refs.Commands); n > 0 && refs.Commands[n-1] == current {
+					refs.Commands = refs.Commands[:n-1]
+				}
+				i++
+			}
+			expectCommand, skipSegment, current, argNum = true, false, "", 0
+			continue
+		}
+		if skipSegment {
+			continue
+		}
+		word := tok.text
+		if expectCommand {
+			switch {
+			case word == "case":
+				checkCommands, skipSegment = false, true
+			case word == "function":
+				// function name { ... } defines a function
+				if i+1 < len(tokens) && !tokens[i+1].op {
+					i++
+					refs.Functions = append(refs.Functions, tokens[i].text)
+				}
+			case nonCommandWords[word]:
+				skipSegment = true
+			case commandPrefixes[word]:
+				if word == "nohup" || word == "env" {
+					refs.Commands = append(refs.Commands, word)
+				}
+			case isAssignment(word) || word == "env" || current == "env" && strings.HasPrefix(word, "-"):
+				if strings.HasPrefix(word, "PATH=") {
+					refs.ChangesEnv = true
+				}
+			default:
+				expectCommand, current = false, word
+				if envCommands[word] {
+					refs.ChangesEnv = true
+				}
+				switch {
+				case tok.dynamic || !checkCommands:
+				case strings.Contains(word, "/") && !filepath.IsAbs(word):
+					// ./run.sh runs from the directory of the last cd
+					if cwdKnown {
+						path := filepath.Join(cwd, word)
+						if !strings.Contains(path, "/") {
+							path = "./" + path
+						}
+						refs.Commands = append(refs.Commands, path)
+					}
+				default:
+					refs.Commands = append(refs.Commands, word)
+				}
+			}
+			continue
+		}
+
+		argNum++
+		if exportCommands[current] && strings.HasPrefix(word, "PATH=") {
+			refs.ChangesEnv = true
+		}
+		if current == "cd" && argNum == 1 {
+			switch {
+			case tok.dynamic || word == "-":
+				cwdKnown = false
+			case filepath.IsAbs(word):
+				cwd = word
+			default:
+				cwd = filepath.Join(cwd, word)
+			}
+		}
+		if tok.dynamic {
+			continue
+		}
+		path := word
+		if strings.HasPrefix(word, "-") {
+			// --option=/path
+			_, value, ok := strings.Cut(word, "=")
+			if !ok {
+				continue
+			}
+			path = value
+		}
+		if !filepath.IsAbs(path) {
+			continue
+		}
+		switch {
+		case filepath.Base(current) == "mkdir":
+			refs.Mkdirs = append(refs.Mkdirs, path)
+		case current == "cd":
+			refs.Dirs = append(refs.Dirs, path)
+		case scriptInterpreters[filepath.Base(current)] && argNum == 1:
+			refs.Scripts = append(refs.Scripts, path)
+		case pathTestCommands[current]:
+			// Paths of tests and messages need not exist
+		default:
+			refs.Paths = append(refs.Paths, path)
+		}
+	}
+	if !checkCommands {
+		refs.Commands, refs.Functions = nil, nil
+	}
+	return refs
+}
+
+// lookupCommand checks if a command word can be run, relative paths are resolved against workDir
+// Relative paths of commands run after a cd are already joined with its directory by scanTaskReferences
+func lookupCommand(word, workDir string) error {
+	if !strings.Contains(word, "/") {
+		_, err := exec.LookPath(word)
+		return err
+	}
+	path := word
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workDir, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("not executable")
+	}
+	return nil
+}
+
+// createdBy checks if dir is, or is under, a directory created with mkdir
+func createdBy(dir string, mkdirs map[string]bool) bool {
+	for d := dir; d != "/" && d != "."; d = filepath.Dir(d) {
+		if mkdirs[d] {
+			return true
+		}
+	}
+	return false
+}
+
+// bashSyntaxCheck runs bash -n on a script
+func bashSyntaxCheck(script string) string {
+	out, err := exec.Command("bash", "-n", script).CombinedOutput()
+	if err == nil {
+		return ""
+	}
+	msg := strings.TrimSpace(strings.ReplaceAll(string(out), script+": ", ""))
+	if msg == "" {
+		msg = err.Error()
+	}
+	return fmt.Sprintf("syntax error in %s: %s", filepath.Base(script), strings.ReplaceAll(msg, "\n", "; "))
+}
+
+// listSGENames runs a qconf list option (-sql for queues, -sprjl for projects)
+func listSGENames(option string) (map[string]bool, error) {
+	out, err := exec.Command("qconf", option).Output()
+	if err != nil {
+		return nil, fmt.Errorf("qconf %s: %v", option, err)
+	}
+	names := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			names[name] = true
+		}
+	}
+	return names, nil
+}
+
+// preflightSGE checks that the requested queues and SGE project exist
+func preflightSGE(queue, sgeProject string) []PreflightIssue {
+	var issues []PreflightIssue
+	if queues := splitList(queue); len(queues) > 0 {
+		known, err := listSGENames("-sql")
+		if err != nil {
+			issues = append(issues, PreflightIssue{Warning: true, Message: fmt.Sprintf("could not check queues: %v", err)})
+		} else {
+			for _, q := range queues {
+				// Queue instances (all.q@node1) and wildcards are left to SGE
+				name, _, _ := strings.Cut(q, "@")
+				if strings.ContainsAny(name, "*?[") {
+					continue
+				}
+				if !known[name] {
+					issues = append(issues, PreflightIssue{Message: fmt.Sprintf("queue %s does not exist (qconf -sql)", name)})
+				}
+			}
+		}
+	}
+	if sgeProject != "" {
+		known, err := listSGENames("-sprjl")
+		if err != nil {
+			issues = append(issues, PreflightIssue{Warning: true, Message: fmt.Sprintf("could not check SGE project: %v", err)})
+		} else if !known[sgeProject] {
+			issues = append(issues, PreflightIssue{Message: fmt.Sprintf("SGE project %s does not exist (qconf -sprjl)", sgeProject)})
+		}
+	}
+	return issues
+}
+
+// preflightTasks checks the tasks to run before dispatch: bash syntax of their scripts, commands missing from PATH,
+// declared and absolute input paths, and for qsubsge mode the queues and SGE project
+// Relative paths are resolved against workDir, the directory tasks run in
+func preflightTasks(dbObj *MySql, need2run []int, mode JobMode, queue, sgeProject, workDir string) ([]PreflightIssue, error) {
+	type task struct {
+		N          int
+		shellPath  string
+		command    string
+		directives TaskDirectives
+	}
+	selected := make(map[int]bool)
+	for _, N := range need2run {
+		selected[N] = true
+	}
+	rows, err := dbObj.Db.Query("SELECT subJob_num, shellPath, directives FROM job")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tasks: %v", err)
+	}
+	var tasks []task
+	mkdirs := make(map[string]bool)
+	for rows.Next() {
+		var t task
+		var directives *string
+		if err := rows.Scan(&t.N, &t.shellPath, &directives); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan task: %v", err)
+		}
+		data, err := os.ReadFile(t.shellPath)
+		if err != nil {
+			if selected[t.N] {
+				tasks = append(tasks, t)
+			}
+			continue
+		}
+		t.command = string(data)
+		// Directories created by any task count as existing, tasks often write into directories made by earlier ones
+		for _, dir := range scanTaskReferences(t.command).Mkdirs {
+			mkdirs[filepath.Clean(dir)] = true
+		}
+		if selected[t.N] {
+			if directives != nil {
+				t.directives = decodeDirectives(*directives)
+			}
+			tasks = append(tasks, t)
+		}
+	}
+	rows.Close()
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].N < tasks[j].N })
+
+	// bash -n is the slow part, run it in parallel
+	syntaxErrors := make([]string, len(tasks))
+	pool := gpool.New(runtime.NumCPU())
+	for i := range tasks {
+		if tasks[i].command == "" {
+			continue
+		}
+		pool.Add(1)
+		go func(i int) {
+			defer pool.Done()
+			syntaxErrors[i] = bashSyntaxCheck(tasks[i].shellPath)
+		}(i)
+	}
+	pool.Wait()
+
+	var issues []PreflightIssue
+	missingCommands := make(map[string]error)
+	for i, t := range tasks {
+		if t.command == "" {
+			issues = append(issues, PreflightIssue{Task: t.N, Message: fmt.Sprintf("script %s can't be read", t.shellPath)})
+			continue
+		}
+		if syntaxErrors[i] != "" {
+			issues = append(issues, PreflightIssue{Task: t.N, Message: syntaxErrors[i]})
+		}
+		refs := scanTaskReferences(t.command)
+		functions := make(map[string]bool)
+		for _, name := range refs.Functions {
+			functions[name] = true
+		}
+		reported := make(map[string]bool)
+		for _, name := range refs.Commands {
+			if shellBuiltins[name] || functions[name] || envCommands[name] || reported[name] {
+				continue
+			}
+			err, checked := missingCommands[name]
+			if !checked {
+				err = lookupCommand(name, workDir)
+				missingCommands[name] = err
+			}
+			if err != nil {
+				reported[name] = true
+				// The PATH of the compute nodes, or the one the task sets up itself, may differ from the current one
+				warning := mode == ModeQsubSge || refs.ChangesEnv
+				issues = append(issues, PreflightIssue{Task: t.N, Warning: warning, Message: fmt.Sprintf("command not found: %s", name)})
+			}
+		}
+		for _, path := range refs.Scripts {
+			if _, err := os.Stat(path); err != nil {
+				issues = append(issues, PreflightIssue{Task: t.N, Message: fmt.Sprintf("script %s does not exist", path)})
+			}
+		}
+		for _, path := range refs.Inputs {
+			if _, err := os.Stat(path); err != nil {
+				issues = append(issues, PreflightIssue{Task: t.N, Message: fmt.Sprintf("input %s does not exist", path)})
+			}
+		}
+		if _, err := expandPaths(t.directives.Inputs, workDir); err != nil {
+			issues = append(issues, PreflightIssue{Task: t.N, Message: fmt.Sprintf("declared input %v", err)})
+		}
+		for _, dir := range refs.Dirs {
+			if _, err := os.Stat(dir); err != nil && !createdBy(filepath.Clean(dir), mkdirs) {
+				issues = append(issues, PreflightIssue{Task: t.N, Message: fmt.Sprintf("directory %s does not exist", dir)})
+			}
+		}
+		// Other paths may be outputs, only a missing directory is reported (usually a typo)
+		for _, path := range refs.Paths {
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+			dir := filepath.Dir(filepath.Clean(path))
+			if _, err := os.Stat(dir); err != nil && !createdBy(dir, mkdirs) && !reported[dir] {
+				reported[dir] = true
+				issues = append(issues, PreflightIssue{Task: t.N, Message: fmt.Sprintf("directory %s does not exist (%s)", dir, path)})
+			}
+		}
+	}
+
+	if mode == ModeQsubSge {
+		issues = append(issues, preflightSGE(queue, sgeProject)...)
+	}
+	return issues, nil
+}
+
+// maxPreflightIssues limits the issues logged, a typo in a generated input file repeats in every task
+const maxPreflightIssues = 50
+
+// logPreflightIssues logs the issues found by the pre-flight check and returns the number of errors
+func logPreflightIssues(issues []PreflightIssue) int {
+	errorCount := 0
+	for i, issue := range issues {
+		if !issue.Warning {
+			errorCount++
+		}
+		if i < maxPreflightIssues {
+			log.Printf("Pre-flight %s", issue)
+		}
+	}
+	if len(issues) > maxPreflightIssues {
+		log.Printf("Pre-flight: ... and %d more issue(s)", len(issues)-maxPreflightIssues)
+	}
+	return errorCount
+}
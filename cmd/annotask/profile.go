@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Profile is a named set of resource settings selected with --profile, e.g. bigmem
+// Profiles are defined under profiles: in the system config (published by the admin) or the user config
+// Values of the profile take precedence over the config, flags given on the command line over the profile
+type Profile struct {
+	Line       int    `yaml:"line,omitempty"`
+	Thread     int    `yaml:"thread,omitempty"`
+	CPU        int    `yaml:"cpu,omitempty"`
+	Mem        string `yaml:"mem,omitempty"`
+	HVmem      string `yaml:"h_vmem,omitempty"`
+	Queue      string `yaml:"queue,omitempty"`
+	SgeProject string `yaml:"sge_project,omitempty"`
+	Timeout    string `yaml:"timeout,omitempty"`
+}
+
+// Merge returns the profile with non-empty values of other taking precedence
+func (p Profile) Merge(other Profile) Profile {
+	if other.Line > 0 {
+		p.Line = other.Line
+	}
+	if other.Thread > 0 {
+		p.Thread = other.Thread
+	}
+	if other.CPU > 0 {
+		p.CPU = other.CPU
+	}
+	if other.Mem != "" {
+		p.Mem = other.Mem
+	}
+	if other.HVmem != "" {
+		p.HVmem = other.HVmem
+	}
+	if other.Queue != "" {
+		p.Queue = other.Queue
+	}
+	if other.SgeProject != "" {
+		p.SgeProject = other.SgeProject
+	}
+	if other.Timeout != "" {
+		p.Timeout = other.Timeout
+	}
+	return p
+}
+
+// Validate checks the memory and timeout values of the profile
+func (p Profile) Validate() error {
+	if p.Mem != "" {
+		if _, err := parseMemoryString(p.Mem); err != nil {
+			return fmt.Errorf("mem: %v", err)
+		}
+	}
+	if p.HVmem != "" {
+		if _, err := parseMemoryString(p.HVmem); err != nil {
+			return fmt.Errorf("h_vmem: %v", err)
+		}
+	}
+	if p.Timeout != "" {
+		if _, err := parseDurationString(p.Timeout); err != nil {
+			return fmt.Errorf("timeout: %v", err)
+		}
+	}
+	return nil
+}
+
+// mergeProfiles merges the profiles of source into target, a profile defined in both is merged value by value
+func mergeProfiles(target *map[string]Profile, source map[string]Profile) {
+	if len(source) == 0 {
+		return
+	}
+	merged := make(map[string]Profile, len(*target)+len(source))
+	for name, p := range *target {
+		merged[name] = p
+	}
+	for name, p := range source {
+		merged[name] = merged[name].Merge(p)
+	}
+	*target = merged
+}
+
+// profileArg returns the value of --profile in the arguments of a module, empty if not given
+// The profile has to be known before the flags are defined, as it changes their defaults
+func profileArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--profile" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--profile=") {
+			return strings.TrimPrefix(arg, "--profile=")
+		}
+	}
+	return ""
+}
+
+// ConfigKeys returns the config keys the profile overrides (see selectProfile)
+func (p Profile) ConfigKeys() []string {
+	var keys []string
+	if p.Line > 0 {
+		keys = append(keys, "defaults.line")
+	}
+	if p.Thread > 0 {
+		keys = append(keys, "defaults.thread")
+	}
+	if p.CPU > 0 {
+		keys = append(keys, "defaults.cpu")
+	}
+	if p.Queue != "" {
+		keys = append(keys, "queue")
+	}
+	if p.SgeProject != "" {
+		keys = append(keys, "sge_project")
+	}
+	return keys
+}
+
+// selectProfile applies the profile given with --profile to the config and returns it, nil if no profile is given
+// The queue, SGE project, line, thread and CPU defaults of the config are replaced by the values the profile sets
+func selectProfile(config *Config, args []string) (*Profile, error) {
+	name := profileArg(args)
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := config.Profiles[name]
+	if !ok {
+		if len(config.Profiles) == 0 {
+			return nil, fmt.Errorf("unknown profile %s, no profiles are defined in the config", name)
+		}
+		names := make([]string, 0, len(config.Profiles))
+		for n := range config.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %s, available profiles: %s", name, strings.Join(names, ", "))
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("profile %s: %v", name, err)
+	}
+	if p.Line > 0 {
+		config.Defaults.Line = p.Line
+	}
+	if p.Thread > 0 {
+		config.Defaults.Thread = p.Thread
+	}
+	if p.CPU > 0 {
+		config.Defaults.CPU = p.CPU
+	}
+	if p.Queue != "" {
+		config.Queue = p.Queue
+	}
+	if p.SgeProject != "" {
+		config.SgeProject = p.SgeProject
+	}
+	return &p, nil
+}
+
+// profileThreads returns the default of -t/--thread, the thread count of the profile if it sets one
+func profileThreads(p *Profile) int {
+	if p != nil && p.Thread > 0 {
+		return p.Thread
+	}
+	return 10
+}
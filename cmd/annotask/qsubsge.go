@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/akamensky/argparse"
 )
@@ -83,10 +85,16 @@ func runQsubSgeMode(config *Config, args []string) {
 		}
 	}
 
+	// The profile changes the defaults of the flags, explicit flags still win
+	profile, err := selectProfile(config, args)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
 	parser := argparse.NewParser("annotask qsubsge", "Submit tasks to qsub SGE system")
 	opt_i := parser.String("i", "infile", &argparse.Options{Required: true, Help: "Input shell command file (one command per line or grouped by -l)"})
 	opt_l := parser.Int("l", "line", &argparse.Options{Default: config.Defaults.Line, Help: fmt.Sprintf("Number of lines to group as one task (default: %d)", config.Defaults.Line)})
-	opt_t := parser.Int("t", "thread", &argparse.Options{Default: 10, Help: "Max concurrent tasks to run (default: 10)"})
+	opt_t := parser.Int("t", "thread", &argparse.Options{Default: profileThreads(profile), Help: fmt.Sprintf("Max concurrent tasks to run (default: %d)", profileThreads(profile))})
 	opt_project := parser.String("", "project", &argparse.Options{Default: config.Project, Help: fmt.Sprintf("Project name (default: %s)", config.Project)})
 	opt_cpu := parser.Int("", "cpu", &argparse.Options{Default: config.Defaults.CPU, Help: fmt.Sprintf("Number of CPUs per task (default: %d)", config.Defaults.CPU)})
 	opt_mem := parser.String("", "mem", &argparse.Options{Required: false, Help: "Virtual memory (vf) per task (maps to -l vf=XG, only used if explicitly set). Supports formats: 2, 2G, 2g, 200m, 200M"})
@@ -102,22 +110,29 @@ func runQsubSgeMode(config *Config, args []string) {
 	opt_sge_project := parser.String("P", "sge-project", &argparse.Options{Default: config.SgeProject, Help: sgeProjectHelp})
 	opt_mode := parser.String("", "mode", &argparse.Options{Default: "num_proc", Help: "Parallel environment mode: pe_smp (use -pe smp X) or num_proc (use -l p=X, default)"})
 	opt_hostname := parser.String("", "hostname", &argparse.Options{Required: false, Help: "Specify hostname(s) for job execution. Supports single hostname or comma-separated list (e.g., node1 or node1,node2). Maps to -l h=hostname in SGE"})
-
-	// Check if user explicitly set --mem or --h_vmem before parsing
-	userSetMem := false
-	userSetHvmem := false
-	for _, arg := range args {
-		if arg == "--mem" {
-			userSetMem = true
-		}
-		if arg == "--h_vmem" {
-			userSetHvmem = true
-		}
-	}
+	opt_timeout := parser.String("", "timeout", &argparse.Options{Required: false, Help: "Wall-clock limit per task (maps to -l h_rt=HH:MM:SS, increased by 125% on retry when exceeded). Supports: 3600, 90m, 2h, 1h30m, 01:30:00"})
+	opt_fail_fast := parser.Flag("", "fail-fast", &argparse.Options{Help: "Stop dispatching new tasks after the first task that failed all its retries (same as --max-failures 0)"})
+	opt_max_failures := parser.String("", "max-failures", &argparse.Options{Required: false, Help: "Stop dispatching new tasks when more than N tasks (or P% of tasks) have failed. Supports: 5, 10%"})
+	opt_cancel_running := parser.Flag("", "cancel-running", &argparse.Options{Help: "Also terminate running SGE jobs when the failure budget is exceeded"})
+	opt_require_output := parser.StringList("", "require-output", &argparse.Options{Help: "Output file (or glob) every task must leave non-empty to be successful, relative to {input}.shell. Repeatable or comma-separated"})
+	opt_ok_exit_codes := parser.String("", "ok-exit-codes", &argparse.Options{Required: false, Help: "Exit codes treated as success, comma-separated (default: 0)"})
+	opt_require_pattern := parser.StringList("", "require-pattern", &argparse.Options{Help: "Regex that must appear in the job's .o/.e output. Repeatable"})
+	opt_reject_pattern := parser.StringList("", "reject-pattern", &argparse.Options{Help: "Regex that must not appear in the job's .o/.e output. Repeatable"})
+	opt_manifest := parser.String("", "manifest", &argparse.Options{Help: "YAML file declaring inputs/outputs (and hooks) per task number, tasks with up-to-date outputs are skipped"})
+	opt_metrics_listen := parser.String("", "metrics-listen", &argparse.Options{Help: "Serve Prometheus metrics of this run on this address (e.g. :9101)"})
+	opt_notify_cmd := parser.String("", "notify-cmd", &argparse.Options{Help: "Shell command run on notifications, the summary is passed on stdin"})
+	opt_notify_email := parser.StringList("", "notify-email", &argparse.Options{Help: "Email address notifications are sent to with sendmail. Repeatable or comma-separated"})
+	opt_notify_webhook := parser.StringList("", "notify-webhook", &argparse.Options{Help: "Webhook URL notifications are posted to (Slack, DingTalk, WeCom or generic JSON). Repeatable"})
+	opt_notify_events := parser.String("", "notify-events", &argparse.Options{Help: "When to notify, comma-separated: complete, failed, first_failure, threshold (default: complete,first_failure,threshold)"})
+	opt_notify_threshold := parser.String("", "notify-threshold", &argparse.Options{Help: "Notify when N tasks (or P% of tasks) have failed. Supports: 5, 10%"})
+	opt_wait := parser.Flag("", "wait", &argparse.Options{Help: "If another annotask process is running the input file, wait for it instead of exiting"})
+	opt_force := parser.Flag("", "force", &argparse.Options{Help: "Run even if the pre-flight check of the task scripts finds errors"})
+	parser.String("", "profile", &argparse.Options{Help: "Named resource profile from the config (profiles:), flags given explicitly take precedence"})
+	opt_dry_run := parser.Flag("", "dry-run", &argparse.Options{Help: "Show how the input file groups into tasks and which tasks would run, without running or recording anything"})
 
 	// Prepend program name for argparse.Parse (it expects os.Args-like format)
 	parseArgs := append([]string{"annotask"}, args...)
-	err := parser.Parse(parseArgs)
+	err = parser.Parse(parseArgs)
 	if err != nil {
 		// If help is requested, show module help
 		errStr := err.Error()
@@ -129,6 +144,23 @@ func runQsubSgeMode(config *Config, args []string) {
 		os.Exit(1)
 	}
 
+	// --mem and --h_vmem have no default, they are set explicitly if non-empty (--mem 8G or --mem=8G)
+	userSetMem := *opt_mem != ""
+	userSetHvmem := *opt_h_vmem != ""
+
+	// Memory and timeout of the profile apply unless given as flags
+	if profile != nil {
+		if !userSetMem && profile.Mem != "" {
+			*opt_mem, userSetMem = profile.Mem, true
+		}
+		if !userSetHvmem && profile.HVmem != "" {
+			*opt_h_vmem, userSetHvmem = profile.HVmem, true
+		}
+		if *opt_timeout == "" {
+			*opt_timeout = profile.Timeout
+		}
+	}
+
 	// Parse mem and h_vmem values
 	var mem float64
 	var h_vmem float64
@@ -147,6 +179,43 @@ func runQsubSgeMode(config *Config, args []string) {
 		}
 	}
 
+	// Parse timeout value (0 means no h_rt limit)
+	var timeout time.Duration
+	if opt_timeout != nil && *opt_timeout != "" {
+		timeout, err = parseDurationString(*opt_timeout)
+		if err != nil {
+			log.Fatalf("Error parsing --timeout value: %v", err)
+		}
+	}
+
+	// Validate failure budget early, the budget itself is created in runTasks once the number of tasks is known
+	if *opt_max_failures != "" {
+		if _, _, err := parseMaxFailures(*opt_max_failures); err != nil {
+			log.Fatalf("Error parsing --max-failures value: %v", err)
+		}
+	}
+
+	// Run-level success criteria (per-task criteria come from #@annotask directives in the input file)
+	criteria, err := newSuccessCriteria(*opt_require_output, *opt_ok_exit_codes, *opt_require_pattern, *opt_reject_pattern)
+	if err != nil {
+		log.Fatalf("Error parsing success criteria: %v", err)
+	}
+	manifest, err := LoadManifest(*opt_manifest)
+	if err != nil {
+		log.Fatalf("Error loading manifest: %v", err)
+	}
+	config.Notify, err = applyNotifyFlags(config.Notify, *opt_notify_cmd, *opt_notify_email, *opt_notify_webhook, *opt_notify_events, *opt_notify_threshold)
+	if err != nil {
+		log.Fatalf("Error parsing notify options: %v", err)
+	}
+	if *opt_metrics_listen != "" && !*opt_dry_run {
+		shellAbsPath, _ := filepath.Abs(*opt_i)
+		err = startMetricsServer(*opt_metrics_listen, GetCurrentUserID(), *opt_project, getFilePrefix(shellAbsPath), shellAbsPath)
+		if err != nil {
+			log.Fatalf("Error starting metrics server: %v", err)
+		}
+	}
+
 	// Note: We don't auto-calculate h_vmem from mem anymore.
 	// Only use values that user explicitly set via --mem or --h_vmem flags.
 
@@ -203,9 +272,38 @@ func runQsubSgeMode(config *Config, args []string) {
 		}
 	}
 
-	// Build command string from original args
-	command := "annotask qsubsge " + strings.Join(args, " ")
-	runTasks(config, *opt_i, *opt_l, *opt_t, *opt_project, ModeQsubSge, *opt_cpu, mem, h_vmem, userSetMem, userSetHvmem, queue, sgeProject, mode, command, hostname)
+	opts := runOptions{
+		Infile:          *opt_i,
+		Line:            *opt_l,
+		Thread:          *opt_t,
+		Project:         *opt_project,
+		Mode:            ModeQsubSge,
+		Command:         formatCommand("qsubsge", args),
+		CPU:             *opt_cpu,
+		Mem:             mem,
+		HVmem:           h_vmem,
+		UserSetMem:      userSetMem,
+		UserSetHvmem:    userSetHvmem,
+		Queue:           queue,
+		SgeProject:      sgeProject,
+		ParallelEnvMode: mode,
+		Hostname:        hostname,
+		Timeout:         timeout,
+		MaxFailures:     *opt_max_failures,
+		FailFast:        *opt_fail_fast,
+		CancelRunning:   *opt_cancel_running,
+		Criteria:        criteria,
+		Manifest:        manifest,
+		WaitLock:        *opt_wait,
+		Force:           *opt_force,
+	}
+	if *opt_dry_run {
+		if err := dryRun(os.Stdout, opts, config.Hooks); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	runTasks(config, opts)
 
 	// Close DRMAA session when qsubsge mode completes
 	closeDRMAASession()
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"golang.org/x/crypto/ssh"
+)
+
+// RunInterrupted is the status of a run whose annotask process died without finalizing it
+const RunInterrupted = "interrupted"
+
+// ReconcileOptions holds the options of reconcile
+type ReconcileOptions struct {
+	DryRun bool // Only report stale runs, don't change the databases
+	NoSSH  bool // Skip runs recorded on other nodes instead of checking them via SSH
+	Quiet  bool // Only print runs marked interrupted, to stderr (used by stat)
+}
+
+// StaleRun is a run marked interrupted by reconcile
+type StaleRun struct {
+	Run         RunInfo
+	Interrupted int      // Running tasks marked Failed in the local database
+	OrphanJobs  []string // SGE jobs of the run still known to qstat, their tasks stay Running
+	OrphanTasks []string // Task numbers of OrphanJobs and Unchecked
+	Unchecked   []string // SGE jobs whose state couldn't be checked (qstat failed), their tasks stay Running
+}
+
+// reconcileRuns checks runs recorded as running in the global database and marks those whose
+// annotask process is gone as interrupted, in the global and the local database
+// Runs on other nodes are checked via SSH unless opts.NoSSH is set
+func reconcileRuns(globalDB *GlobalDB, filter RunFilter, opts ReconcileOptions) ([]StaleRun, error) {
+	filter.Statuses = []string{"running"}
+	filter.Sort, filter.Limit = "", 0
+	runs, err := queryRuns(globalDB, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	currentNode, err := os.Hostname()
+	if err != nil {
+		log.Printf("Warning: Could not get current hostname: %v", err)
+	}
+
+	out := io.Writer(os.Stdout)
+	if opts.Quiet {
+		out = os.Stderr
+	}
+
+	var stale []StaleRun
+	var sgeJobs map[string]bool
+	var sgeErr error
+	sgeQueried := false
+	for _, run := range runs {
+		label := fmt.Sprintf("run %d  %s/%s  %s  node %s  pid %d", run.ID, run.Project, run.Module, run.Mode, orDash(run.Node), run.PID)
+		if run.PID <= 0 {
+			if !opts.Quiet {
+				fmt.Fprintf(out, "%s: unknown (no pid recorded)\n", label)
+			}
+			continue
+		}
+		remote := run.Node != "" && run.Node != "-" && run.Node != currentNode
+		if remote && opts.NoSSH {
+			continue
+		}
+		alive, err := runProcessAlive(run, remote)
+		if err != nil {
+			if !opts.Quiet {
+				fmt.Fprintf(out, "%s: unknown (%v)\n", label, err)
+			}
+			continue
+		}
+		if alive {
+			if !opts.Quiet {
+				fmt.Fprintf(out, "%s: alive\n", label)
+			}
+			continue
+		}
+
+		s := StaleRun{Run: run}
+		jobs, err := loadJobs(run.ShellPath)
+		if err != nil {
+			log.Printf("Warning: Could not read local database of run %d: %v", run.ID, err)
+		}
+		for _, job := range jobs {
+			if job.Status != string(J_running) || job.Mode != string(ModeQsubSge) || job.TaskID == "" {
+				continue
+			}
+			if !sgeQueried {
+				sgeJobs, sgeErr = listSGEJobs(run.UsrID)
+				sgeQueried = true
+			}
+			if sgeErr != nil {
+				s.Unchecked = append(s.Unchecked, job.TaskID)
+			} else if sgeJobs[job.TaskID] {
+				s.OrphanJobs = append(s.OrphanJobs, job.TaskID)
+			} else {
+				continue
+			}
+			s.OrphanTasks = append(s.OrphanTasks, strconv.Itoa(job.Num))
+		}
+
+		if !opts.DryRun {
+			s.Interrupted, err = markRunInterrupted(globalDB, &s.Run, jobs, append(s.OrphanJobs, s.Unchecked...))
+			if err != nil {
+				log.Printf("Warning: Failed to mark run %d as interrupted: %v", run.ID, err)
+				continue
+			}
+		}
+		stale = append(stale, s)
+
+		action := "marked interrupted"
+		if opts.DryRun {
+			action = "would be marked interrupted"
+		}
+		fmt.Fprintf(out, "%s: annotask process is gone, %s", label, action)
+		if s.Interrupted > 0 {
+			fmt.Fprintf(out, " (%d running task(s) marked Failed)", s.Interrupted)
+		}
+		fmt.Fprintln(out)
+		if len(s.OrphanJobs) > 0 {
+			fmt.Fprintf(out, "    orphaned SGE jobs still queued or running, their tasks are left Running: %s\n", strings.Join(s.OrphanJobs, " "))
+			fmt.Fprintf(out, "    wait for them or remove them with: qdel %s\n", strings.Join(s.OrphanJobs, " "))
+		}
+		if len(s.Unchecked) > 0 {
+			fmt.Fprintf(out, "    could not check SGE jobs (%v), their tasks are left Running: %s\n", sgeErr, strings.Join(s.Unchecked, " "))
+		}
+		if len(s.OrphanTasks) > 0 {
+			fmt.Fprintf(out, "    once the jobs ended, rerun the unfinished ones with: annotask rerun -k %d --tasks %s\n", s.Run.ID, strings.Join(s.OrphanTasks, ","))
+		}
+	}
+	return stale, nil
+}
+
+// runProcessAlive checks whether the annotask process of a run is still running on its node
+// A process with the recorded PID only counts if it looks like annotask (the PID may have been reused)
+func runProcessAlive(run RunInfo, remote bool) (bool, error) {
+	command := fmt.Sprintf("ps -o args= -p %d", run.PID)
+	var output []byte
+	if remote {
+		out, exitCode, err := runSSHCommand(run.Node, command)
+		if err != nil {
+			return false, fmt.Errorf("ssh to %s failed: %v", run.Node, err)
+		}
+		if exitCode != 0 {
+			return false, nil
+		}
+		output = out
+	} else {
+		if !processExists(run.PID) {
+			return false, nil
+		}
+		out, err := exec.Command("ps", "-o", "args=", "-p", strconv.Itoa(run.PID)).Output()
+		if err != nil {
+			// The process exists but ps failed or is missing, trust the PID
+			return true, nil
+		}
+		output = out
+	}
+	args := strings.TrimSpace(string(output))
+	if args == "" {
+		return false, nil
+	}
+	return strings.Contains(args, "annotask") || strings.Contains(args, filepath.Base(run.ShellPath)), nil
+}
+
+// runSSHCommand runs a command on a node via SSH and returns its output and exit code
+// An error is only returned if the command couldn't be run
+func runSSHCommand(node, command string) ([]byte, int, error) {
+	config, err := getSSHConfig()
+	if err != nil {
+		return nil, 0, err
+	}
+	address := node
+	if !strings.Contains(address, ":") {
+		address = net.JoinHostPort(address, "22")
+	}
+	client, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create SSH session: %v", err)
+	}
+	defer session.Close()
+
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	err = session.Run(command)
+	if exitError, ok := err.(*ssh.ExitError); ok {
+		return stdout.Bytes(), exitError.ExitStatus(), nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return stdout.Bytes(), 0, nil
+}
+
+// listSGEJobs returns the IDs of the user's jobs known to SGE (queued, running or held)
+func listSGEJobs(usrID string) (map[string]bool, error) {
+	output, err := exec.Command("qstat", "-u", usrID).Output()
+	if err != nil {
+		return nil, fmt.Errorf("qstat failed: %v", err)
+	}
+	jobs := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// Skip the header and separator lines, job lines start with the numeric job ID
+		if _, err := strconv.Atoi(fields[0]); err == nil {
+			jobs[fields[0]] = true
+		}
+	}
+	return jobs, nil
+}
+
+// markRunInterrupted marks a run interrupted in the global database and its running tasks Failed
+// in the local database, so that they are rerun next time
+// Tasks whose SGE job is still alive (aliveJobs) stay Running, otherwise rerun --failed would submit them a second time
+// The end time of the run is its last recorded task activity
+// Returns the number of tasks marked Failed
+func markRunInterrupted(globalDB *GlobalDB, run *RunInfo, jobs []JobInfo, aliveJobs []string) (int, error) {
+	endTime := lastActivity(run, jobs)
+	interrupted := 0
+	if dbObj, err := openLocalDB(run.ShellPath); err == nil {
+		reason := fmt.Sprintf("interrupted: annotask process %d on %s is gone", run.PID, orDash(run.Node))
+		query := "UPDATE job SET status=?, endtime=?, reason=? WHERE status=?"
+		queryArgs := []interface{}{J_failed, endTime.Format("2006-01-02 15:04:05"), reason, J_running}
+		if len(aliveJobs) > 0 {
+			query += " AND (mode IS NOT ? OR taskid IS NULL OR taskid NOT IN (?" + strings.Repeat(",?", len(aliveJobs)-1) + "))"
+			queryArgs = append(queryArgs, string(ModeQsubSge))
+			for _, id := range aliveJobs {
+				queryArgs = append(queryArgs, id)
+			}
+		}
+		result, err := dbObj.Db.Exec(query, queryArgs...)
+		if err != nil {
+			log.Printf("Warning: Failed to update local database of run %d: %v", run.ID, err)
+		} else if n, err := result.RowsAffected(); err == nil {
+			interrupted = int(n)
+		}
+		dbObj.Db.Close()
+		refreshRunCounts(run)
+	} else {
+		log.Printf("Warning: Only marking run %d interrupted in the global database: %v", run.ID, err)
+	}
+
+	_, err := globalDB.Db.Exec(`
+		UPDATE tasks SET status=?, endtime=?,
+			totalTasks=?, pendingTasks=?, failedTasks=?, runningTasks=?, finishedTasks=?
+		WHERE Id=?
+	`, RunInterrupted, endTime.Format("2006-01-02 15:04:05"),
+		run.Total, run.Pending, run.Failed, run.Running, run.Finished, run.ID)
+	if err != nil {
+		return interrupted, fmt.Errorf("failed to update global database: %v", err)
+	}
+	run.Status = RunInterrupted
+	return interrupted, nil
+}
+
+// lastActivity returns the latest task start or end time of a run (its start time if there is none)
+func lastActivity(run *RunInfo, jobs []JobInfo) time.Time {
+	last, ok := parseDBTime(run.StartTime)
+	if !ok {
+		return time.Now()
+	}
+	for _, job := range jobs {
+		for _, s := range []string{job.StartTime, job.EndTime} {
+			if t, ok := parseDBTime(s); ok && t.After(last) {
+				last = t
+			}
+		}
+	}
+	return last
+}
+
+// orDash returns s, or "-" if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// RunReconcileModule runs the reconcile module
+func RunReconcileModule(config *Config, args []string) {
+	globalDB, err := InitGlobalDB(config.Db)
+	if err != nil {
+		log.Fatalf("Failed to initialize global database: %v", err)
+	}
+	defer globalDB.Db.Close()
+
+	parser := argparse.NewParser("annotask reconcile", "Mark runs whose annotask process died as interrupted")
+	opt_project := parser.String("p", "project", &argparse.Options{Help: "Only check runs of this project"})
+	opt_id := parser.String("k", "id", &argparse.Options{Help: "Only check the run with this ID or run ID"})
+	opt_dry_run := parser.Flag("n", "dry-run", &argparse.Options{Help: "Only report stale runs, don't change the databases"})
+	opt_no_ssh := parser.Flag("", "no-ssh", &argparse.Options{Help: "Don't check runs recorded on other nodes via SSH"})
+
+	parseArgs := append([]string{"annotask"}, args...)
+	err = parser.Parse(parseArgs)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "help") {
+			printModuleHelp("reconcile", config)
+			return
+		}
+		fmt.Print(parser.Usage(err))
+		os.Exit(1)
+	}
+
+	filter := RunFilter{UsrID: GetCurrentUserID(), Project: *opt_project}
+	if *opt_id != "" {
+		if filter.ID, err = resolveRunRef(globalDB, filter.UsrID, *opt_id); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	stale, err := reconcileRuns(globalDB, filter, ReconcileOptions{DryRun: *opt_dry_run, NoSSH: *opt_no_ssh})
+	if err != nil {
+		log.Fatalf("Reconcile failed: %v", err)
+	}
+	if len(stale) == 0 {
+		fmt.Println("No stale runs found")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/akamensky/argparse"
+)
+
+// reportGroupKeys are the columns a report can be grouped by
+var reportGroupKeys = []string{"project", "module", "user", "month"}
+
+// ReportRow is one group of a usage report
+type ReportRow struct {
+	Keys     map[string]string
+	Runs     int
+	Tasks    int
+	CPUHours float64
+	MemHours float64
+}
+
+// reportGroupKey returns the value of a group column for a run
+func reportGroupKey(run *RunInfo, key string) string {
+	switch key {
+	case "project":
+		return run.Project
+	case "module":
+		return run.Module
+	case "user":
+		return run.UsrID
+	case "month":
+		if t, ok := parseDBTime(run.StartTime); ok {
+			return t.Format("2006-01")
+		}
+		return ""
+	}
+	return ""
+}
+
+// buildReport groups runs by the given columns, sorted by group values
+func buildReport(runs []RunInfo, groupBy []string) []ReportRow {
+	groups := make(map[string]*ReportRow)
+	var order []string
+	for i := range runs {
+		run := &runs[i]
+		keys := make(map[string]string, len(groupBy))
+		values := make([]string, len(groupBy))
+		for j, key := range groupBy {
+			keys[key] = reportGroupKey(run, key)
+			values[j] = keys[key]
+		}
+		id := strings.Join(values, "\x00")
+		row := groups[id]
+		if row == nil {
+			row = &ReportRow{Keys: keys}
+			groups[id] = row
+			order = append(order, id)
+		}
+		row.Runs++
+		row.Tasks += run.Total
+		row.CPUHours += run.CPUHours
+		row.MemHours += run.MemHours
+	}
+
+	sort.Strings(order)
+	rows := make([]ReportRow, len(order))
+	for i, id := range order {
+		rows[i] = *groups[id]
+	}
+	return rows
+}
+
+// reportFields returns the output fields of a report grouped by groupBy
+func reportFields(groupBy []string) []outputField[ReportRow] {
+	var fields []outputField[ReportRow]
+	for _, key := range groupBy {
+		key := key
+		fields = append(fields, outputField[ReportRow]{key, func(r *ReportRow) interface{} { return r.Keys[key] }})
+	}
+	return append(fields,
+		outputField[ReportRow]{"runs", func(r *ReportRow) interface{} { return r.Runs }},
+		outputField[ReportRow]{"tasks", func(r *ReportRow) interface{} { return r.Tasks }},
+		outputField[ReportRow]{"cpu_hours", func(r *ReportRow) interface{} { return roundHours(r.CPUHours) }},
+		outputField[ReportRow]{"mem_hours", func(r *ReportRow) interface{} { return roundHours(r.MemHours) }},
+	)
+}
+
+// parseGroupBy parses the --by list
+func parseGroupBy(s string) ([]string, error) {
+	var groupBy []string
+	for _, key := range splitList(s) {
+		key = strings.ToLower(key)
+		if !containsString(reportGroupKeys, key) {
+			return nil, fmt.Errorf("invalid --by value: %s (expected %s)", key, strings.Join(reportGroupKeys, ", "))
+		}
+		if !containsString(groupBy, key) {
+			groupBy = append(groupBy, key)
+		}
+	}
+	if len(groupBy) == 0 {
+		return nil, fmt.Errorf("--by must not be empty")
+	}
+	return groupBy, nil
+}
+
+// RunReportCommand writes a usage report of the runs selected by filter
+// Table and Markdown reports end with a total row
+func RunReportCommand(globalDB *GlobalDB, filter RunFilter, groupBy []string, format string) error {
+	runs, err := queryRuns(globalDB, filter)
+	if err != nil {
+		return err
+	}
+	rows := buildReport(runs, groupBy)
+	if (format == FormatTable || format == FormatMarkdown) && len(rows) > 0 {
+		total := ReportRow{Keys: map[string]string{groupBy[0]: "total"}}
+		for _, row := range rows {
+			total.Runs += row.Runs
+			total.Tasks += row.Tasks
+			total.CPUHours += row.CPUHours
+			total.MemHours += row.MemHours
+		}
+		rows = append(rows, total)
+	}
+	if len(rows) == 0 && format == FormatTable {
+		fmt.Println("No runs found")
+		return nil
+	}
+	return writeRows(os.Stdout, rows, reportFields(groupBy), format)
+}
+
+// RunReportModule runs the report module
+func RunReportModule(config *Config, args []string) {
+	globalDB, err := InitGlobalDB(config.Db)
+	if err != nil {
+		log.Fatalf("Failed to initialize global database: %v", err)
+	}
+	defer globalDB.Db.Close()
+
+	parser := argparse.NewParser("annotask report", "Report CPU-hours and memory-hours of runs")
+	opt_by := parser.String("", "by", &argparse.Options{Default: "project", Help: "Group by: project, module, user, month (comma-separated)"})
+	opt_project := parser.String("p", "project", &argparse.Options{Help: "Only runs of this project"})
+	opt_module := parser.String("", "module", &argparse.Options{Help: "Only runs of modules matching this glob"})
+	opt_since := parser.String("", "since", &argparse.Options{Help: "Only runs started at or after this time: 2024-12-01, '2024-12-01 08:00', or 30d ago"})
+	opt_until := parser.String("", "until", &argparse.Options{Help: "Only runs started before this time (a date alone includes that day)"})
+	opt_user := parser.String("", "user", &argparse.Options{Help: "Report runs of this user (admins only)"})
+	opt_all_users := parser.Flag("", "all-users", &argparse.Options{Help: "Report runs of all users (admins only)"})
+	opt_format := parser.String("", "format", &argparse.Options{Default: FormatTable, Help: "Output format: table, csv, tsv, markdown or json"})
+
+	parseArgs := append([]string{"annotask"}, args...)
+	err = parser.Parse(parseArgs)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "help") {
+			printModuleHelp("report", config)
+			return
+		}
+		fmt.Print(parser.Usage(err))
+		os.Exit(1)
+	}
+
+	groupBy, err := parseGroupBy(*opt_by)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if *opt_format != FormatMarkdown {
+		if err := validateFormat(*opt_format); err != nil {
+			log.Fatalf("Error: invalid format: %s (expected table, csv, tsv, markdown or json)", *opt_format)
+		}
+	}
+
+	currentUser := GetCurrentUserID()
+	filter := RunFilter{UsrID: currentUser, Project: *opt_project, Module: *opt_module}
+	if *opt_all_users || (*opt_user != "" && *opt_user != currentUser) {
+		if !isAdmin(config, currentUser) {
+			log.Fatalf("Error: --all-users and --user are only available to admins (set admins in annotask.yaml of the program directory)")
+		}
+		filter.UsrID = *opt_user
+		if *opt_all_users {
+			filter.UsrID = ""
+		}
+	}
+	if filter.Since, err = parseTimeArg(*opt_since, false); err != nil {
+		log.Fatalf("Error parsing --since value: %v", err)
+	}
+	if filter.Until, err = parseTimeArg(*opt_until, true); err != nil {
+		log.Fatalf("Error parsing --until value: %v", err)
+	}
+
+	if err := RunReportCommand(globalDB, filter, groupBy, *opt_format); err != nil {
+		log.Fatalf("Report failed: %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akamensky/argparse"
+)
+
+// TaskSelection is a set of task numbers a rerun is restricted to
+// A nil TaskSelection selects all tasks
+type TaskSelection map[int]bool
+
+// rerunSelection restricts the current run to the tasks selected by annotask rerun, nil otherwise
+var rerunSelection TaskSelection
+
+// rerunLock is the input lock taken by annotask rerun before resetting the tasks, used by runTasks instead of taking it again
+var rerunLock *InputLock
+
+// Contains checks if task N is explicitly selected
+func (s TaskSelection) Contains(N int) bool {
+	return s[N]
+}
+
+// Filter returns the tasks of need2run that are selected
+func (s TaskSelection) Filter(need2run []int) []int {
+	if s == nil {
+		return need2run
+	}
+	var selected []int
+	for _, N := range need2run {
+		if s[N] {
+			selected = append(selected, N)
+		}
+	}
+	return selected
+}
+
+// Sorted returns the selected task numbers in ascending order
+func (s TaskSelection) Sorted() []int {
+	nums := make([]int, 0, len(s))
+	for N := range s {
+		nums = append(nums, N)
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+// parseTaskRanges parses a task list like "3,17,40-55"
+func parseTaskRanges(s string) (TaskSelection, error) {
+	selection := make(TaskSelection)
+	for _, part := range splitList(s) {
+		from, to, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil || start <= 0 {
+			return nil, fmt.Errorf("invalid task number: %s", part)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(strings.TrimSpace(to))
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid task range: %s", part)
+			}
+		}
+		for N := start; N <= end; N++ {
+			selection[N] = true
+		}
+	}
+	if len(selection) == 0 {
+		return nil, fmt.Errorf("no tasks given")
+	}
+	return selection, nil
+}
+
+// formatCommand builds the command line of a run from the module arguments
+// Arguments that are not plain words are quoted, so the line can be split again by splitCommand
+func formatCommand(module string, args []string) string {
+	words := []string{"annotask", module}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+			arg = shellQuote(arg)
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// splitCommand splits a command line into words, handling single quotes, double quotes and backslashes
+func splitCommand(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range command {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' {
+				escaped = true
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote in command: %s", command)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// rerunArgs returns the module arguments of a run from its recorded command line
+// Runs recorded by older versions have no command line, only the input file is known then
+func rerunArgs(run *RunInfo) ([]string, error) {
+	if run.Command == "" {
+		log.Printf("Warning: Run %d has no recorded command line, rerunning %s with default options", run.ID, run.ShellPath)
+		return []string{"-i", run.ShellPath}, nil
+	}
+	words, err := splitCommand(run.Command)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) < 2 || words[0] != "annotask" || words[1] != run.Mode {
+		return nil, fmt.Errorf("unexpected command line of run %d: %s", run.ID, run.Command)
+	}
+	return words[2:], nil
+}
+
+// setOption replaces all occurrences of a --name option (as "--name value" or "--name=value") in args
+func setOption(args []string, name, value string) []string {
+	flag := "--" + name
+	var out []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == flag {
+			i++ // Skip the value
+			continue
+		}
+		if strings.HasPrefix(args[i], flag+"=") {
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return append(out, flag, value)
+}
+
+// resetTasksForRerun removes the .sign files of the selected tasks and marks them Pending,
+// so they run again even if they finished
+// With clearResources the memory and h_rt raised by earlier retries are cleared, so that the tasks
+// are submitted with the resources given to rerun (--mem/--h_vmem) rather than the stored ones
+func resetTasksForRerun(dbObj *MySql, selection TaskSelection, clearResources bool) error {
+	rows, err := dbObj.Db.Query("SELECT subJob_num, shellPath FROM job")
+	if err != nil {
+		return fmt.Errorf("failed to query tasks: %v", err)
+	}
+	shellPaths := make(map[int]string)
+	for rows.Next() {
+		var N int
+		var shellPath string
+		if err := rows.Scan(&N, &shellPath); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan task: %v", err)
+		}
+		shellPaths[N] = shellPath
+	}
+	rows.Close()
+
+	var missing []string
+	for _, N := range selection.Sorted() {
+		if _, ok := shellPaths[N]; !ok {
+			missing = append(missing, strconv.Itoa(N))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no such task(s): %s (the run has %d tasks)", strings.Join(missing, ","), len(shellPaths))
+	}
+
+	resources := ""
+	if clearResources {
+		resources = ", mem=0, h_vmem=0, h_rt=0"
+	}
+	for _, N := range selection.Sorted() {
+		removeSignFile(shellPaths[N])
+		_, err := dbObj.Db.Exec(`
+			UPDATE job
+			SET status=?, endtime=NULL, exitCode=NULL, taskid=NULL, reason=NULL, retry=1`+resources+`
+			WHERE subJob_num=?
+		`, J_pending, N)
+		if err != nil {
+			return fmt.Errorf("failed to reset task %d: %v", N, err)
+		}
+	}
+	return nil
+}
+
+// failedTasks returns the failed tasks of a local database
+func failedTasks(dbObj *MySql) (TaskSelection, error) {
+	rows, err := dbObj.Db.Query("SELECT subJob_num FROM job WHERE status=?", J_failed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query failed tasks: %v", err)
+	}
+	defer rows.Close()
+	selection := make(TaskSelection)
+	for rows.Next() {
+		var N int
+		if err := rows.Scan(&N); err != nil {
+			return nil, fmt.Errorf("failed to scan task: %v", err)
+		}
+		selection[N] = true
+	}
+	return selection, rows.Err()
+}
+
+// RunRerunModule runs the rerun module
+func RunRerunModule(config *Config, args []string) {
+	parser := argparse.NewParser("annotask rerun", "Rerun failed or selected tasks of a run")
+	opt_id := parser.String("k", "id", &argparse.Options{Required: true, Help: "ID or run ID of the run (from annotask stat)"})
+	opt_failed := parser.Flag("", "failed", &argparse.Options{Help: "Rerun the failed tasks (default)"})
+	opt_tasks := parser.String("", "tasks", &argparse.Options{Help: "Rerun these tasks, even if they finished: 3,17,40-55"})
+	opt_mem := parser.String("", "mem", &argparse.Options{Help: "Override the virtual memory (vf) per task (qsubsge only)"})
+	opt_h_vmem := parser.String("", "h_vmem", &argparse.Options{Help: "Override the hard virtual memory limit per task (qsubsge only)"})
+	opt_queue := parser.String("", "queue", &argparse.Options{Help: "Override the queue(s) (qsubsge only)"})
+
+	parseArgs := append([]string{"annotask"}, args...)
+	err := parser.Parse(parseArgs)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "help") {
+			printModuleHelp("rerun", config)
+			return
+		}
+		fmt.Print(parser.Usage(err))
+		os.Exit(1)
+	}
+	if *opt_failed && *opt_tasks != "" {
+		log.Fatalf("Error: --failed and --tasks can't be used together")
+	}
+
+	globalDB, err := InitGlobalDB(config.Db)
+	if err != nil {
+		log.Fatalf("Failed to initialize global database: %v", err)
+	}
+	id, err := resolveRunRef(globalDB, GetCurrentUserID(), *opt_id)
+	if err != nil {
+		globalDB.Db.Close()
+		log.Fatalf("Error: %v", err)
+	}
+	run, err := loadRun(globalDB, GetCurrentUserID(), id)
+	if err != nil {
+		globalDB.Db.Close()
+		log.Fatalf("Error: %v", err)
+	}
+	if run.Status == "running" {
+		currentNode, _ := os.Hostname()
+		remote := run.Node != "" && run.Node != currentNode
+		alive, err := runProcessAlive(*run, remote)
+		if err != nil {
+			globalDB.Db.Close()
+			log.Fatalf("Error: run %d is recorded as running and its process can't be checked: %v", run.ID, err)
+		}
+		if alive {
+			globalDB.Db.Close()
+			log.Fatalf("Error: run %d is still running (pid %d on %s)", run.ID, run.PID, orDash(run.Node))
+		}
+	}
+	globalDB.Db.Close()
+
+	// Hold the input lock from resetting the tasks until the rerun ends, so that no other process
+	// can start on the input file in between
+	lockHost, _ := os.Hostname()
+	inputLock, err := acquireInputLock(run.ShellPath, LockHolder{Host: lockHost, PID: os.Getpid(), Command: formatCommand("rerun", args)}, false)
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		if locked.Holder != nil {
+			log.Fatalf("Error: %s is being run by annotask %s", run.ShellPath, locked.Holder)
+		}
+		log.Fatalf("Error: %s is being run by another annotask process", run.ShellPath)
+	} else if err != nil {
+		log.Printf("Warning: Rerunning %s without lock: %v", run.ShellPath, err)
+	}
+	rerunLock = inputLock
+
+	moduleArgs, err := rerunArgs(run)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	overrides := map[string]string{"mem": *opt_mem, "h_vmem": *opt_h_vmem, "queue": *opt_queue}
+	for _, name := range []string{"mem", "h_vmem", "queue"} {
+		if overrides[name] == "" {
+			continue
+		}
+		if run.Mode != string(ModeQsubSge) {
+			log.Fatalf("Error: --%s is only available for qsubsge runs, run %d is a %s run", name, run.ID, run.Mode)
+		}
+		moduleArgs = setOption(moduleArgs, name, overrides[name])
+	}
+
+	// Select the tasks and reset them in {input}.db
+	dbObj, err := openLocalDB(run.ShellPath)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	var selection TaskSelection
+	if *opt_tasks != "" {
+		selection, err = parseTaskRanges(*opt_tasks)
+		if err != nil {
+			dbObj.Db.Close()
+			log.Fatalf("Error parsing --tasks value: %v", err)
+		}
+	} else {
+		selection, err = failedTasks(dbObj)
+		if err != nil {
+			dbObj.Db.Close()
+			log.Fatalf("Error: %v", err)
+		}
+		if len(selection) == 0 {
+			dbObj.Db.Close()
+			fmt.Printf("Run %d has no failed tasks\n", run.ID)
+			return
+		}
+	}
+	err = resetTasksForRerun(dbObj, selection, *opt_mem != "" || *opt_h_vmem != "")
+	dbObj.Db.Close()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// Resume the run from the directory it was started in, restricted to the selected tasks
+	if run.WorkDir != "" {
+		if err := os.Chdir(run.WorkDir); err != nil {
+			log.Fatalf("Error: could not change to the working directory of run %d: %v", run.ID, err)
+		}
+	}
+	var nums []string
+	for _, N := range selection.Sorted() {
+		nums = append(nums, strconv.Itoa(N))
+	}
+	log.Printf("Rerunning %d task(s) of run %d: %s", len(nums), run.ID, strings.Join(nums, ","))
+	log.Printf("Command: %s", formatCommand(run.Mode, moduleArgs))
+	rerunSelection = selection
+
+	switch JobMode(run.Mode) {
+	case ModeLocal:
+		runLocalMode(config, moduleArgs)
+	case ModeQsubSge:
+		runQsubSgeMode(config, moduleArgs)
+	default:
+		log.Fatalf("Error: unknown mode %q of run %d", run.Mode, run.ID)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// crockfordAlphabet is the Crockford base32 alphabet used by ULIDs
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newRunID generates a ULID identifying a run: 48-bit millisecond timestamp followed by 80 random bits,
+// encoded as 26 Crockford base32 characters, so run IDs sort by start time
+func newRunID(t time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], uint64(t.UnixMilli())<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		// crypto/rand doesn't fail on supported platforms, fall back to the clock
+		binary.BigEndian.PutUint64(b[8:], uint64(time.Now().UnixNano()))
+	}
+
+	// 128 bits as 26 base32 digits (130 bits, the first digit holds the top 3 bits)
+	var out [26]byte
+	for i := 0; i < 26; i++ {
+		digit := 0
+		for j := 0; j < 5; j++ {
+			bit := (25-i)*5 + 4 - j // Bit index from the least significant bit
+			digit <<= 1
+			if bit < 128 && b[15-bit/8]&(1<<(bit%8)) != 0 {
+				digit |= 1
+			}
+		}
+		out[i] = crockfordAlphabet[digit]
+	}
+	return string(out[:])
+}
+
+// resolveRunRef returns the Id of a run given its Id or its run ID (or a unique prefix of it)
+// An all-digit ref is an Id unless it is only a run ID prefix, it is an error if it matches both
+// Only runs of usrID are considered, any user if usrID is empty
+func resolveRunRef(globalDB *GlobalDB, usrID, ref string) (int, error) {
+	ref = strings.TrimSpace(ref)
+	id, atoiErr := strconv.Atoi(ref)
+	if atoiErr != nil && (ref == "" || strings.Trim(strings.ToUpper(ref), crockfordAlphabet) != "") {
+		return 0, fmt.Errorf("invalid run ID: %s", ref)
+	}
+	ids, err := runIDPrefixMatches(globalDB, usrID, ref)
+	if err != nil {
+		return 0, err
+	}
+	if atoiErr == nil {
+		var idExists bool
+		err := globalDB.Db.QueryRow("SELECT COUNT(*) > 0 FROM tasks WHERE Id=? AND (?='' OR usrID=?)", id, usrID, usrID).Scan(&idExists)
+		if err != nil {
+			return 0, fmt.Errorf("failed to query tasks: %v", err)
+		}
+		if len(ids) == 0 || (len(ids) == 1 && ids[0] == id) {
+			return id, nil
+		}
+		if idExists {
+			return 0, fmt.Errorf("%s is both the Id of run %d and a run ID prefix, give the full run ID or more characters", ref, id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return 0, fmt.Errorf("run %s not found or does not belong to user %s", ref, usrID)
+	case 1:
+		return ids[0], nil
+	}
+	return 0, fmt.Errorf("run ID prefix %s is ambiguous, give more characters", ref)
+}
+
+// runIDPrefixMatches returns the Ids of up to 2 runs whose run ID starts with prefix (case-insensitive)
+func runIDPrefixMatches(globalDB *GlobalDB, usrID, prefix string) ([]int, error) {
+	rows, err := globalDB.Db.Query("SELECT Id FROM tasks WHERE runID LIKE ? AND (?='' OR usrID=?) LIMIT 2",
+		strings.ToUpper(prefix)+"%", usrID, usrID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tasks: %v", err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan task: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
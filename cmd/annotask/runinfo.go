@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// RunInfo is one run (row of the global tasks table) with live task counts from its local database
+type RunInfo struct {
+	ID        int    `json:"id"`
+	RunID     string `json:"runId"`
+	UsrID     string `json:"user"`
+	Project   string `json:"project"`
+	Module    string `json:"module"`
+	Mode      string `json:"mode"`
+	Status    string `json:"status"`
+	StartTime string `json:"starttime"`
+	EndTime   string `json:"endtime,omitempty"`
+	ShellPath string `json:"shellPath"`
+	Node      string `json:"node,omitempty"`
+	PID       int    `json:"pid,omitempty"`
+	Total     int    `json:"total"`
+	Pending   int    `json:"pending"`
+	Running   int    `json:"running"`
+	Failed    int    `json:"failed"`
+	Finished  int    `json:"finished"`
+	// Usage of completed task attempts of this run
+	CPUHours float64 `json:"cpuHours"`
+	MemHours float64 `json:"memHours"` // GB-hours
+	// Command line and working directory the run was started with (empty for runs of older versions)
+	Command string `json:"command,omitempty"`
+	WorkDir string `json:"workdir,omitempty"`
+	// Parameters of the run as JSON (RunParams)
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// JobInfo is one task (row of the local job table)
+type JobInfo struct {
+	Num       int    `json:"num"`
+	ShellPath string `json:"shellPath"`
+	Status    string `json:"status"`
+	Retry     int    `json:"retry"`
+	ExitCode  *int   `json:"exitCode,omitempty"`
+	StartTime string `json:"starttime,omitempty"`
+	EndTime   string `json:"endtime,omitempty"`
+	Mode      string `json:"mode"`
+	TaskID    string `json:"taskid,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// CPU slots of the task (1 for local tasks)
+	CPU int `json:"cpu,omitempty"`
+	// Memory requested from SGE in GB (zero for local tasks or if not set)
+	// After a memory failure it is the escalated request of the next retry
+	Mem   float64 `json:"mem,omitempty"`
+	HVmem float64 `json:"h_vmem,omitempty"`
+}
+
+// parseDBTime parses a time stored in the databases
+// Times are stored as local wall-clock "2006-01-02 15:04:05", but the sqlite3 driver returns datetime
+// columns as "2006-01-02T15:04:05Z", so the zone suffix is ignored (like formatTimeShort does)
+func parseDBTime(s string) (time.Time, bool) {
+	if len(s) < 19 {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", strings.Replace(s[:19], "T", " ", 1), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// normalizeDBTime formats a time read from the databases as "2006-01-02 15:04:05"
+// Returns the input unchanged if it can't be parsed
+func normalizeDBTime(s string) string {
+	if t, ok := parseDBTime(s); ok {
+		return t.Format("2006-01-02 15:04:05")
+	}
+	return s
+}
+
+// elapsedSince returns the time from start to end (or now if end is empty), zero if start can't be parsed
+func elapsedSince(start, end string) time.Duration {
+	startTime, ok := parseDBTime(start)
+	if !ok {
+		return 0
+	}
+	endTime, ok := parseDBTime(end)
+	if !ok {
+		endTime = time.Now()
+	}
+	if endTime.Before(startTime) {
+		return 0
+	}
+	return endTime.Sub(startTime)
+}
+
+// openLocalDB opens the local database of a run without creating it if it doesn't exist
+func openLocalDB(shellPath string) (*MySql, error) {
+	dbPath := shellPath + ".db"
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("local database not found: %s", dbPath)
+	}
+	conn, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local database: %v", err)
+	}
+	return &MySql{Db: conn}, nil
+}
+
+// loadRuns loads runs of a user from global database, newest first
+// Empty usrID means all users, empty projectFilter means all projects
+// Task counts are refreshed from each run's local database
+// when it is readable, otherwise the counts stored in the global database are used
+func loadRuns(globalDB *GlobalDB, usrID, projectFilter string) ([]RunInfo, error) {
+	return queryRuns(globalDB, RunFilter{UsrID: usrID, Project: projectFilter})
+}
+
+// RunFilter selects runs of the global tasks table, each set field adds a WHERE condition
+type RunFilter struct {
+	ID       int      // 0 for any run
+	UsrID    string   // Empty for all users
+	Project  string   // Empty for all projects
+	Statuses []string // Any of these statuses
+	Since    time.Time
+	Until    time.Time
+	Module   string // Glob pattern
+	Mode     string
+	Node     string // Glob pattern
+	Sort     string // field[:asc|desc], empty for newest first
+	Limit    int    // 0 for no limit
+}
+
+// runSortColumns maps sortable fields to columns of the tasks table
+var runSortColumns = map[string]string{
+	"id":        "Id",
+	"user":      "usrID",
+	"project":   "project",
+	"module":    "module",
+	"mode":      "mode",
+	"status":    "status",
+	"starttime": "starttime",
+	"endtime":   "endtime",
+	"elapsed":   "(julianday(COALESCE(endtime, datetime('now', 'localtime'))) - julianday(starttime))",
+	"total":     "totalTasks",
+	"pending":   "pendingTasks",
+	"running":   "runningTasks",
+	"failed":    "failedTasks",
+	"finished":  "finishedTasks",
+	"cpuHours":  "cpuHours",
+	"memHours":  "memHours",
+	"node":      "node",
+	"pid":       "pid",
+}
+
+// Where returns the WHERE clause (starting with "WHERE 1=1") and its arguments
+func (f RunFilter) Where() (string, []interface{}) {
+	where := "WHERE 1=1"
+	var args []interface{}
+	if f.ID != 0 {
+		where += " AND Id=?"
+		args = append(args, f.ID)
+	}
+	if f.UsrID != "" {
+		where += " AND usrID=?"
+		args = append(args, f.UsrID)
+	}
+	if f.Project != "" {
+		where += " AND project=?"
+		args = append(args, f.Project)
+	}
+	if len(f.Statuses) > 0 {
+		where += " AND status IN (?" + strings.Repeat(",?", len(f.Statuses)-1) + ")"
+		for _, status := range f.Statuses {
+			args = append(args, status)
+		}
+	}
+	// Times are stored as local "2006-01-02 15:04:05" strings, which compare in time order
+	if !f.Since.IsZero() {
+		where += " AND starttime>=?"
+		args = append(args, f.Since.Format("2006-01-02 15:04:05"))
+	}
+	if !f.Until.IsZero() {
+		where += " AND starttime<?"
+		args = append(args, f.Until.Format("2006-01-02 15:04:05"))
+	}
+	if f.Module != "" {
+		where += " AND module GLOB ?"
+		args = append(args, f.Module)
+	}
+	if f.Mode != "" {
+		where += " AND mode=?"
+		args = append(args, f.Mode)
+	}
+	if f.Node != "" {
+		where += " AND node GLOB ?"
+		args = append(args, f.Node)
+	}
+	return where, args
+}
+
+// OrderBy returns the ORDER BY clause of f.Sort, or defaultOrder if no sort is set
+func (f RunFilter) OrderBy(defaultOrder string) (string, error) {
+	if f.Sort == "" {
+		return "ORDER BY " + defaultOrder, nil
+	}
+	field, direction, _ := strings.Cut(f.Sort, ":")
+	column, ok := runSortColumns[strings.ToLower(field)]
+	if !ok {
+		fields := make([]string, 0, len(runSortColumns))
+		for name := range runSortColumns {
+			fields = append(fields, name)
+		}
+		sort.Strings(fields)
+		return "", fmt.Errorf("invalid sort field: %s (available: %s)", field, strings.Join(fields, ","))
+	}
+	switch strings.ToLower(direction) {
+	case "", "asc":
+		return "ORDER BY " + column + " ASC, Id ASC", nil
+	case "desc":
+		return "ORDER BY " + column + " DESC, Id DESC", nil
+	}
+	return "", fmt.Errorf("invalid sort direction: %s (expected asc or desc)", direction)
+}
+
+// Clauses returns WHERE, ORDER BY and LIMIT clauses with their arguments
+func (f RunFilter) Clauses(defaultOrder string) (string, []interface{}, error) {
+	where, args := f.Where()
+	orderBy, err := f.OrderBy(defaultOrder)
+	if err != nil {
+		return "", nil, err
+	}
+	clauses := where + " " + orderBy
+	if f.Limit > 0 {
+		clauses += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	return clauses, args, nil
+}
+
+// queryRuns loads the runs selected by a filter, newest first unless the filter sets a sort order
+// Task counts are refreshed from local databases like loadRuns
+func queryRuns(globalDB *GlobalDB, filter RunFilter) ([]RunInfo, error) {
+	clauses, queryArgs, err := filter.Clauses("starttime DESC")
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT Id, runID, usrID, project, module, mode, status, starttime, endtime, shellPath, node, pid,
+			totalTasks, pendingTasks, runningTasks, failedTasks, finishedTasks, cpuHours, memHours, command, workdir, params
+		FROM tasks
+		` + clauses
+
+	rows, err := globalDB.Db.Query(query, queryArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tasks: %v", err)
+	}
+	defer rows.Close()
+
+	var runs []RunInfo
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range runs {
+		refreshRunCounts(&runs[i])
+	}
+	return runs, nil
+}
+
+// loadRun loads a single run by id, only if it belongs to usrID (any user if usrID is empty)
+func loadRun(globalDB *GlobalDB, usrID string, id int) (*RunInfo, error) {
+	rows, err := globalDB.Db.Query(`
+		SELECT Id, runID, usrID, project, module, mode, status, starttime, endtime, shellPath, node, pid,
+			totalTasks, pendingTasks, runningTasks, failedTasks, finishedTasks, cpuHours, memHours, command, workdir, params
+		FROM tasks
+		WHERE Id=? AND (?='' OR usrID=?)
+	`, id, usrID, usrID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query task: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, fmt.Errorf("task with ID %d not found or does not belong to user %s", id, usrID)
+	}
+	run, err := scanRun(rows)
+	if err != nil {
+		return nil, err
+	}
+	refreshRunCounts(&run)
+	return &run, nil
+}
+
+// scanRun scans a row selected by loadRuns/loadRun
+func scanRun(rows *sql.Rows) (RunInfo, error) {
+	var run RunInfo
+	var runID, status, endtime, node, command, workdir, params sql.NullString
+	var pid sql.NullInt64
+	var cpuHours, memHours sql.NullFloat64
+	err := rows.Scan(&run.ID, &runID, &run.UsrID, &run.Project, &run.Module, &run.Mode, &status, &run.StartTime, &endtime,
+		&run.ShellPath, &node, &pid, &run.Total, &run.Pending, &run.Running, &run.Failed, &run.Finished, &cpuHours, &memHours, &command, &workdir, &params)
+	if err != nil {
+		return run, fmt.Errorf("failed to scan task: %v", err)
+	}
+	run.RunID = runID.String
+	run.Status = status.String
+	run.StartTime = normalizeDBTime(run.StartTime)
+	run.EndTime = normalizeDBTime(endtime.String)
+	run.Node = node.String
+	run.PID = int(pid.Int64)
+	run.CPUHours = cpuHours.Float64
+	run.MemHours = memHours.Float64
+	run.Command = command.String
+	run.WorkDir = workdir.String
+	if params.String != "" {
+		run.Params = json.RawMessage(params.String)
+	}
+	return run, nil
+}
+
+// refreshRunCounts updates task counts of a run from its local database (kept unchanged on error)
+func refreshRunCounts(run *RunInfo) {
+	dbObj, err := openLocalDB(run.ShellPath)
+	if err != nil {
+		return
+	}
+	defer dbObj.Db.Close()
+	total, pending, failed, running, finished, err := GetTaskStats(dbObj)
+	if err != nil {
+		return
+	}
+	run.Total, run.Pending, run.Failed, run.Running, run.Finished = total, pending, failed, running, finished
+}
+
+// loadJobs loads all tasks of a run from its local database, ordered by task number
+func loadJobs(shellPath string) ([]JobInfo, error) {
+	dbObj, err := openLocalDB(shellPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dbObj.Db.Close()
+
+	rows, err := dbObj.Db.Query(`
+		SELECT subJob_num, shellPath, status, retry, exitCode, starttime, endtime, mode, taskid, node, reason, cpu, mem, h_vmem
+		FROM job
+		ORDER BY subJob_num
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query job table: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []JobInfo
+	for rows.Next() {
+		var job JobInfo
+		var status, starttime, endtime, mode, taskid, node, reason sql.NullString
+		var retry, exitCode, cpu sql.NullInt64
+		var mem, hvmem sql.NullFloat64
+		err := rows.Scan(&job.Num, &job.ShellPath, &status, &retry, &exitCode, &starttime, &endtime, &mode, &taskid, &node, &reason, &cpu, &mem, &hvmem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job: %v", err)
+		}
+		job.Status = status.String
+		job.Retry = int(retry.Int64)
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			job.ExitCode = &code
+		}
+		job.StartTime = normalizeDBTime(starttime.String)
+		job.EndTime = normalizeDBTime(endtime.String)
+		job.Mode = mode.String
+		job.TaskID = taskid.String
+		job.Node = node.String
+		job.Reason = reason.String
+		// cpu/mem/h_vmem are only written when submitting to SGE, local tasks keep the column defaults
+		job.CPU = 1
+		if job.Mode == string(ModeQsubSge) {
+			if cpu.Int64 > 0 {
+				job.CPU = int(cpu.Int64)
+			}
+			job.Mem = mem.Float64
+			job.HVmem = hvmem.Float64
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Elapsed returns the run time of a task (zero if it hasn't started)
+// Pending tasks keep times of earlier runs in the database, so they are not counted
+func (j *JobInfo) Elapsed() time.Duration {
+	if j.Status == string(J_pending) {
+		return 0
+	}
+	return elapsedSince(j.StartTime, j.EndTime)
+}
+
+// LogFiles returns the .o/.e files of the last attempt of the task
+func (j *JobInfo) LogFiles() (string, string) {
+	return taskLogFiles(j.ShellPath, j.Mode, j.TaskID)
+}
+
+// tailFile returns up to n last lines of a file, reading at most maxBytes from its end
+// Returns nil if the file doesn't exist
+func tailFile(path string, n int, maxBytes int64) []string {
+	if path == "" || n <= 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() > maxBytes {
+		f.Seek(info.Size()-maxBytes, io.SeekStart)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), int(maxBytes)+1)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
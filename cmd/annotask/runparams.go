@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RunParams are the parameters a run was started with, stored as JSON in the params column of the global database
+type RunParams struct {
+	Version  string `json:"version"`
+	Command  string `json:"command"`
+	Hostname string `json:"hostname"` // Node annotask runs on
+	Cwd      string `json:"cwd"`
+	Mode     string `json:"mode"`
+	Line     int    `json:"line"`
+	Thread   int    `json:"thread"`
+	// SGE resources, empty for local runs
+	CPU             int     `json:"cpu,omitempty"`
+	Mem             float64 `json:"mem,omitempty"`    // GB, only if set with --mem
+	HVmem           float64 `json:"h_vmem,omitempty"` // GB, only if set with --h_vmem
+	Queue           string  `json:"queue,omitempty"`
+	SgeProject      string  `json:"sgeProject,omitempty"`
+	ParallelEnvMode string  `json:"parallelEnvMode,omitempty"`
+	ExecHosts       string  `json:"execHosts,omitempty"` // --hostname
+	// Limits and failure budget
+	Timeout       string `json:"timeout,omitempty"`
+	MaxFailures   string `json:"maxFailures,omitempty"`
+	FailFast      bool   `json:"failFast,omitempty"`
+	CancelRunning bool   `json:"cancelRunning,omitempty"`
+	// Effective configuration (system, user and command-line notify settings merged)
+	Config map[string]interface{} `json:"config,omitempty"`
+}
+
+// configSnapshot returns the configuration as a map keyed like annotask.yaml
+// Webhook URLs are left out as they usually embed access tokens, profiles as only the selected one applies
+func configSnapshot(config *Config) (map[string]interface{}, error) {
+	snapshot := *config
+	snapshot.Notify.Webhooks = nil
+	snapshot.Profiles = nil // The values of the selected profile are in the run parameters
+	data, err := yaml.Marshal(&snapshot)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// encodeRunParams returns the parameters of a run as JSON for the global database
+func encodeRunParams(config *Config, opts runOptions) (string, error) {
+	params := RunParams{
+		Version:       Version,
+		Command:       opts.Command,
+		Mode:          string(opts.Mode),
+		Line:          opts.Line,
+		Thread:        opts.Thread,
+		MaxFailures:   opts.MaxFailures,
+		FailFast:      opts.FailFast,
+		CancelRunning: opts.CancelRunning,
+	}
+	params.Hostname, _ = os.Hostname()
+	params.Cwd, _ = os.Getwd()
+	if opts.Timeout > 0 {
+		params.Timeout = opts.Timeout.String()
+	}
+	if opts.Mode == ModeQsubSge {
+		params.CPU = opts.CPU
+		params.Queue = opts.Queue
+		params.SgeProject = opts.SgeProject
+		params.ParallelEnvMode = opts.ParallelEnvMode
+		params.ExecHosts = opts.Hostname
+		if opts.UserSetMem {
+			params.Mem = opts.Mem
+		}
+		if opts.UserSetHvmem {
+			params.HVmem = opts.HVmem
+		}
+	}
+	snapshot, err := configSnapshot(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to snapshot config: %v", err)
+	}
+	params.Config = snapshot
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// decodeRunParams parses the params column of a run, nil if it wasn't recorded
+func decodeRunParams(data []byte) *RunParams {
+	if len(data) == 0 {
+		return nil
+	}
+	var params RunParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil
+	}
+	return &params
+}
+
+// resourceSummary describes the resources of a run for the stat header
+func (p *RunParams) resourceSummary() string {
+	s := fmt.Sprintf("line %d  thread %d", p.Line, p.Thread)
+	if p.Mode == string(ModeQsubSge) {
+		s += fmt.Sprintf("  cpu %d", p.CPU)
+		if p.Mem > 0 {
+			s += "  mem " + formatMemoryGB(p.Mem)
+		}
+		if p.HVmem > 0 {
+			s += "  h_vmem " + formatMemoryGB(p.HVmem)
+		}
+		s += "  queue " + orDash(p.Queue)
+		if p.SgeProject != "" {
+			s += "  -P " + p.SgeProject
+		}
+	}
+	if p.Timeout != "" {
+		s += "  timeout " + p.Timeout
+	}
+	return s + "  annotask v" + p.Version
+}
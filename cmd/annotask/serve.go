@@ -0,0 +1,488 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+//go:embed serve.html
+var serveIndexHTML []byte
+
+// maxLogLines limits the number of log lines returned by the log API
+const maxLogLines = 5000
+
+// sgeJobIDPattern matches SGE job IDs in log file suffixes (.e123 or .e.123)
+var sgeJobIDPattern = regexp.MustCompile(`^\.?([0-9]+)$`)
+
+// dashboardServer serves the read-only web UI and JSON API
+type dashboardServer struct {
+	globalDB *GlobalDB
+	usrID    string // Only runs of this user are served, all users if empty
+}
+
+// ProjectSummary summarizes the runs of a project
+type ProjectSummary struct {
+	Project  string `json:"project"`
+	Runs     int    `json:"runs"`
+	Running  int    `json:"running"`
+	Failed   int    `json:"failed"`
+	LastRun  string `json:"lastRun"`
+	Users    int    `json:"users"`
+	Tasks    int    `json:"tasks"`
+	Finished int    `json:"finished"`
+}
+
+// TaskAttempt is one attempt of a task with its log files
+// For qsubsge mode each SGE job is an attempt, local mode appends all attempts to the same .o/.e files
+type TaskAttempt struct {
+	JobID   string `json:"jobid,omitempty"`
+	OutFile string `json:"out"`
+	ErrFile string `json:"err"`
+	Time    string `json:"time,omitempty"`
+}
+
+// RunTaskDetail is the response of the run detail API
+type RunTaskDetail struct {
+	Run   *RunInfo  `json:"run"`
+	Tasks []JobInfo `json:"tasks"`
+}
+
+// TaskDetail is the response of the task detail API
+type TaskDetail struct {
+	Run      *RunInfo      `json:"run"`
+	Task     JobInfo       `json:"task"`
+	Attempts []TaskAttempt `json:"attempts"`
+}
+
+// LogTail is the response of the log API
+type LogTail struct {
+	Path  string   `json:"path"`
+	Lines []string `json:"lines"`
+}
+
+// RunServeModule runs the serve module: a read-only web UI and JSON API over the local SQLite databases
+func RunServeModule(config *Config, args []string) {
+	parser := argparse.NewParser("annotask serve", "Serve a read-only web dashboard and JSON API")
+	opt_listen := parser.String("", "listen", &argparse.Options{Default: ":8080", Help: "Address to listen on"})
+	opt_all_users := parser.Flag("", "all-users", &argparse.Options{Help: "Serve runs of all users (admins only, default: only the current user)"})
+
+	parseArgs := append([]string{"annotask"}, args...)
+	if err := parser.Parse(parseArgs); err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "help") {
+			printModuleHelp("serve", config)
+			return
+		}
+		fmt.Print(parser.Usage(err))
+		os.Exit(1)
+	}
+
+	// Serving other users' runs is limited to admins of the system config, like stat --all-users
+	if *opt_all_users && !isAdmin(config, GetCurrentUserID()) {
+		log.Fatalf("Error: --all-users is only available to admins (set admins in annotask.yaml of the program directory)")
+	}
+
+	globalDB, err := InitGlobalDB(config.Db)
+	if err != nil {
+		log.Fatalf("Failed to initialize global DB: %v", err)
+	}
+	defer globalDB.Db.Close()
+
+	server := &dashboardServer{globalDB: globalDB}
+	if !*opt_all_users {
+		server.usrID = GetCurrentUserID()
+	}
+
+	httpServer := &http.Server{
+		Addr:              *opt_listen,
+		Handler:           server.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	scope := "user " + server.usrID
+	if server.usrID == "" {
+		scope = "all users"
+	}
+	log.Printf("Serving annotask dashboard for %s on http://%s", scope, displayAddr(*opt_listen))
+	if err := httpServer.ListenAndServe(); err != nil {
+		log.Fatalf("annotask serve failed: %v", err)
+	}
+}
+
+// displayAddr turns a listen address like ":8080" into a browsable address
+func displayAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		return hostname + addr
+	}
+	return addr
+}
+
+// routes registers the UI and API handlers
+func (s *dashboardServer) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /api/projects", s.handleProjects)
+	mux.HandleFunc("GET /api/runs", s.handleRuns)
+	mux.HandleFunc("GET /api/runs/{id}", s.handleRun)
+	mux.HandleFunc("GET /api/runs/{id}/tasks/{num}", s.handleTask)
+	mux.HandleFunc("GET /api/runs/{id}/tasks/{num}/log", s.handleTaskLog)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	return mux
+}
+
+// handleIndex serves the embedded single-page UI
+func (s *dashboardServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(serveIndexHTML)
+}
+
+// handleProjects returns a summary of each project
+func (s *dashboardServer) handleProjects(w http.ResponseWriter, r *http.Request) {
+	runs, err := loadRuns(s.globalDB, s.usrID, "")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	summaries := make(map[string]*ProjectSummary)
+	users := make(map[string]map[string]bool)
+	for _, run := range runs {
+		summary, ok := summaries[run.Project]
+		if !ok {
+			summary = &ProjectSummary{Project: run.Project}
+			summaries[run.Project] = summary
+			users[run.Project] = make(map[string]bool)
+		}
+		summary.Runs++
+		if run.Status == "running" {
+			summary.Running++
+		}
+		if run.Status == "failed" || run.Status == RunInterrupted {
+			summary.Failed++
+		}
+		if run.StartTime > summary.LastRun {
+			summary.LastRun = run.StartTime
+		}
+		summary.Tasks += run.Total
+		summary.Finished += run.Finished
+		users[run.Project][run.UsrID] = true
+	}
+
+	result := make([]ProjectSummary, 0, len(summaries))
+	for project, summary := range summaries {
+		summary.Users = len(users[project])
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LastRun > result[j].LastRun })
+	writeJSON(w, result)
+}
+
+// handleRuns returns runs, optionally filtered by ?project= and ?status=
+func (s *dashboardServer) handleRuns(w http.ResponseWriter, r *http.Request) {
+	runs, err := loadRuns(s.globalDB, s.usrID, r.URL.Query().Get("project"))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		var filtered []RunInfo
+		for _, run := range runs {
+			if run.Status == status {
+				filtered = append(filtered, run)
+			}
+		}
+		runs = filtered
+	}
+	if runs == nil {
+		runs = []RunInfo{}
+	}
+	writeJSON(w, runs)
+}
+
+// handleRun returns a run and its tasks
+func (s *dashboardServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.lookupRun(w, r)
+	if !ok {
+		return
+	}
+	jobs, err := loadJobs(run.ShellPath)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if jobs == nil {
+		jobs = []JobInfo{}
+	}
+	writeJSON(w, RunTaskDetail{Run: run, Tasks: jobs})
+}
+
+// handleTask returns a task and its attempts
+func (s *dashboardServer) handleTask(w http.ResponseWriter, r *http.Request) {
+	run, job, ok := s.lookupTask(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, TaskDetail{Run: run, Task: *job, Attempts: taskAttempts(job)})
+}
+
+// handleTaskLog returns the tail of a task's .o or .e file
+// Query parameters: stream (o or e, default e), attempt (SGE job ID, default last attempt), lines (default 200)
+func (s *dashboardServer) handleTaskLog(w http.ResponseWriter, r *http.Request) {
+	_, job, ok := s.lookupTask(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	stream := query.Get("stream")
+	if stream == "" {
+		stream = "e"
+	}
+	if stream != "o" && stream != "e" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid stream: %s (expected o or e)", stream))
+		return
+	}
+	lines := 200
+	if value := query.Get("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid lines: %s", value))
+			return
+		}
+		lines = n
+	}
+	if lines > maxLogLines {
+		lines = maxLogLines
+	}
+
+	// Only log files of the task itself can be read: the attempt is matched against the task's attempts
+	attempts := taskAttempts(job)
+	if len(attempts) == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no log files for task %d", job.Num))
+		return
+	}
+	attempt := attempts[len(attempts)-1]
+	if jobID := query.Get("attempt"); jobID != "" {
+		found := false
+		for _, a := range attempts {
+			if a.JobID == jobID {
+				attempt, found = a, true
+				break
+			}
+		}
+		if !found {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("attempt %s not found for task %d", jobID, job.Num))
+			return
+		}
+	}
+
+	path := attempt.ErrFile
+	if stream == "o" {
+		path = attempt.OutFile
+	}
+	tail := tailFile(path, lines, 1024*1024)
+	if tail == nil {
+		tail = []string{}
+	}
+	writeJSON(w, LogTail{Path: path, Lines: tail})
+}
+
+// handleMetrics serves Prometheus metrics: number of runs by status, and task gauges and durations
+// of the latest run of each module
+// Submission, retry, escalation and DRMAA error counters are only known to the running
+// annotask process, see --metrics-listen
+func (s *dashboardServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	runs, err := loadRuns(s.globalDB, s.usrID, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type runKey struct{ user, project, status string }
+	runCounts := make(map[runKey]int)
+	var runKeys []runKey
+	type moduleKey struct{ user, project, module string }
+	latest := make(map[moduleKey]bool)
+	var latestRuns []RunInfo
+	for _, run := range runs {
+		key := runKey{run.UsrID, run.Project, run.Status}
+		if _, ok := runCounts[key]; !ok {
+			runKeys = append(runKeys, key)
+		}
+		runCounts[key]++
+		// Runs are ordered newest first
+		if mk := (moduleKey{run.UsrID, run.Project, run.Module}); !latest[mk] {
+			latest[mk] = true
+			latestRuns = append(latestRuns, run)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := newMetricsWriter(w)
+	mw.header("annotask_runs", "gauge", "Number of runs by status")
+	for _, key := range runKeys {
+		mw.sample("annotask_runs", []string{"user", key.user, "project", key.project, "status", key.status}, float64(runCounts[key]))
+	}
+
+	counts := make([]taskCounts, 0, len(latestRuns))
+	for _, run := range latestRuns {
+		labels := []string{"user", run.UsrID, "project", run.Project, "module", run.Module}
+		counts = append(counts, taskCounts{labels, run.Total, run.Pending, run.Running, run.Failed, run.Finished})
+	}
+	writeTaskGauges(mw, counts)
+
+	writeDurationHeader(mw)
+	for i, run := range latestRuns {
+		jobs, err := loadJobs(run.ShellPath)
+		if err != nil {
+			continue
+		}
+		histograms := map[string]*durationHistogram{}
+		for _, job := range jobs {
+			result := ""
+			switch job.Status {
+			case string(J_finished):
+				result = "finished"
+			case string(J_failed):
+				result = "failed"
+			}
+			if result == "" || job.EndTime == "" {
+				continue
+			}
+			if histograms[result] == nil {
+				histograms[result] = newDurationHistogram()
+			}
+			histograms[result].observe(job.Elapsed().Seconds())
+		}
+		for _, result := range []string{"finished", "failed"} {
+			if h, ok := histograms[result]; ok {
+				writeDurationHistogram(mw, withLabels(counts[i].labels, "result", result), h)
+			}
+		}
+	}
+}
+
+// lookupRun loads the run named by the {id} path value, writing an error response if it fails
+func (s *dashboardServer) lookupRun(w http.ResponseWriter, r *http.Request) (*RunInfo, bool) {
+	// {id} is the Id or the run ID of the run
+	id, err := resolveRunRef(s.globalDB, s.usrID, r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return nil, false
+	}
+	run, err := loadRun(s.globalDB, s.usrID, id)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return nil, false
+	}
+	return run, true
+}
+
+// lookupTask loads the run and task named by the {id} and {num} path values
+func (s *dashboardServer) lookupTask(w http.ResponseWriter, r *http.Request) (*RunInfo, *JobInfo, bool) {
+	run, ok := s.lookupRun(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	num, err := strconv.Atoi(r.PathValue("num"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid task number: %s", r.PathValue("num")))
+		return nil, nil, false
+	}
+	jobs, err := loadJobs(run.ShellPath)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return nil, nil, false
+	}
+	for i := range jobs {
+		if jobs[i].Num == num {
+			return run, &jobs[i], true
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, fmt.Errorf("task %d not found in run %d", num, run.ID))
+	return nil, nil, false
+}
+
+// taskAttempts lists the attempts of a task, oldest first
+// For qsubsge mode SGE writes one .o/.e pair per job ({script}.e{jobID} or {script}.e.{jobID})
+func taskAttempts(job *JobInfo) []TaskAttempt {
+	if job.Mode != string(ModeQsubSge) {
+		outFile, errFile := job.LogFiles()
+		attempt := TaskAttempt{OutFile: outFile, ErrFile: errFile}
+		if info, err := os.Stat(errFile); err == nil {
+			attempt.Time = info.ModTime().Format("2006-01-02 15:04:05")
+		}
+		return []TaskAttempt{attempt}
+	}
+
+	matches, _ := filepath.Glob(job.ShellPath + ".e*")
+	type attemptFile struct {
+		attempt TaskAttempt
+		modTime time.Time
+	}
+	var files []attemptFile
+	for _, match := range matches {
+		m := sgeJobIDPattern.FindStringSubmatch(strings.TrimPrefix(match, job.ShellPath+".e"))
+		if m == nil {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		jobID := m[1]
+		files = append(files, attemptFile{
+			attempt: TaskAttempt{
+				JobID:   jobID,
+				OutFile: findSGELogFile(job.ShellPath, "o", jobID),
+				ErrFile: match,
+				Time:    info.ModTime().Format("2006-01-02 15:04:05"),
+			},
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	attempts := make([]TaskAttempt, 0, len(files))
+	for _, f := range files {
+		attempts = append(attempts, f.attempt)
+	}
+	// The current SGE job may not have written its log files yet
+	if job.TaskID != "" && (len(attempts) == 0 || attempts[len(attempts)-1].JobID != job.TaskID) {
+		outFile, errFile := job.LogFiles()
+		attempts = append(attempts, TaskAttempt{JobID: job.TaskID, OutFile: outFile, ErrFile: errFile})
+	}
+	return attempts
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("Warning: Failed to write response: %v", err)
+	}
+}
+
+// writeJSONError writes an error as a JSON response
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
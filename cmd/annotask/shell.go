@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,7 +13,8 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func GenerateShell(shellPath, content string) {
+// GenerateShell writes the sub-shell script of task N, running its pre hook (if any) before the command
+func GenerateShell(shellPath, content string, N int, pre string) {
 	fi, err := os.Create(shellPath)
 	if err != nil {
 		panic(err)
@@ -20,7 +22,7 @@ func GenerateShell(shellPath, content string) {
 	defer fi.Close()
 
 	content = strings.TrimRight(content, "\n")
-	content = fmt.Sprintf("#!/bin/bash\necho ========== start at : $(date +\"%%Y/%%m/%%d %%H:%%M:%%S\") ==========\n%s", content)
+	content = fmt.Sprintf("#!/bin/bash\necho ========== start at : $(date +\"%%Y/%%m/%%d %%H:%%M:%%S\") ==========\n%s%s", preHookScript(shellPath, N, pre), content)
 	content = fmt.Sprintf("%s && \\\necho ========== end at : $(date +\"%%Y/%%m/%%d %%H:%%M:%%S\") ========== && \\\n", content)
 	content = fmt.Sprintf("%secho LLAP 1>&2 && \\\necho LLAP > %s.sign\n", content, shellPath)
 
@@ -43,7 +45,10 @@ func getFilePrefix(filePath string) string {
 	return base
 }
 
-func Creat_tb(shell_path string, line_unit int, mode JobMode) (dbObj *MySql) {
+// Creat_tb creates the local database and sub-shell scripts for an input file
+// Inputs/outputs declared in manifest (may be nil) are added to the directives of each task
+// hooks (from config) apply to tasks that don't set their own in the input file or manifest
+func Creat_tb(shell_path string, line_unit int, mode JobMode, manifest Manifest, hooks TaskHooks) (dbObj *MySql) {
 	shellAbsName, _ := filepath.Abs(shell_path)
 	dbpath := shellAbsName + ".db"
 	subShellPath := shellAbsName + ".shell"
@@ -65,66 +70,123 @@ func Creat_tb(shell_path string, line_unit int, mode JobMode) (dbObj *MySql) {
 
 	tx, _ := dbObj.Db.Begin()
 	defer tx.Rollback()
-	insert_job, err := tx.Prepare("INSERT INTO job(subJob_num, shellPath, status, retry, mode) values(?,?,?,?,?)")
+	insert_job, err := tx.Prepare("INSERT INTO job(subJob_num, shellPath, status, retry, mode, directives, cmdHash) values(?,?,?,?,?,?,?)")
 	CheckErr(err)
+	// Directives and command hash are refreshed for existing tasks so edits in the input file take effect on rerun
+	update_directives, err := tx.Prepare("UPDATE job SET directives=?, cmdHash=? WHERE subJob_num=?")
+	CheckErr(err)
+
+	// addTask generates the sub-shell script and job record for task N if it doesn't exist yet
+	// If the command of an existing task changed, its script is regenerated and its .sign file removed
+	// If only its pre hook changed, the script is regenerated but the task is not rerun
+	addTask := func(N int, cmd_l string, directives *TaskDirectives) {
+		if entry, ok := manifest[N]; ok {
+			directives.ApplyManifest(entry)
+		}
+		directives.DefaultHooks(hooks)
+		pre := directives.hooks().Pre
+		cmd_l = strings.TrimRight(cmd_l, "\n")
+		hash := commandHash(cmd_l)
+
+		var subShell string
+		var oldHash, oldDirectives sql.NullString
+		err := tx.QueryRow("select shellPath, cmdHash, directives from job where subJob_num = ?", N).Scan(&subShell, &oldHash, &oldDirectives)
+		if err == sql.ErrNoRows {
+			subShell = fmt.Sprintf("%s/%s_%04d.sh", subShellPath, filePrefix, N)
+			GenerateShell(subShell, cmd_l, N, pre)
+			_, _ = insert_job.Exec(N, subShell, J_pending, 0, string(mode), encodeDirectives(directives), hash)
+			return
+		}
+		CheckErr(err)
+		oldTaskDirectives := decodeDirectives(oldDirectives.String)
+		if commandChanged(oldHash.String, hash) {
+			log.Printf("Task %d command changed, regenerating %s", N, subShell)
+			GenerateShell(subShell, cmd_l, N, pre)
+			removeSignFile(subShell)
+		} else if oldTaskDirectives.hooks().Pre != pre {
+			GenerateShell(subShell, cmd_l, N, pre)
+		}
+		_, err = update_directives.Exec(encodeDirectives(directives), hash, N)
+		CheckErr(err)
+	}
 
 	f, err := os.Open(shellAbsName)
 	if err != nil {
 		panic(err)
 	}
 	defer f.Close()
-	buf := bufio.NewReader(f)
+	err = readInputTasks(f, line_unit, func(task InputTask) {
+		addTask(task.N, task.Command, task.Directives)
+	})
+	if err != nil {
+		log.Fatalf("Error in %s: %v", shellAbsName, err)
+	}
+
+	err = tx.Commit()
+	CheckErr(err)
+	return
+}
+
+// InputTask is a task of an input file: line_unit command lines and the directives applying to them
+type InputTask struct {
+	N          int
+	FirstLine  int // Line numbers in the input file, directive lines included
+	LastLine   int
+	Command    string
+	Directives *TaskDirectives
+}
 
+// readInputTasks splits an input file into tasks of line_unit command lines and calls fn for each task in order
+// Directive lines (#@annotask key=value) are not counted as command lines,
+// they apply to the task containing the next command line
+func readInputTasks(r io.Reader, line_unit int, fn func(task InputTask)) error {
+	buf := bufio.NewReader(r)
+	var task InputTask
 	ii := 0
-	var cmd_l string = ""
-	N := 0
+	lineNum := 0
+	var pendingDirectives []string
+	applyDirectives := func(target *TaskDirectives) error {
+		for _, directiveLine := range pendingDirectives {
+			if err := target.Apply(directiveLine); err != nil {
+				return err
+			}
+		}
+		pendingDirectives = nil
+		return nil
+	}
 	for {
 		line, err := buf.ReadString('\n')
 		if err != nil || err == io.EOF {
 			break
 		}
+		lineNum++
 
-		if ii == 0 {
-			cmd_l = line
-			ii++
-		} else if ii < line_unit {
-			cmd_l = cmd_l + line
-			ii++
-		} else {
-			N++
-			Nrows, err := tx.Query("select Id from job where subJob_num = ?", N)
-			if err != nil {
-				CheckErr(err)
-			}
-			defer Nrows.Close()
-			if CheckCount(Nrows) == 0 {
-				cmd_l = strings.TrimRight(cmd_l, "\n")
-				subShell := fmt.Sprintf("%s/%s_%04d.sh", subShellPath, filePrefix, N)
-				GenerateShell(subShell, cmd_l)
-				_, _ = insert_job.Exec(N, subShell, J_pending, 0, string(mode))
-			}
+		if isDirectiveLine(line) {
+			pendingDirectives = append(pendingDirectives, line)
+			continue
+		}
 
-			ii = 1
-			cmd_l = line
+		if ii == line_unit {
+			fn(task)
+			ii = 0
 		}
+		if ii == 0 {
+			task = InputTask{N: task.N + 1, FirstLine: lineNum, Directives: &TaskDirectives{}}
+		}
+		task.Command += line
+		task.LastLine = lineNum
+		if err := applyDirectives(task.Directives); err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		ii++
 	}
 
 	if ii > 0 {
-		N++
-		Nrows, err := tx.Query("select Id from job where subJob_num = ?", N)
-		if err != nil {
-			CheckErr(err)
-		}
-		defer Nrows.Close()
-		if CheckCount(Nrows) == 0 {
-			cmd_l = strings.TrimRight(cmd_l, "\n")
-			subShell := fmt.Sprintf("%s/%s_%04d.sh", subShellPath, filePrefix, N)
-			GenerateShell(subShell, cmd_l)
-			_, _ = insert_job.Exec(N, subShell, J_pending, 0, string(mode))
+		// Trailing directives at the end of file apply to the last task
+		if err := applyDirectives(task.Directives); err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
 		}
+		fn(task)
 	}
-
-	err = tx.Commit()
-	CheckErr(err)
-	return
+	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,38 +13,172 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// StatOptions holds the options of the stat command
+type StatOptions struct {
+	Filter RunFilter // Selects runs: user, project, status, time range, module, mode, node, sort and limit
+	Format string    // table, json, csv or tsv
+	Fields string    // Comma-separated fields, empty for the default layout (table) or all fields
+	Usage  bool      // Show per-user and per-project aggregates of the selected runs instead of the runs (--usage)
+}
+
+// TaskStatOptions holds the options of stat -k <id> --tasks
+type TaskStatOptions struct {
+	Statuses []string // Only tasks with any of these statuses, all tasks if empty
+	Format   string   // table, json, csv or tsv
+	Fields   string   // Comma-separated fields, empty for the default layout (table) or all fields
+}
+
+// RunStatTasks lists the tasks of one run from its local database
+// The table ends with the .e files of failed tasks
+func RunStatTasks(globalDB *GlobalDB, usrID string, id int, opts TaskStatOptions) error {
+	run, err := loadRun(globalDB, usrID, id)
+	if err != nil {
+		return err
+	}
+	allJobs, err := loadJobs(run.ShellPath)
+	if err != nil {
+		return err
+	}
+	var jobs []JobInfo
+	for _, job := range allJobs {
+		if len(opts.Statuses) == 0 || containsString(opts.Statuses, job.Status) {
+			jobs = append(jobs, job)
+		}
+	}
+
+	if opts.Format != FormatTable || opts.Fields != "" {
+		fields, err := selectFields(jobFields, opts.Fields)
+		if err != nil {
+			return err
+		}
+		return writeRows(os.Stdout, jobs, fields, opts.Format)
+	}
+
+	fmt.Printf("run %d (%s)  %s/%s  mode %s  status %s  %d/%d finished  pending %d  running %d  failed %d\n",
+		run.ID, orDash(run.RunID), run.Project, run.Module, run.Mode, run.Status, run.Finished, run.Total, run.Pending, run.Running, run.Failed)
+	fmt.Printf("%s\n", run.ShellPath)
+	if run.Command != "" {
+		fmt.Printf("command: %s\n", run.Command)
+	}
+	if params := decodeRunParams(run.Params); params != nil {
+		fmt.Printf("resources: %s\n", params.resourceSummary())
+	}
+	fmt.Println()
+	fmt.Printf("%-6s %-9s %-6s %-12s %-16s %-5s %-12s %-12s %-10s %-8s %s\n",
+		"task", "status", "retry", "taskid", "node", "exit", "stime", "etime", "duration", "mem", "reason")
+
+	var failedLogs []string
+	for i := range jobs {
+		job := &jobs[i]
+		taskID := "-"
+		if job.TaskID != "" {
+			taskID = job.TaskID
+		}
+		// Local tasks run on the node annotask runs on
+		node := job.Node
+		if node == "" {
+			node = run.Node
+		}
+		if node == "" {
+			node = "-"
+		}
+		exitCode := "-"
+		if code := jobExitCode(job); code != nil {
+			exitCode = fmt.Sprint(code)
+		}
+		stime, etime, duration := "-", "-", "-"
+		if job.Status != string(J_pending) {
+			stime = formatTimeShort(job.StartTime)
+			if job.Status != string(J_running) {
+				etime = formatTimeShort(job.EndTime)
+			}
+		}
+		if d := job.Elapsed(); d > 0 {
+			duration = formatHRT(d)
+		}
+		mem := "-"
+		if job.Mem > 0 {
+			mem = formatMemoryGB(job.Mem)
+		}
+		fmt.Printf("%-6d %-9s %-6d %-12s %-16s %-5s %-12s %-12s %-10s %-8s %s\n",
+			job.Num, job.Status, job.Retry, taskID, node, exitCode, stime, etime, duration, mem, job.Reason)
+
+		if job.Status == string(J_failed) {
+			if _, errFile := job.LogFiles(); errFile != "" {
+				failedLogs = append(failedLogs, errFile)
+			}
+		}
+	}
+	if len(jobs) == 0 {
+		fmt.Println("No tasks found")
+	}
+
+	if len(failedLogs) > 0 {
+		fmt.Println()
+		for _, errFile := range failedLogs {
+			fmt.Println(errFile)
+		}
+	}
+	return nil
+}
+
+// parseJobStatus returns the task status (as stored in the job table) matching s case-insensitively
+func parseJobStatus(s string) (string, bool) {
+	for _, status := range []jobStatusType{J_pending, J_running, J_failed, J_finished} {
+		if strings.EqualFold(s, string(status)) {
+			return string(status), true
+		}
+	}
+	return "", false
+}
+
+// containsString checks if list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // RunStatCommand runs the stat subcommand
-func RunStatCommand(globalDB *GlobalDB, projectFilter string, config *Config) error {
-	usrID := GetCurrentUserID()
+func RunStatCommand(globalDB *GlobalDB, opts StatOptions, config *Config) error {
+	projectFilter := opts.Filter.Project
+
+	// Mark runs whose annotask process died on this node as interrupted
+	// Runs on other nodes are only checked by annotask reconcile, which uses SSH
+	// Only runs of the current user are checked, local databases of other users may not be writable
+	reconcileFilter := opts.Filter
+	reconcileFilter.UsrID = GetCurrentUserID()
+	if opts.Filter.UsrID == "" || opts.Filter.UsrID == reconcileFilter.UsrID {
+		reconcileRuns(globalDB, reconcileFilter, ReconcileOptions{NoSSH: true, Quiet: true})
+	}
 
 	// First, query all tasks to update them before displaying
 	var updateRows *sql.Rows
 	var err error
 
-	if projectFilter != "" {
-		updateRows, err = globalDB.Db.Query(`
-			SELECT shellPath, mode, project, module, starttime
-			FROM tasks
-			WHERE usrID=? AND project=?
-		`, usrID, projectFilter)
-	} else {
-		updateRows, err = globalDB.Db.Query(`
-			SELECT shellPath, mode, project, module, starttime
-			FROM tasks
-			WHERE usrID=?
-		`, usrID)
-	}
+	where, whereArgs := opts.Filter.Where()
+	updateRows, err = globalDB.Db.Query(`
+		SELECT runID, shellPath, mode, project, module, starttime, usrID
+		FROM tasks
+		`+where, whereArgs...)
 
 	if err == nil {
 		defer updateRows.Close()
 		// Update each task's status from local database
 		for updateRows.Next() {
-			var shellPath, mode, project, module, starttime string
-			err := updateRows.Scan(&shellPath, &mode, &project, &module, &starttime)
+			var runID sql.NullString
+			var shellPath, mode, project, module, starttime, usrID string
+			err := updateRows.Scan(&runID, &shellPath, &mode, &project, &module, &starttime, &usrID)
 			if err != nil {
 				log.Printf("Warning: Failed to scan task for update: %v", err)
 				continue
 			}
+			if !runID.Valid {
+				continue
+			}
 
 			// Parse starttime (support multiple formats: "2006-01-02 15:04:05" and ISO 8601 formats)
 			var startTime time.Time
@@ -68,51 +203,43 @@ func RunStatCommand(globalDB *GlobalDB, projectFilter string, config *Config) er
 			}
 
 			// Open local database
-			dbPath := shellPath + ".db"
-			conn, err := sql.Open("sqlite3", dbPath)
+			dbObj, err := openLocalDB(shellPath)
 			if err != nil {
 				// Local database doesn't exist or can't be opened, skip
 				continue
 			}
 
-			dbObj := &MySql{Db: conn}
 			// Get task statistics from local database
 			total, pending, failed, running, finished, err := GetTaskStats(dbObj)
-			conn.Close()
+			dbObj.Db.Close()
 
 			if err != nil {
 				log.Printf("Warning: Failed to get task stats for %s: %v", shellPath, err)
 				continue
 			}
 
-			// Get node name
-			// For local mode: get current hostname
-			// For qsubsge mode: get from database (submission node)
+			// Get node name from database (the node annotask ran on, the submission node for qsubsge mode)
+			// For local mode records without a node, fall back to current hostname
 			node := "-"
-			if mode == "local" {
+			var nodeValue sql.NullString
+			err = globalDB.Db.QueryRow(`
+				SELECT node FROM tasks WHERE runID=?
+			`, runID.String).Scan(&nodeValue)
+			if err == nil && nodeValue.Valid && nodeValue.String != "" {
+				node = nodeValue.String
+			} else if mode == "local" {
 				hostname, err := os.Hostname()
 				if err == nil {
 					node = hostname
 				}
-			} else if mode == "qsubsge" {
-				// For qsubsge mode, node is stored in database (submission node)
-				var nodeValue sql.NullString
-				err = globalDB.Db.QueryRow(`
-					SELECT node FROM tasks 
-					WHERE usrID=? AND project=? AND module=? AND starttime=?
-				`, usrID, project, module, starttime).Scan(&nodeValue)
-				if err == nil && nodeValue.Valid && nodeValue.String != "" {
-					node = nodeValue.String
-				}
 			}
 
 			// Get PID if process is still running (try to get from global DB first)
 			var pid int
 			var pidValue sql.NullInt64
 			err = globalDB.Db.QueryRow(`
-				SELECT pid FROM tasks 
-				WHERE usrID=? AND project=? AND module=? AND starttime=?
-			`, usrID, project, module, starttime).Scan(&pidValue)
+				SELECT pid FROM tasks WHERE runID=?
+			`, runID.String).Scan(&pidValue)
 			if err == nil && pidValue.Valid {
 				pid = int(pidValue.Int64)
 			} else {
@@ -121,7 +248,7 @@ func RunStatCommand(globalDB *GlobalDB, projectFilter string, config *Config) er
 			}
 
 			// Update global database
-			err = UpdateGlobalTaskRecord(globalDB, usrID, project, module, mode, shellPath, startTime, total, pending, failed, running, finished, node, pid)
+			err = UpdateGlobalTaskRecord(globalDB, runID.String, usrID, project, module, mode, shellPath, startTime, total, pending, failed, running, finished, node, pid)
 			if err != nil {
 				log.Printf("Warning: Failed to update task record for %s: %v", shellPath, err)
 			}
@@ -129,16 +256,54 @@ func RunStatCommand(globalDB *GlobalDB, projectFilter string, config *Config) er
 		updateRows.Close()
 	}
 
+	// Aggregates per user and per project (--usage)
+	if opts.Usage {
+		runs, err := queryRuns(globalDB, opts.Filter)
+		if err != nil {
+			return err
+		}
+		byUser, byProject := summarizeUsage(runs)
+		if opts.Format != FormatTable || opts.Fields != "" {
+			fields, err := selectFields(usageFields, opts.Fields)
+			if err != nil {
+				return err
+			}
+			// Totals per user first (project is null), then the per-project breakdown
+			return writeRows(os.Stdout, append(byUser, byProject...), fields, opts.Format)
+		}
+		if len(runs) == 0 {
+			fmt.Println("No runs found")
+			return nil
+		}
+		writeUsageTable(os.Stdout, byUser, byProject)
+		return nil
+	}
+
+	// Machine-readable formats and --fields list every run with the selected fields
+	if opts.Format != FormatTable || opts.Fields != "" {
+		fields, err := selectFields(runFields, opts.Fields)
+		if err != nil {
+			return err
+		}
+		runs, err := queryRuns(globalDB, opts.Filter)
+		if err != nil {
+			return err
+		}
+		return writeRows(os.Stdout, runs, fields, opts.Format)
+	}
+
 	var rows *sql.Rows
 
 	if projectFilter != "" {
 		// When -p is used, show different format: id module pending running failed finished stime etime
+		clauses, clauseArgs, err := opts.Filter.Clauses("starttime DESC")
+		if err != nil {
+			return err
+		}
 		rows, err = globalDB.Db.Query(`
 			SELECT Id, module, pendingTasks, runningTasks, failedTasks, finishedTasks, starttime, endtime, shellPath
 			FROM tasks
-			WHERE usrID=? AND project=?
-			ORDER BY starttime DESC
-		`, usrID, projectFilter)
+			`+clauses, clauseArgs...)
 		if err != nil {
 			return fmt.Errorf("failed to query tasks: %v", err)
 		}
@@ -191,12 +356,14 @@ func RunStatCommand(globalDB *GlobalDB, projectFilter string, config *Config) er
 		}
 	} else {
 		// When no -p, show: project module mode status statis stime etime
+		clauses, clauseArgs, err := opts.Filter.Clauses("project, starttime DESC")
+		if err != nil {
+			return err
+		}
 		rows, err = globalDB.Db.Query(`
 			SELECT project, module, mode, status, totalTasks, finishedTasks, starttime, endtime
 			FROM tasks
-			WHERE usrID=?
-			ORDER BY project, starttime DESC
-		`, usrID)
+			`+clauses, clauseArgs...)
 		if err != nil {
 			return fmt.Errorf("failed to query tasks: %v", err)
 		}
@@ -204,7 +371,7 @@ func RunStatCommand(globalDB *GlobalDB, projectFilter string, config *Config) er
 
 		// Output format: project module mode status statis stime etime
 		// statis format: finishedTasks/totalTasks (已完成数/总任务数)
-		fmt.Printf("%-28s %-20s %-10s %-10s %-15s %-12s %-12s\n",
+		fmt.Printf("%-28s %-20s %-10s %-12s %-15s %-12s %-12s\n",
 			"project", "module", "mode", "status", "statis", "stime", "etime")
 
 		var count int
@@ -236,7 +403,7 @@ func RunStatCommand(globalDB *GlobalDB, projectFilter string, config *Config) er
 				etimeStr = formatTimeShort(endtime.String)
 			}
 
-			fmt.Printf("%-28s %-20s %-10s %-10s %-15s %-12s %-12s\n",
+			fmt.Printf("%-28s %-20s %-10s %-12s %-15s %-12s %-12s\n",
 				project, module, mode, statusStr, statisStr, stimeStr, etimeStr)
 			count++
 		}
@@ -257,6 +424,22 @@ func RunStatModule(config *Config, args []string) {
 	// Parse stat command arguments
 	statParser := argparse.NewParser("annotask stat", "Query task status from global database")
 	opt_project := statParser.String("p", "project", &argparse.Options{Help: "Filter by project name"})
+	opt_format := statParser.String("", "format", &argparse.Options{Default: FormatTable, Help: "Output format: table, json, csv or tsv"})
+	opt_fields := statParser.String("", "fields", &argparse.Options{Help: "Comma-separated fields to output, e.g. id,module,status,failed"})
+	opt_status := statParser.String("", "status", &argparse.Options{Help: "Filter by run status: running, completed, failed, interrupted (comma-separated)"})
+	opt_since := statParser.String("", "since", &argparse.Options{Help: "Only runs started at or after this time: 2024-12-01, '2024-12-01 08:00', or 7d/12h/30m ago"})
+	opt_until := statParser.String("", "until", &argparse.Options{Help: "Only runs started before this time (a date alone includes that day)"})
+	opt_module := statParser.String("", "module", &argparse.Options{Help: "Filter by module name glob, e.g. 'align*'"})
+	opt_mode := statParser.String("", "mode", &argparse.Options{Help: "Filter by mode: local or qsubsge"})
+	opt_node := statParser.String("", "node", &argparse.Options{Help: "Filter by node (glob) annotask ran on"})
+	opt_user := statParser.String("", "user", &argparse.Options{Help: "Show runs of this user instead of the current user (admins only for other users)"})
+	opt_all_users := statParser.Flag("", "all-users", &argparse.Options{Help: "Show runs of all users (admins only)"})
+	opt_usage := statParser.Flag("", "usage", &argparse.Options{Help: "Show per-user and per-project aggregates of the selected runs instead of the runs"})
+	opt_sort := statParser.String("", "sort", &argparse.Options{Help: "Sort by field[:asc|desc], e.g. starttime:desc, failed:desc, elapsed"})
+	opt_limit := statParser.Int("", "limit", &argparse.Options{Help: "Show at most N runs"})
+	opt_id := statParser.String("k", "id", &argparse.Options{Help: "Only show the run with this ID or run ID (or a unique prefix of it)"})
+	opt_tasks := statParser.Flag("", "tasks", &argparse.Options{Help: "List the tasks of the run given by -k/--id"})
+	opt_failed := statParser.Flag("", "failed", &argparse.Options{Help: "With --tasks, only list failed tasks (same as --status failed)"})
 
 	// Prepend program name for argparse.Parse (it expects os.Args-like format)
 	parseArgs := append([]string{"annotask"}, args...)
@@ -276,9 +459,149 @@ func RunStatModule(config *Config, args []string) {
 	if opt_project != nil && *opt_project != "" {
 		projectFilter = *opt_project
 	}
+	if err := validateFormat(*opt_format); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// Viewing other users' runs is limited to admins of the system config
+	currentUser := GetCurrentUserID()
+	usrID := currentUser
+	if *opt_all_users || (*opt_user != "" && *opt_user != currentUser) {
+		if !isAdmin(config, currentUser) {
+			log.Fatalf("Error: --all-users and --user of another user are only available to admins (set admins in annotask.yaml of the program directory)")
+		}
+		usrID = *opt_user
+		if *opt_all_users {
+			usrID = ""
+		}
+	}
+	usage := *opt_usage
+
+	runID := 0
+	if *opt_id != "" {
+		if runID, err = resolveRunRef(globalDB, usrID, *opt_id); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
 
-	err = RunStatCommand(globalDB, projectFilter, config)
+	// Drill down into the tasks of one run
+	if *opt_tasks || *opt_failed {
+		if runID <= 0 {
+			log.Fatalf("Error: --tasks requires -k/--id <id> (run IDs are shown by annotask stat -p <project>)")
+		}
+		if _, err := selectFields(jobFields, *opt_fields); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		taskOpts := TaskStatOptions{Format: *opt_format, Fields: *opt_fields}
+		for _, status := range splitList(*opt_status) {
+			jobStatus, ok := parseJobStatus(status)
+			if !ok {
+				log.Fatalf("Error: invalid --status value for --tasks: %s (expected pending, running, failed or finished)", status)
+			}
+			taskOpts.Statuses = append(taskOpts.Statuses, jobStatus)
+		}
+		if *opt_failed {
+			taskOpts.Statuses = append(taskOpts.Statuses, string(J_failed))
+		}
+		if err := RunStatTasks(globalDB, usrID, runID, taskOpts); err != nil {
+			log.Fatalf("Stat command failed: %v", err)
+		}
+		return
+	}
+
+	if usage && runID == 0 {
+		_, err = selectFields(usageFields, *opt_fields)
+	} else {
+		_, err = selectFields(runFields, *opt_fields)
+	}
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	filter := RunFilter{
+		ID:      runID,
+		UsrID:   usrID,
+		Project: projectFilter,
+		Module:  *opt_module,
+		Node:    *opt_node,
+		Sort:    *opt_sort,
+		Limit:   *opt_limit,
+	}
+	for _, status := range splitList(*opt_status) {
+		status = strings.ToLower(status)
+		if !isRunStatus(status) {
+			log.Fatalf("Error: invalid --status value: %s (expected running, completed, failed or interrupted)", status)
+		}
+		filter.Statuses = append(filter.Statuses, status)
+	}
+	if *opt_mode != "" {
+		if *opt_mode != string(ModeLocal) && *opt_mode != string(ModeQsubSge) {
+			log.Fatalf("Error: invalid --mode value: %s (expected local or qsubsge)", *opt_mode)
+		}
+		filter.Mode = *opt_mode
+	}
+	if filter.Since, err = parseTimeArg(*opt_since, false); err != nil {
+		log.Fatalf("Error parsing --since value: %v", err)
+	}
+	if filter.Until, err = parseTimeArg(*opt_until, true); err != nil {
+		log.Fatalf("Error parsing --until value: %v", err)
+	}
+	if _, err := filter.OrderBy(""); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if *opt_limit < 0 {
+		log.Fatalf("Error: --limit must not be negative")
+	}
+
+	opts := StatOptions{Filter: filter, Format: *opt_format, Fields: *opt_fields, Usage: usage && runID == 0}
+	err = RunStatCommand(globalDB, opts, config)
 	if err != nil {
 		log.Fatalf("Stat command failed: %v", err)
 	}
 }
+
+// runStatuses are the statuses of runs in the global tasks table
+var runStatuses = []string{"running", "completed", "failed", RunInterrupted}
+
+// isRunStatus checks if status is a valid run status
+func isRunStatus(status string) bool {
+	for _, s := range runStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimeArg parses --since/--until values: a date, a date and time (local time, RFC 3339 also accepted)
+// or a duration before now such as 30m, 12h, 7d
+// A date alone means the start of that day, or the end of it if endOfDay is set
+// Returns the zero time for an empty string
+func parseTimeArg(s string, endOfDay bool) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && days >= 0 {
+			return time.Now().AddDate(0, 0, -days), nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Local(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s (expected 2006-01-02, '2006-01-02 15:04', RFC 3339 or a duration like 7d, 12h)", s)
+}
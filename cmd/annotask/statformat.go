@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Output formats of the stat command
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+	FormatTSV   = "tsv"
+	// FormatMarkdown is only offered by report
+	FormatMarkdown = "markdown"
+)
+
+// outputField is one column of machine-readable output
+// value returns nil for missing values (null in JSON, empty in CSV/TSV, "-" in tables)
+type outputField[T any] struct {
+	name  string
+	value func(row *T) interface{}
+}
+
+// runFields are the fields of a run available to stat --fields, in default order
+var runFields = []outputField[RunInfo]{
+	{"id", func(r *RunInfo) interface{} { return r.ID }},
+	{"runId", func(r *RunInfo) interface{} { return nullIfEmpty(r.RunID) }},
+	{"user", func(r *RunInfo) interface{} { return r.UsrID }},
+	{"project", func(r *RunInfo) interface{} { return r.Project }},
+	{"module", func(r *RunInfo) interface{} { return r.Module }},
+	{"mode", func(r *RunInfo) interface{} { return r.Mode }},
+	{"status", func(r *RunInfo) interface{} { return nullIfEmpty(r.Status) }},
+	{"total", func(r *RunInfo) interface{} { return r.Total }},
+	{"pending", func(r *RunInfo) interface{} { return r.Pending }},
+	{"running", func(r *RunInfo) interface{} { return r.Running }},
+	{"failed", func(r *RunInfo) interface{} { return r.Failed }},
+	{"finished", func(r *RunInfo) interface{} { return r.Finished }},
+	{"starttime", func(r *RunInfo) interface{} { return rfc3339Time(r.StartTime) }},
+	{"endtime", func(r *RunInfo) interface{} { return rfc3339Time(r.EndTime) }},
+	{"elapsed", func(r *RunInfo) interface{} { return int64(elapsedSince(r.StartTime, r.EndTime).Seconds()) }},
+	{"node", func(r *RunInfo) interface{} { return nullIfEmpty(r.Node) }},
+	{"pid", func(r *RunInfo) interface{} { return r.PID }},
+	{"cpuHours", func(r *RunInfo) interface{} { return roundHours(r.CPUHours) }},
+	{"memHours", func(r *RunInfo) interface{} { return roundHours(r.MemHours) }},
+	{"shellPath", func(r *RunInfo) interface{} { return r.ShellPath }},
+	{"command", func(r *RunInfo) interface{} { return nullIfEmpty(r.Command) }},
+	{"params", func(r *RunInfo) interface{} { return rawJSONValue(r.Params) }},
+}
+
+// jobFields are the fields of a task available to stat -k <id> --tasks --fields, in default order
+var jobFields = []outputField[JobInfo]{
+	{"task", func(j *JobInfo) interface{} { return j.Num }},
+	{"status", func(j *JobInfo) interface{} { return nullIfEmpty(j.Status) }},
+	{"retry", func(j *JobInfo) interface{} { return j.Retry }},
+	{"taskid", func(j *JobInfo) interface{} { return nullIfEmpty(j.TaskID) }},
+	{"node", func(j *JobInfo) interface{} { return nullIfEmpty(j.Node) }},
+	{"exitCode", func(j *JobInfo) interface{} { return jobExitCode(j) }},
+	{"starttime", func(j *JobInfo) interface{} { return jobTime(j, j.StartTime) }},
+	{"endtime", func(j *JobInfo) interface{} { return jobTime(j, j.EndTime) }},
+	{"duration", func(j *JobInfo) interface{} { return int64(j.Elapsed().Seconds()) }},
+	{"mem", func(j *JobInfo) interface{} { return nullIfZero(j.Mem) }},
+	{"h_vmem", func(j *JobInfo) interface{} { return nullIfZero(j.HVmem) }},
+	{"reason", func(j *JobInfo) interface{} { return nullIfEmpty(j.Reason) }},
+	{"shellPath", func(j *JobInfo) interface{} { return j.ShellPath }},
+	{"stderr", func(j *JobInfo) interface{} {
+		_, errFile := j.LogFiles()
+		return nullIfEmpty(errFile)
+	}},
+}
+
+// jobExitCode returns the exit code of a finished or failed task, nil otherwise
+func jobExitCode(j *JobInfo) interface{} {
+	if j.ExitCode == nil || j.Status == string(J_pending) || j.Status == string(J_running) {
+		return nil
+	}
+	return *j.ExitCode
+}
+
+// jobTime converts a task time to RFC 3339
+// Pending tasks keep times of earlier runs in the database, so they have none
+func jobTime(j *JobInfo, s string) interface{} {
+	if j.Status == string(J_pending) {
+		return nil
+	}
+	return rfc3339Time(s)
+}
+
+// selectFields returns the fields named in a comma-separated list (all fields if the list is empty)
+func selectFields[T any](fields []outputField[T], list string) ([]outputField[T], error) {
+	names := splitList(list)
+	if len(names) == 0 {
+		return fields, nil
+	}
+	var selected []outputField[T]
+	for _, name := range names {
+		found := false
+		for _, field := range fields {
+			if strings.EqualFold(field.name, name) {
+				selected = append(selected, field)
+				found = true
+				break
+			}
+		}
+		if !found {
+			available := make([]string, len(fields))
+			for i, field := range fields {
+				available[i] = field.name
+			}
+			return nil, fmt.Errorf("unknown field: %s (available: %s)", name, strings.Join(available, ","))
+		}
+	}
+	return selected, nil
+}
+
+// validateFormat checks an output format name
+func validateFormat(format string) error {
+	switch format {
+	case FormatTable, FormatJSON, FormatCSV, FormatTSV:
+		return nil
+	}
+	return fmt.Errorf("invalid format: %s (expected table, json, csv or tsv)", format)
+}
+
+// writeRows writes rows in the given format with the selected fields
+func writeRows[T any](w io.Writer, rows []T, fields []outputField[T], format string) error {
+	switch format {
+	case FormatJSON:
+		objects := make([]jsonObject, len(rows))
+		for i := range rows {
+			for _, field := range fields {
+				objects[i].keys = append(objects[i].keys, field.name)
+				objects[i].values = append(objects[i].values, field.value(&rows[i]))
+			}
+		}
+		data, err := json.MarshalIndent(objects, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case FormatCSV, FormatTSV:
+		cw := csv.NewWriter(w)
+		if format == FormatTSV {
+			cw.Comma = '\t'
+		}
+		record := make([]string, len(fields))
+		for i, field := range fields {
+			record[i] = field.name
+		}
+		cw.Write(record)
+		for i := range rows {
+			for j, field := range fields {
+				record[j] = formatFieldValue(field.value(&rows[i]), "")
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		return cw.Error()
+	case FormatMarkdown:
+		names := make([]string, len(fields))
+		separators := make([]string, len(fields))
+		for i, field := range fields {
+			names[i] = field.name
+			separators[i] = "---"
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(names, " | "))
+		fmt.Fprintf(w, "| %s |\n", strings.Join(separators, " | "))
+		for i := range rows {
+			values := make([]string, len(fields))
+			for j, field := range fields {
+				values[j] = strings.ReplaceAll(formatFieldValue(field.value(&rows[i]), "-"), "|", "\\|")
+			}
+			if _, err := fmt.Fprintf(w, "| %s |\n", strings.Join(values, " | ")); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		names := make([]string, len(fields))
+		for i, field := range fields {
+			names[i] = field.name
+		}
+		fmt.Fprintln(tw, strings.Join(names, "\t"))
+		for i := range rows {
+			values := make([]string, len(fields))
+			for j, field := range fields {
+				values[j] = formatFieldValue(field.value(&rows[i]), "-")
+			}
+			fmt.Fprintln(tw, strings.Join(values, "\t"))
+		}
+		return tw.Flush()
+	}
+}
+
+// rawJSON is a JSON value written as is, in JSON output and as text
+type rawJSON string
+
+func (r rawJSON) MarshalJSON() ([]byte, error) {
+	return []byte(r), nil
+}
+
+// rawJSONValue returns a stored JSON value as a field value, nil if it is empty
+func rawJSONValue(data json.RawMessage) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	return rawJSON(data)
+}
+
+// formatFieldValue formats a field value as text, missing values are replaced by empty
+func formatFieldValue(value interface{}, empty string) string {
+	if value == nil {
+		return empty
+	}
+	if s, ok := value.(string); ok && s == "" {
+		return empty
+	}
+	return fmt.Sprint(value)
+}
+
+// jsonObject is a JSON object that keeps the order of its keys
+type jsonObject struct {
+	keys   []string
+	values []interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(o.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// rfc3339Time converts a time read from the databases to RFC 3339, nil if it is empty or invalid
+func rfc3339Time(s string) interface{} {
+	t, ok := parseDBTime(s)
+	if !ok {
+		return nil
+	}
+	return t.Format(time.RFC3339)
+}
+
+// nullIfEmpty returns nil for an empty string
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullIfZero returns nil for zero
+func nullIfZero(f float64) interface{} {
+	if f == 0 {
+		return nil
+	}
+	return f
+}
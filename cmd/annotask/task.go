@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -310,15 +311,113 @@ func formatMemoryGB(mem float64) string {
 	return fmt.Sprintf("%.2fG", mem)
 }
 
-func IlterCommand(ctx context.Context, dbObj *MySql, thred int, need2run []int, mode JobMode, cpu int, mem, h_vmem float64, userSetMem, userSetHvmem bool, queue string, sgeProject string, parallelEnvMode string, write_pool *gpool.Pool, hostname string) {
-	pool := gpool.New(thred)
+// formatHRT formats a wall-clock limit as HH:MM:SS for SGE h_rt resource specification
+// Sub-second parts are rounded up so the limit is never shorter than requested
+func formatHRT(d time.Duration) string {
+	totalSeconds := int64(math.Ceil(d.Seconds()))
+	hours := totalSeconds / 3600
+	minutes := (totalSeconds % 3600) / 60
+	seconds := totalSeconds % 60
+	return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
+}
+
+// sgeNativeSpec builds the DRMAA native specification (qsub options) of a task
+func sgeNativeSpec(cpu int, mem, h_vmem float64, userSetMem, userSetHvmem bool, queue string, sgeProject string, parallelEnvMode string, hostname string, timeout time.Duration) string {
+	// Build nativeSpec with SGE resource options
+	// Following goqsub's pattern: include -cwd to ensure output files are generated in script's directory
+	// - SetRemoteCommand sets the script path
+	// - -cwd ensures working directory is script's directory
+	// - -b n means non-binary mode (use shell)
+	// - SGE will auto-generate output files as {job_name}.o.{jobID} and {job_name}.e.{jobID}
+	// Note: Following goqsub's pattern:
+	// - --mem maps to -l vf=XG (virtual free memory)
+	// - --h_vmem maps to -l h_vmem=XG (hard virtual memory limit)
+	// Two parallel environment modes:
+	// - pe_smp mode: -pe smp Y -cwd -b n (Y=cpu)
+	// - num_proc mode (default): -l p=Y -cwd -b n (p=cpu)
+
+	// Build resource specification
+	var resourceSpecs []string
+
+	// Add memory specifications if set
+	if userSetMem {
+		resourceSpecs = append(resourceSpecs, fmt.Sprintf("vf=%s", formatMemoryGB(mem)))
+	}
+	if userSetHvmem {
+		resourceSpecs = append(resourceSpecs, fmt.Sprintf("h_vmem=%s", formatMemoryGB(h_vmem)))
+	}
+
+	// Add wall-clock limit if --timeout is set (maps to -l h_rt=HH:MM:SS)
+	if timeout > 0 {
+		resourceSpecs = append(resourceSpecs, fmt.Sprintf("h_rt=%s", formatHRT(timeout)))
+	}
+
+	// Add hostname specification if provided (non-empty and not "none")
+	// Supports single hostname or comma-separated list (e.g., node1 or node1,node2)
+	if hostname != "" && strings.ToLower(strings.TrimSpace(hostname)) != "none" {
+		hostnameValue := strings.TrimSpace(hostname)
+		resourceSpecs = append(resourceSpecs, fmt.Sprintf("h=%s", hostnameValue))
+	}
+
+	// Build nativeSpec
+	var nativeSpecParts []string
+
+	// Add parallel environment or CPU specification based on mode
+	if parallelEnvMode == string(ParallelEnvPeSmp) {
+		// pe_smp mode: use -pe smp (matches goqsub)
+		nativeSpecParts = append(nativeSpecParts, fmt.Sprintf("-pe smp %d", cpu))
+	} else {
+		// num_proc mode: add p=cpu to -l specification
+		resourceSpecs = append(resourceSpecs, fmt.Sprintf("p=%d", cpu))
+	}
+
+	// Add -cwd to use current working directory (where qsub was executed) as job's working directory
+	// -cwd is a boolean flag in SGE and does not accept a path argument
+	// -b n means non-binary mode (use shell)
+	nativeSpecParts = append(nativeSpecParts, "-cwd", "-b n")
+
+	// Add resource specifications if any
+	if len(resourceSpecs) > 0 {
+		nativeSpecParts = append(nativeSpecParts, fmt.Sprintf("-l %s", strings.Join(resourceSpecs, ",")))
+	}
+
+	// Add queue specification if provided (supports multiple queues, comma-separated)
+	if queue != "" {
+		// Trim whitespace from queue string, but preserve internal structure
+		// Only trim leading/trailing whitespace, not commas (commas are valid separators)
+		queue = strings.TrimSpace(queue)
+		// Only remove trailing commas (if user accidentally added them)
+		queue = strings.TrimRight(queue, ",")
+		// Trim any remaining whitespace after removing trailing commas
+		queue = strings.TrimSpace(queue)
+		if queue != "" {
+			nativeSpecParts = append(nativeSpecParts, fmt.Sprintf("-q %s", queue))
+		}
+	}
+
+	// Add SGE project specification if provided (for resource quota management)
+	if sgeProject != "" {
+		nativeSpecParts = append(nativeSpecParts, fmt.Sprintf("-P %s", sgeProject))
+	}
+
+	return strings.Join(nativeSpecParts, " ")
+}
+
+func IlterCommand(ctx context.Context, dbObj *MySql, need2run []int, opts runOptions, write_pool *gpool.Pool, budget *FailureBudget) {
+	pool := gpool.New(opts.Thread)
 
 	for _, N := range need2run {
 		pool.Add(1)
-		if mode == ModeQsubSge {
-			go SubmitQsubCommand(ctx, N, pool, dbObj, write_pool, cpu, mem, h_vmem, userSetMem, userSetHvmem, queue, sgeProject, parallelEnvMode, hostname)
+		// Stop dispatching new tasks once the failure budget is exceeded
+		// Remaining tasks stay Pending and will run on the next invocation
+		if budget.Exceeded() {
+			pool.Done()
+			break
+		}
+		if opts.Mode == ModeQsubSge {
+			go SubmitQsubCommand(ctx, N, pool, dbObj, write_pool, opts, budget)
 		} else {
-			go RunCommand(N, pool, dbObj, write_pool)
+			go RunCommand(N, pool, dbObj, write_pool, opts.Timeout, budget, opts.Criteria)
 		}
 	}
 
@@ -327,13 +426,44 @@ func IlterCommand(ctx context.Context, dbObj *MySql, thred int, need2run []int,
 	pool.Wait()
 }
 
-func RunCommand(N int, pool *gpool.Pool, dbObj *MySql, write_pool *gpool.Pool) {
+// killProcessGroup sends SIGTERM to a process group, then SIGKILL if it is still around after a grace period
+// exited is closed once the task's process has been waited for: if the group is empty by then, its pgid
+// may be reused by an unrelated process and the SIGKILL is dropped
+func killProcessGroup(pgid int, exited <-chan struct{}) {
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	grace := time.NewTimer(10 * time.Second)
+	go func() {
+		defer grace.Stop()
+		select {
+		case <-exited:
+			if syscall.Kill(-pgid, 0) != nil {
+				return
+			}
+			// Children that ignored SIGTERM keep the pgid in use, they still get the SIGKILL
+			<-grace.C
+		case <-grace.C:
+		}
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}()
+}
+
+func RunCommand(N int, pool *gpool.Pool, dbObj *MySql, write_pool *gpool.Pool, timeout time.Duration, budget *FailureBudget, criteria *SuccessCriteria) {
 	defer pool.Done()
+	// Runs before pool.Done so the budget is updated before the next task is dispatched
+	defer budget.CheckTask(dbObj, N)
+	defer runNotifier.CheckTask(dbObj, N)
 
 	var subShellPath string
 	var retry int
-	err := dbObj.Db.QueryRow("select shellPath, retry from job where subJob_num = ?", N).Scan(&subShellPath, &retry)
+	var directives sql.NullString
+	err := dbObj.Db.QueryRow("select shellPath, retry, directives from job where subJob_num = ?", N).Scan(&subShellPath, &retry, &directives)
 	CheckErr(err)
+	attempt := eventLog.StartAttempt(N, ModeLocal)
+	node, _ := os.Hostname()
+
+	// Run-level criteria merged with the task's own directives
+	taskDirectives := decodeDirectives(directives.String)
+	effective := criteria.Merge(taskDirectives.Criteria)
 
 	now := time.Now().Format("2006-01-02 15:04:05")
 	write_pool.Add(1)
@@ -354,18 +484,39 @@ func RunCommand(N int, pool *gpool.Pool, dbObj *MySql, write_pool *gpool.Pool) {
 	Ewriter := io.MultiWriter(she)
 	cmd.Stdout = Owriter
 	cmd.Stderr = Ewriter
+	if len(effective.RequirePatterns) > 0 || len(effective.RejectPatterns) > 0 {
+		// Mark where this attempt starts in the appended .e file, so patterns are only checked against this attempt
+		fmt.Fprintf(she, "%s %s ==========\n", attemptStartMarker, time.Now().Format("2006/01/02 15:04:05"))
+	}
+	hooks := taskDirectives.hooks()
+	if hooks.Pre != "" {
+		cmd.Env = append(os.Environ(), hookEnv(ModeLocal, retry+1)...)
+	}
+	if timeout > 0 || budget.CancelRunning() {
+		// Run in its own process group so the whole tree can be killed on timeout or cancellation
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
 
 	err = cmd.Start() // Start the process
 	if err != nil {
+		reason := fmt.Sprintf("failed to start: %v", err)
+		eventLog.Emit(TaskEvent{Event: EventFailed, Task: N, Attempt: attempt, Mode: string(ModeLocal), Node: node,
+			ExitCode: exitCodePtr(1), Reason: reason})
 		write_pool.Add(1)
 		now = time.Now().Format("2006-01-02 15:04:05")
 		retry++
 		_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, retry=? where subJob_num=?", J_failed, now, 1, retry, N)
 		write_pool.Done()
 		CheckErr(err)
+		hooks.RunCompletion(false, TaskHookContext{Task: N, ShellPath: subShellPath, Attempt: retry, Mode: ModeLocal,
+			Node: node, ExitCode: 1, Reason: reason, Stdout: subShellPath + ".o", Stderr: subShellPath + ".e"})
 		return
 	}
 
+	attemptStart := time.Now()
+	processMetrics.RecordSubmission(ModeLocal, N)
+	eventLog.Emit(TaskEvent{Event: EventRunning, Task: N, Attempt: attempt, Mode: string(ModeLocal), TaskID: strconv.Itoa(cmd.Process.Pid), Node: node})
+
 	// Store PID as taskid for local mode
 	write_pool.Add(1)
 	_, err2 := dbObj.Db.Exec("UPDATE job set taskid=? where subJob_num=?", strconv.Itoa(cmd.Process.Pid), N)
@@ -374,7 +525,42 @@ func RunCommand(N int, pool *gpool.Pool, dbObj *MySql, write_pool *gpool.Pool) {
 	}
 	write_pool.Done()
 
+	// Kill the process group if the task exceeds its wall-clock limit
+	var timedOut atomic.Bool
+	waitDone := make(chan struct{})
+	if timeout > 0 {
+		pgid := cmd.Process.Pid
+		timer := time.AfterFunc(timeout, func() {
+			timedOut.Store(true)
+			fmt.Fprintf(she, "annotask: task exceeded timeout of %s, killing process group %d\n", timeout, pgid)
+			killProcessGroup(pgid, waitDone)
+		})
+		defer timer.Stop()
+	}
+
+	// Kill the process group if the failure budget is exceeded while the task is running
+	var cancelled atomic.Bool
+	if budget.CancelRunning() {
+		pgid := cmd.Process.Pid
+		go func() {
+			select {
+			case <-budget.Done():
+				cancelled.Store(true)
+				fmt.Fprintf(she, "annotask: failure budget exceeded, cancelling task (process group %d)\n", pgid)
+				killProcessGroup(pgid, waitDone)
+			case <-waitDone:
+			}
+		}()
+	}
+
 	err = cmd.Wait() // Wait for process to complete
+	close(waitDone)
+	wall := time.Since(attemptStart)
+	// Local tasks don't request memory, account their peak RSS (ru_maxrss is in KB on Linux)
+	var peakMemGB float64
+	if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		peakMemGB = float64(rusage.Maxrss) / (1024 * 1024)
+	}
 
 	var exitCode int
 
@@ -391,53 +577,123 @@ func RunCommand(N int, pool *gpool.Pool, dbObj *MySql, write_pool *gpool.Pool) {
 		ws := cmd.ProcessState.Sys().(syscall.WaitStatus)
 		exitCode = ws.ExitStatus()
 	}
+	if timedOut.Load() {
+		// Same exit code as coreutils timeout(1)
+		exitCode = 124
+		log.Printf("Task %d exceeded timeout of %s and was killed", N, timeout)
+	} else if cancelled.Load() {
+		// 128 + SIGTERM, the task was cancelled by annotask rather than failing on its own
+		exitCode = 143
+		log.Printf("Task %d was cancelled because the failure budget was exceeded", N)
+	}
+
+	// Apply success criteria: allowed exit codes, required outputs and log patterns
+	success := false
+	reason := ""
+	if timedOut.Load() {
+		reason = fmt.Sprintf("killed after exceeding timeout of %s", timeout)
+	} else if cancelled.Load() {
+		reason = "cancelled: failure budget exceeded"
+	} else if !effective.ExitCodeOK(exitCode) {
+		reason = fmt.Sprintf("exit code %d", exitCode)
+	} else if reason = effective.Check("", subShellPath+".o", subShellPath+".e"); reason != "" {
+		removeSignFile(subShellPath)
+		log.Printf("Task %d failed success criteria: %s", N, reason)
+	} else {
+		success = true
+		if _, statErr := os.Stat(subShellPath + ".sign"); statErr != nil {
+			// Allowed non-zero exit code, the script didn't write .sign
+			if signErr := writeSignFile(subShellPath); signErr != nil {
+				log.Printf("Warning: Could not write .sign file for task %d: %v", N, signErr)
+			}
+		}
+	}
+
+	processMetrics.ObserveDuration(success, time.Since(attemptStart))
+	event := TaskEvent{Event: EventFailed, Task: N, Attempt: attempt, Mode: string(ModeLocal), TaskID: strconv.Itoa(cmd.Process.Pid),
+		Node: node, ExitCode: exitCodePtr(exitCode), Reason: reason, Duration: time.Since(attemptStart).Seconds()}
+	if success {
+		event.Event = EventFinished
+	} else if cancelled.Load() {
+		event.Event = EventCancelled
+	}
+	eventLog.Emit(event)
 
 	write_pool.Add(1)
 	now = time.Now().Format("2006-01-02 15:04:05")
-	if exitCode == 0 {
-		_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=? where subJob_num=?", J_finished, now, exitCode, N)
+	hookContext := TaskHookContext{Task: N, ShellPath: subShellPath, Attempt: retry + 1, Mode: ModeLocal, JobID: strconv.Itoa(cmd.Process.Pid),
+		Node: node, ExitCode: exitCode, Reason: reason, Stdout: subShellPath + ".o", Stderr: subShellPath + ".e"}
+	if success {
+		_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, reason=NULL, doneHash=cmdHash where subJob_num=?", J_finished, now, exitCode, N)
 	} else {
 		// Check if process is still running (for retry logic)
 		retry++
-		_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, retry=? where subJob_num=?", J_failed, now, exitCode, retry, N)
+		_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, retry=?, reason=? where subJob_num=?", J_failed, now, exitCode, retry, reason, N)
 		// Retry logic will be handled by main loop
 	}
+	recordTaskUsage(dbObj, N, 1, peakMemGB, wall)
 
 	write_pool.Done()
 	CheckErr(err)
+	hooks.RunCompletion(success, hookContext)
+}
+
+// attemptResources returns the memory and h_rt an SGE attempt of a task is submitted with
+// If retry > 0, the stored values are used (they may have been increased after a memory or h_rt failure),
+// but only for the parameters the user set originally (--mem, --h_vmem, --timeout)
+// Used by SubmitQsubCommand and --dry-run
+func attemptResources(retry int, storedMem, storedHvmem float64, storedHrt int64, mem, h_vmem float64, userSetMem, userSetHvmem bool, timeout time.Duration) (float64, float64, time.Duration) {
+	if retry > 0 {
+		if userSetMem && storedMem > 0 {
+			mem = storedMem
+		}
+		if userSetHvmem && storedHvmem > 0 {
+			h_vmem = storedHvmem
+		}
+		if timeout > 0 && storedHrt > 0 {
+			timeout = time.Duration(storedHrt) * time.Second
+		}
+	}
+	return mem, h_vmem, timeout
 }
 
-func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySql, write_pool *gpool.Pool, cpu int, mem, h_vmem float64, userSetMem, userSetHvmem bool, queue string, sgeProject string, parallelEnvMode string, hostname string) {
+func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySql, write_pool *gpool.Pool, opts runOptions, budget *FailureBudget) {
 	defer pool.Done()
+	// Runs before pool.Done so the budget is updated before the next task is dispatched
+	defer budget.CheckTask(dbObj, N)
+	defer runNotifier.CheckTask(dbObj, N)
 
 	var subShellPath string
 	var retry int
 	var currentMem float64
 	var currentHvmem float64
+	var currentHrt sql.NullInt64
 	var taskid sql.NullString
-	err := dbObj.Db.QueryRow("select shellPath, retry, mem, h_vmem, taskid from job where subJob_num = ?", N).Scan(&subShellPath, &retry, &currentMem, &currentHvmem, &taskid)
+	var directives sql.NullString
+	err := dbObj.Db.QueryRow("select shellPath, retry, mem, h_vmem, h_rt, taskid, directives from job where subJob_num = ?", N).Scan(&subShellPath, &retry, &currentMem, &currentHvmem, &currentHrt, &taskid, &directives)
 	CheckErr(err)
+	attempt := eventLog.StartAttempt(N, ModeQsubSge)
 
-	// If retry > 0, use stored memory values (may have been increased)
-	// Only use stored values if user originally set the corresponding parameter
-	// This ensures we use the previously increased values for subsequent retries
-	if retry > 0 {
-		// Only update mem if user set it originally
-		if userSetMem && currentMem > 0 {
-			mem = currentMem
-		}
-		// Only update h_vmem if user set it originally
-		if userSetHvmem && currentHvmem > 0 {
-			h_vmem = currentHvmem
-		}
-	}
+	// Run-level criteria merged with the task's own directives
+	taskDirectives := decodeDirectives(directives.String)
+	effective := opts.Criteria.Merge(taskDirectives.Criteria)
+
+	cpu, queue, parallelEnvMode := opts.CPU, opts.Queue, opts.ParallelEnvMode
+	mem, h_vmem, timeout := attemptResources(retry, currentMem, currentHvmem, currentHrt.Int64, opts.Mem, opts.HVmem, opts.UserSetMem, opts.UserSetHvmem, opts.Timeout)
 
 	now := time.Now().Format("2006-01-02 15:04:05")
 	write_pool.Add(1)
-	_, err = dbObj.Db.Exec("UPDATE job set status=?, starttime=?, cpu=?, mem=?, h_vmem=? where subJob_num=?", J_running, now, cpu, mem, h_vmem, N)
+	_, err = dbObj.Db.Exec("UPDATE job set status=?, starttime=?, cpu=?, mem=?, h_vmem=?, h_rt=? where subJob_num=?", J_running, now, cpu, mem, h_vmem, int64(math.Ceil(timeout.Seconds())), N)
 	CheckErr(err)
 	write_pool.Done()
 
+	resources := &EventResources{CPU: cpu, Mem: mem, HVmem: h_vmem, HRT: int64(math.Ceil(timeout.Seconds())), Queue: queue, PEMode: parallelEnvMode}
+	// emitFailed records a task that failed before or during submission
+	emitFailed := func(reason string) {
+		eventLog.Emit(TaskEvent{Event: EventFailed, Task: N, Attempt: attempt, Mode: string(ModeQsubSge),
+			ExitCode: exitCodePtr(1), Reason: reason, Resources: resources})
+	}
+
 	// Get global DRMAA session (thread-safe)
 	session, err := getDRMAASession()
 	if err != nil {
@@ -445,6 +701,8 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 		now = time.Now().Format("2006-01-02 15:04:05")
 		retry++
 		drmaaErr := err // Save original error before database update
+		processMetrics.RecordDRMAAError()
+		emitFailed(fmt.Sprintf("DRMAA session error: %v", err))
 		_, dbErr := dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, retry=? where subJob_num=?", J_failed, now, 1, retry, N)
 		write_pool.Done()
 		if dbErr != nil {
@@ -467,6 +725,8 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 		now = time.Now().Format("2006-01-02 15:04:05")
 		retry++
 		templateErr := err // Save original error before database update
+		processMetrics.RecordDRMAAError()
+		emitFailed(fmt.Sprintf("DRMAA job template error: %v", err))
 		_, dbErr := dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, retry=? where subJob_num=?", J_failed, now, 1, retry, N)
 		write_pool.Done()
 		if dbErr != nil {
@@ -512,82 +772,16 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 	// For example: task_0001.sh.o.8944790 and task_0001.sh.e.8944790
 	// Output files will be generated in the script's directory (via -cwd in nativeSpec)
 	jt.SetJobName(subShellBase)
+	hooks := taskDirectives.hooks()
+	attemptNum := retry + 1
+	if hooks.Pre != "" {
+		// The pre hook in the script reads the mode and attempt number from the job environment
+		jt.SetEnv(hookEnv(ModeQsubSge, attemptNum))
+	}
 	// Note: We don't call SetOutputPath/SetErrorPath - let SGE auto-generate based on job name
 	// This matches goqsub's implementation and avoids DRMAA path format issues
 
-	// Build nativeSpec with SGE resource options
-	// Following goqsub's pattern: include -cwd to ensure output files are generated in script's directory
-	// - SetRemoteCommand sets the script path
-	// - -cwd ensures working directory is script's directory
-	// - -b n means non-binary mode (use shell)
-	// - SGE will auto-generate output files as {job_name}.o.{jobID} and {job_name}.e.{jobID}
-	// Note: Following goqsub's pattern:
-	// - --mem maps to -l vf=XG (virtual free memory)
-	// - --h_vmem maps to -l h_vmem=XG (hard virtual memory limit)
-	// Two parallel environment modes:
-	// - pe_smp mode: -pe smp Y -cwd -b n (Y=cpu)
-	// - num_proc mode (default): -l p=Y -cwd -b n (p=cpu)
-
-	// Build resource specification
-	var resourceSpecs []string
-
-	// Add memory specifications if set
-	if userSetMem {
-		resourceSpecs = append(resourceSpecs, fmt.Sprintf("vf=%s", formatMemoryGB(mem)))
-	}
-	if userSetHvmem {
-		resourceSpecs = append(resourceSpecs, fmt.Sprintf("h_vmem=%s", formatMemoryGB(h_vmem)))
-	}
-
-	// Add hostname specification if provided (non-empty and not "none")
-	// Supports single hostname or comma-separated list (e.g., node1 or node1,node2)
-	if hostname != "" && strings.ToLower(strings.TrimSpace(hostname)) != "none" {
-		hostnameValue := strings.TrimSpace(hostname)
-		resourceSpecs = append(resourceSpecs, fmt.Sprintf("h=%s", hostnameValue))
-	}
-
-	// Build nativeSpec
-	var nativeSpecParts []string
-
-	// Add parallel environment or CPU specification based on mode
-	if parallelEnvMode == string(ParallelEnvPeSmp) {
-		// pe_smp mode: use -pe smp (matches goqsub)
-		nativeSpecParts = append(nativeSpecParts, fmt.Sprintf("-pe smp %d", cpu))
-	} else {
-		// num_proc mode: add p=cpu to -l specification
-		resourceSpecs = append(resourceSpecs, fmt.Sprintf("p=%d", cpu))
-	}
-
-	// Add -cwd to use current working directory (where qsub was executed) as job's working directory
-	// -cwd is a boolean flag in SGE and does not accept a path argument
-	// -b n means non-binary mode (use shell)
-	nativeSpecParts = append(nativeSpecParts, "-cwd", "-b n")
-
-	// Add resource specifications if any
-	if len(resourceSpecs) > 0 {
-		nativeSpecParts = append(nativeSpecParts, fmt.Sprintf("-l %s", strings.Join(resourceSpecs, ",")))
-	}
-
-	// Add queue specification if provided (supports multiple queues, comma-separated)
-	if queue != "" {
-		// Trim whitespace from queue string, but preserve internal structure
-		// Only trim leading/trailing whitespace, not commas (commas are valid separators)
-		queue = strings.TrimSpace(queue)
-		// Only remove trailing commas (if user accidentally added them)
-		queue = strings.TrimRight(queue, ",")
-		// Trim any remaining whitespace after removing trailing commas
-		queue = strings.TrimSpace(queue)
-		if queue != "" {
-			nativeSpecParts = append(nativeSpecParts, fmt.Sprintf("-q %s", queue))
-		}
-	}
-
-	// Add SGE project specification if provided (for resource quota management)
-	if sgeProject != "" {
-		nativeSpecParts = append(nativeSpecParts, fmt.Sprintf("-P %s", sgeProject))
-	}
-
-	nativeSpec := strings.Join(nativeSpecParts, " ")
+	nativeSpec := sgeNativeSpec(cpu, mem, h_vmem, opts.UserSetMem, opts.UserSetHvmem, queue, opts.SgeProject, parallelEnvMode, opts.Hostname, timeout)
 	jt.SetNativeSpecification(nativeSpec)
 
 	// Submit job
@@ -597,6 +791,8 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 		now = time.Now().Format("2006-01-02 15:04:05")
 		retry++
 		submitErr := err // Save original error before database update
+		processMetrics.RecordDRMAAError()
+		emitFailed(fmt.Sprintf("submission failed: %v", err))
 		_, dbErr := dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, retry=? where subJob_num=?", J_failed, now, 1, retry, N)
 		write_pool.Done()
 		if dbErr != nil {
@@ -611,13 +807,36 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 		return
 	}
 
-	// Store SGE job ID as taskid for qsubsge mode
+	submitTime := time.Now()
+	processMetrics.RecordSubmission(ModeQsubSge, N)
+	eventLog.Emit(TaskEvent{Event: EventSubmitted, Task: N, Attempt: attempt, Mode: string(ModeQsubSge), TaskID: jobID, Resources: resources})
+
+	// Store SGE job ID as taskid for qsubsge mode, the node of a previous attempt no longer applies
 	write_pool.Add(1)
-	_, err = dbObj.Db.Exec("UPDATE job set taskid=? where subJob_num=?", jobID, N)
+	_, err = dbObj.Db.Exec("UPDATE job set taskid=?, node=NULL where subJob_num=?", jobID, N)
 	write_pool.Done()
 	CheckErr(err)
 
+	// Only watch the failure budget if in-flight jobs should be cancelled
+	// A nil channel is never selected
+	var budgetDone <-chan struct{}
+	if budget.CancelRunning() {
+		budgetDone = budget.Done()
+	}
+
 	// Monitor job status
+	runningSeen := false
+	runningNode := ""
+	// Run time is counted from the first poll that saw the job running (or the last one that saw it queued,
+	// if it finished in between) when DRMAA reports no ru_wallclock, so queue wait isn't accounted
+	var runningSince time.Time
+	lastQueued := submitTime
+	usageStart := func() time.Time {
+		if runningSeen {
+			return runningSince
+		}
+		return lastQueued
+	}
 	for {
 		// Check if context is cancelled (should not happen normally, but allows graceful shutdown)
 		select {
@@ -627,6 +846,28 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 			// The job status will be checked again in the next retry round
 			log.Printf("Context cancelled for job %d (jobID: %s), stopping monitoring. Job continues on SGE.", N, jobID)
 			return
+		case <-budgetDone:
+			// Failure budget exceeded, terminate the SGE job
+			if termErr := session.TerminateJob(jobID); termErr != nil {
+				log.Printf("Warning: Failed to terminate SGE job %s (task %d): %v", jobID, N, termErr)
+			} else {
+				log.Printf("Terminated SGE job %s (task %d) because the failure budget was exceeded", jobID, N)
+			}
+			eventLog.Emit(TaskEvent{Event: EventCancelled, Task: N, Attempt: attempt, Mode: string(ModeQsubSge), TaskID: jobID,
+				ExitCode: exitCodePtr(143), Reason: "cancelled: failure budget exceeded", Duration: time.Since(submitTime).Seconds(), Resources: resources})
+			write_pool.Add(1)
+			now = time.Now().Format("2006-01-02 15:04:05")
+			_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=? where subJob_num=?", J_failed, now, 143, N)
+			if runningSeen {
+				// A job cancelled while queued used nothing
+				recordTaskUsage(dbObj, N, cpu, sgeAccountedMem(mem, h_vmem, 0), time.Since(runningSince))
+			}
+			write_pool.Done()
+			CheckErr(err)
+			hooks.RunCompletion(false, TaskHookContext{Task: N, ShellPath: subShellPath, Attempt: attemptNum, Mode: ModeQsubSge, JobID: jobID,
+				ExitCode: 143, Reason: "cancelled: failure budget exceeded",
+				Stdout: findSGELogFile(subShellPath, "o", jobID), Stderr: findSGELogFile(subShellPath, "e", jobID)})
+			return
 		default:
 			// Continue monitoring
 		}
@@ -636,6 +877,7 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 		// Check job status using DRMAA
 		state, err := session.JobPs(jobID)
 		if err != nil {
+			processMetrics.RecordDRMAAError()
 			log.Printf("Error checking job status: %v", err)
 			// Try to determine status from files
 			state = drmaa.PsDone
@@ -646,13 +888,33 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 			// Job finished, check exit code and get execution node
 			var exitCode int = 0
 			var isMemoryError bool = false
+			var isTimeoutError bool = false
 			var executionNode string = ""
+			// Run time from ru_wallclock, or time since the job was seen running if unavailable
+			duration := time.Since(usageStart())
+			// Peak virtual memory reported by SGE, used for accounting when no memory was requested
+			var maxvmemGB float64
 
 			// Try to get execution node from DRMAA JobInfo
 			jobInfo, err := session.Wait(jobID, drmaa.TimeoutNoWait)
 			if err == nil {
 				// Try to get execution node from ResourceUsage
 				resourceUsage := jobInfo.ResourceUsage()
+				if maxvmem, ok := resourceUsage["maxvmem"]; ok {
+					if bytes, parseErr := strconv.ParseFloat(strings.TrimSpace(maxvmem), 64); parseErr == nil {
+						maxvmemGB = bytes / (1024 * 1024 * 1024)
+					}
+				}
+				// Check whether the job was killed for exceeding h_rt
+				// SGE kills the job once ru_wallclock reaches the limit, so compare against the requested h_rt
+				if wallclock, ok := resourceUsage["ru_wallclock"]; ok {
+					if seconds, parseErr := strconv.ParseFloat(strings.TrimSpace(wallclock), 64); parseErr == nil {
+						duration = time.Duration(seconds * float64(time.Second))
+						if timeout > 0 && seconds >= timeout.Seconds() {
+							isTimeoutError = true
+						}
+					}
+				}
 				if host, ok := resourceUsage["exec_host"]; ok {
 					// exec_host format might be "node1/1" or "node1", extract node name
 					executionNode = strings.Split(host, "/")[0]
@@ -679,25 +941,11 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 			}
 
 			// Build actual file paths using jobID (taskid)
-			// Get directory and base name of subShellPath
-			subShellDir := filepath.Dir(subShellPath)
-			subShellBase := filepath.Base(subShellPath)
-
 			// Check error file for memory-related errors
-			// SGE generates output files in different formats depending on version:
-			// - Format 1: {job_name}.o.{jobID} and {job_name}.e.{jobID} (with dot separator)
-			// - Format 2: {job_name}.o{jobID} and {job_name}.e{jobID} (without dot separator)
-			// Try both formats to support different SGE versions
 			// Note: job_name includes .sh extension (e.g., task_0001.sh)
-			errFile := filepath.Join(subShellDir, fmt.Sprintf("%s.e.%s", subShellBase, jobID))
-			if _, err := os.Stat(errFile); os.IsNotExist(err) {
-				// Try format without dot separator (some SGE versions use this)
-				errFileAlt := filepath.Join(subShellDir, fmt.Sprintf("%s.e%s", subShellBase, jobID))
-				if _, err := os.Stat(errFileAlt); err == nil {
-					errFile = errFileAlt
-				}
-			}
-			if errData, readErr := os.ReadFile(errFile); readErr == nil {
+			outFile := findSGELogFile(subShellPath, "o", jobID)
+			errFile := findSGELogFile(subShellPath, "e", jobID)
+			if errData, readErr := os.ReadFile(errFile); readErr == nil && !isTimeoutError {
 				errStr := string(errData)
 				errStrLower := strings.ToLower(errStr)
 				if strings.Contains(errStrLower, "killed") || strings.Contains(errStrLower, "memory") ||
@@ -713,6 +961,8 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 			signFile := fmt.Sprintf("%s.sign", subShellPath)
 			if _, statErr := os.Stat(signFile); statErr == nil {
 				exitCode = 0
+			} else if isTimeoutError {
+				exitCode = 137 // Killed by SGE (SIGKILL) after h_rt was reached
 			} else {
 				if !isMemoryError {
 					if state == drmaa.PsFailed {
@@ -726,35 +976,87 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 				}
 			}
 
+			// Apply success criteria: allowed exit codes, required outputs and log patterns
+			// Memory and timeout kills are always failures so that resources get escalated
+			success := exitCode == 0
+			reason := ""
+			if !isMemoryError && !isTimeoutError {
+				success = effective.ExitCodeOK(exitCode)
+			}
+			if success {
+				if reason = effective.Check("", outFile, errFile); reason != "" {
+					success = false
+					removeSignFile(subShellPath)
+					log.Printf("Task %d failed success criteria: %s", N, reason)
+				} else if _, statErr := os.Stat(signFile); statErr != nil {
+					// Allowed non-zero exit code, the script didn't write .sign
+					if signErr := writeSignFile(subShellPath); signErr != nil {
+						log.Printf("Warning: Could not write .sign file for task %d: %v", N, signErr)
+					}
+				}
+			} else if isTimeoutError {
+				reason = fmt.Sprintf("killed after exceeding h_rt=%s", formatHRT(timeout))
+			} else if isMemoryError {
+				reason = "killed by memory limit"
+			} else {
+				reason = fmt.Sprintf("exit code %d", exitCode)
+			}
+
+			processMetrics.ObserveDuration(success, duration)
+			event := TaskEvent{Event: EventFailed, Task: N, Attempt: attempt, Mode: string(ModeQsubSge), TaskID: jobID, Node: executionNode,
+				ExitCode: exitCodePtr(exitCode), Reason: reason, Duration: duration.Seconds(), Resources: resources}
+			if success {
+				event.Event = EventFinished
+			}
+			eventLog.Emit(event)
+
 			write_pool.Add(1)
 			now = time.Now().Format("2006-01-02 15:04:05")
-			if exitCode == 0 {
-				_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, node=? where subJob_num=?", J_finished, now, exitCode, executionNode, N)
+			if success {
+				_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, node=?, reason=NULL, doneHash=cmdHash where subJob_num=?", J_finished, now, exitCode, executionNode, N)
 			} else {
 				retry++
 				newMem := mem
 				newHvmem := h_vmem
+				newHrt := int64(math.Ceil(timeout.Seconds()))
+				if isTimeoutError {
+					// Increase wall-clock limit by 125%, mirroring the memory escalation
+					newHrt = int64(math.Ceil(timeout.Seconds() * 1.25))
+					log.Printf("Task %d exceeded h_rt=%s, increasing to %s for next retry", N, formatHRT(timeout), formatHRT(time.Duration(newHrt)*time.Second))
+					processMetrics.RecordTimeoutEscalation()
+				}
 				if isMemoryError {
 					// Increase memory by 125% only if user set the corresponding parameter
 					// Round up to ensure we have enough memory
-					if userSetMem {
+					if opts.UserSetMem {
 						newMem = math.Ceil(mem * 1.25)
 					}
-					if userSetHvmem {
+					if opts.UserSetHvmem {
 						newHvmem = math.Ceil(h_vmem * 1.25)
 					}
+					if opts.UserSetMem || opts.UserSetHvmem {
+						processMetrics.RecordOOMEscalation()
+					}
+				}
+				if newMem != mem || newHvmem != h_vmem || newHrt != resources.HRT {
+					escalated := *resources
+					escalated.Mem, escalated.HVmem, escalated.HRT = newMem, newHvmem, newHrt
+					eventLog.Emit(TaskEvent{Event: EventEscalated, Task: N, Attempt: attempt, Mode: string(ModeQsubSge), TaskID: jobID,
+						Reason: reason, Resources: &escalated, Previous: resources})
 				}
 				// Store as float64 in database (database will handle conversion if needed)
-				_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, retry=?, mem=?, h_vmem=?, node=? where subJob_num=?", J_failed, now, exitCode, retry, newMem, newHvmem, executionNode, N)
+				_, err = dbObj.Db.Exec("UPDATE job set status=?, endtime=?, exitCode=?, retry=?, mem=?, h_vmem=?, h_rt=?, node=?, reason=? where subJob_num=?", J_failed, now, exitCode, retry, newMem, newHvmem, newHrt, executionNode, reason, N)
 			}
+			// Memory is accounted as requested (vf, else h_vmem), or the peak if nothing was requested
+			recordTaskUsage(dbObj, N, cpu, sgeAccountedMem(mem, h_vmem, maxvmemGB), duration)
 			write_pool.Done()
 			CheckErr(err)
+			hooks.RunCompletion(success, TaskHookContext{Task: N, ShellPath: subShellPath, Attempt: attemptNum, Mode: ModeQsubSge, JobID: jobID,
+				Node: executionNode, ExitCode: exitCode, Reason: reason, Stdout: outFile, Stderr: errFile})
 			return
 		} else if state == drmaa.PsRunning {
-			// Job is running, try to get execution node if not already stored
-			var currentNode sql.NullString
-			err := dbObj.Db.QueryRow("SELECT node FROM job WHERE subJob_num=?", N).Scan(&currentNode)
-			if err == nil && (!currentNode.Valid || currentNode.String == "") {
+			// Job is running, try to get execution node if not known yet for this attempt
+			if runningNode == "" {
 				// Try to get execution node using qstat command
 				cmd := exec.Command("qstat", "-j", jobID)
 				output, err := cmd.Output()
@@ -772,6 +1074,7 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 						}
 					}
 					if executionNode != "" {
+						runningNode = executionNode
 						write_pool.Add(1)
 						_, err = dbObj.Db.Exec("UPDATE job set node=? where subJob_num=?", executionNode, N)
 						write_pool.Done()
@@ -781,6 +1084,13 @@ func SubmitQsubCommand(ctx context.Context, N int, pool *gpool.Pool, dbObj *MySq
 					}
 				}
 			}
+			if !runningSeen {
+				runningSeen = true
+				runningSince = time.Now()
+				eventLog.Emit(TaskEvent{Event: EventRunning, Task: N, Attempt: attempt, Mode: string(ModeQsubSge), TaskID: jobID, Node: runningNode})
+			}
+		} else if !runningSeen {
+			lastQueued = time.Now()
 		}
 		// Job is still running, continue monitoring
 	}
@@ -790,14 +1100,16 @@ func CheckExitCode(dbObj *MySql) {
 	tx, _ := dbObj.Db.Begin()
 	defer tx.Rollback()
 
-	rows1, err := tx.Query("select subJob_num, shellPath from job where exitCode!=0")
+	// Count by status rather than exitCode: with success criteria a task may finish with an
+	// allowed non-zero exit code, or fail with exit code 0 (e.g. a required output is empty)
+	rows1, err := tx.Query("select subJob_num, shellPath from job where status=?", J_failed)
 	CheckErr(err)
 	defer rows1.Close()
-	rows12, err := tx.Query("select subJob_num, shellPath from job where exitCode!=0")
+	rows12, err := tx.Query("select subJob_num, shellPath, reason from job where status=?", J_failed)
 	CheckErr(err)
 	defer rows12.Close()
 
-	rows0, err := tx.Query("select exitCode from job where exitCode=0")
+	rows0, err := tx.Query("select exitCode from job where status=?", J_finished)
 	CheckErr(err)
 	defer rows0.Close()
 
@@ -813,10 +1125,15 @@ func CheckExitCode(dbObj *MySql) {
 
 	var subJob_num int
 	var shellPath string
+	var reason sql.NullString
 	for rows12.Next() {
-		err := rows12.Scan(&subJob_num, &shellPath)
+		err := rows12.Scan(&subJob_num, &shellPath, &reason)
 		CheckErr(err)
-		os.Stderr.WriteString(fmt.Sprintf("%v\t%s\n", subJob_num, shellPath))
+		if reason.Valid && reason.String != "" {
+			os.Stderr.WriteString(fmt.Sprintf("%v\t%s\t%s\n", subJob_num, shellPath, reason.String))
+		} else {
+			os.Stderr.WriteString(fmt.Sprintf("%v\t%s\n", subJob_num, shellPath))
+		}
 	}
 
 	os.Exit(exitCode)
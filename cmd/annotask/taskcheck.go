@@ -0,0 +1,105 @@
+package main
+
+// TaskAction is what a run does with a task before dispatching, decided by decideTask
+type TaskAction string
+
+const (
+	TaskFinished       TaskAction = "finished"        // .sign file present and success criteria pass: skipped
+	TaskUpToDate       TaskAction = "up to date"      // Declared outputs newer than inputs: .sign file written back, skipped
+	TaskOutOfDate      TaskAction = "out of date"     // Declared outputs stale: .sign file removed, run
+	TaskCriteriaFailed TaskAction = "criteria failed" // .sign file present but success criteria fail: .sign file removed, marked Failed, run
+	TaskPending        TaskAction = "pending"         // No .sign file: run
+)
+
+// Run reports whether the task is dispatched
+func (a TaskAction) Run() bool {
+	return a != TaskFinished && a != TaskUpToDate
+}
+
+// TaskRecord is the job row of a task as Creat_tb leaves it, with the state of its .sign file
+type TaskRecord struct {
+	N          int
+	ShellPath  string
+	Status     string
+	Mode       string
+	TaskID     string
+	Reason     string
+	Retry      int
+	Directives TaskDirectives
+	CmdHash    string
+	DoneHash   string
+	HasSign    bool
+	Forced     bool // Selected by annotask rerun: runs again even if its outputs are up to date
+	Excluded   bool // Left out of an annotask rerun: keeps its status
+}
+
+// decideTask decides whether a run runs a task and why, without changing anything
+// It is used by CheckSignFilesAndUpdateStatus before a run and by --dry-run, so both agree
+// The reason of TaskOutOfDate and TaskCriteriaFailed is the failed check, of TaskPending the status it comes from
+// Relative paths in success criteria and declared outputs are resolved against workDir
+func decideTask(rec TaskRecord, criteria *SuccessCriteria, workDir string) (TaskAction, string) {
+	hasSign := rec.HasSign
+	action, reason := TaskPending, ""
+
+	// File-based freshness for tasks declaring outputs
+	// A missing doneHash (e.g. directory copied without its database) is not treated as a changed command
+	if len(rec.Directives.Outputs) > 0 && !rec.Forced {
+		upToDate, outReason := outputsUpToDate(rec.Directives.Inputs, rec.Directives.Outputs, workDir)
+		if upToDate && rec.DoneHash != "" && rec.DoneHash != rec.CmdHash {
+			upToDate, outReason = false, "command changed since outputs were produced"
+		}
+		if upToDate && !hasSign {
+			hasSign, action, reason = true, TaskUpToDate, "outputs up to date"
+		} else if !upToDate && hasSign {
+			hasSign, action, reason = false, TaskOutOfDate, outReason
+		}
+	}
+
+	if hasSign {
+		// Success criteria of the last attempt
+		effective := criteria.Merge(rec.Directives.Criteria)
+		outFile, errFile := taskLogFiles(rec.ShellPath, rec.Mode, rec.TaskID)
+		if failReason := effective.Check(workDir, outFile, errFile); failReason != "" {
+			return TaskCriteriaFailed, failReason
+		}
+		if action == TaskUpToDate {
+			return action, reason
+		}
+		return TaskFinished, "finished (.sign)"
+	}
+	if action == TaskOutOfDate {
+		return action, reason
+	}
+	switch rec.Status {
+	case string(J_failed):
+		if rec.Reason != "" {
+			return TaskPending, "failed: " + rec.Reason
+		}
+		return TaskPending, "failed"
+	case string(J_running):
+		return TaskPending, "interrupted while running"
+	case string(J_finished):
+		return TaskPending, ".sign file missing"
+	}
+	return TaskPending, "pending"
+}
+
+// taskStatusAfterCheck returns the status and retry count CheckSignFilesAndUpdateStatus leaves a task with
+// Tasks reset to Pending or Failed start again from retry 1
+func taskStatusAfterCheck(rec TaskRecord, action TaskAction) (jobStatusType, int) {
+	switch {
+	case action == TaskCriteriaFailed:
+		return J_failed, 1
+	case !action.Run():
+		return J_finished, rec.Retry
+	case rec.Status != string(J_pending) && !rec.Excluded:
+		return J_pending, 1
+	}
+	return jobStatusType(rec.Status), rec.Retry
+}
+
+// commandChanged reports whether the command of a task differs from the one recorded in its job row
+// Creat_tb regenerates the script of such a task and removes its .sign file
+func commandChanged(storedHash, hash string) bool {
+	return storedHash != "" && storedHash != hash
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"golang.org/x/term"
+)
+
+// ANSI escape sequences used by the dashboard
+const (
+	ansiAltScreenOn  = "\033[?1049h"
+	ansiAltScreenOff = "\033[?1049l"
+	ansiHideCursor   = "\033[?25l"
+	ansiShowCursor   = "\033[?25h"
+	ansiHome         = "\033[H"
+	ansiClearToEnd   = "\033[J"
+	ansiClearLine    = "\033[K"
+	ansiReverse      = "\033[7m"
+	ansiBold         = "\033[1m"
+	ansiRed          = "\033[31m"
+	ansiGreen        = "\033[32m"
+	ansiYellow       = "\033[33m"
+	ansiReset        = "\033[0m"
+)
+
+// Keys recognized by the dashboard
+const (
+	keyUp    = "up"
+	keyDown  = "down"
+	keyPgUp  = "pgup"
+	keyPgDn  = "pgdn"
+	keyEnter = "enter"
+	keyBack  = "back"
+	keyQuit  = "quit"
+	keyFail  = "failed"
+)
+
+// topState holds the dashboard state between refreshes
+type topState struct {
+	globalDB *GlobalDB
+	usrID    string
+	project  string
+	interval time.Duration
+
+	runs    []RunInfo
+	runSel  int
+	run     *RunInfo // Selected run, nil in run list view
+	jobs    []JobInfo
+	jobSel  int
+	failed  bool // Only show failed tasks in run view
+	lastErr string
+	fixedID bool // Started with -k, no run list view
+}
+
+// RunTopModule runs the top module: a live terminal dashboard of runs and tasks
+func RunTopModule(config *Config, args []string) {
+	parser := argparse.NewParser("annotask top", "Live terminal dashboard of runs and tasks")
+	opt_project := parser.String("p", "project", &argparse.Options{Help: "Only show runs of this project"})
+	opt_id := parser.String("k", "id", &argparse.Options{Help: "Show tasks of the run with this ID or run ID (from annotask stat -p)"})
+	opt_interval := parser.String("n", "interval", &argparse.Options{Default: "2s", Help: "Refresh interval"})
+
+	parseArgs := append([]string{"annotask"}, args...)
+	if err := parser.Parse(parseArgs); err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "help") {
+			printModuleHelp("top", config)
+			return
+		}
+		fmt.Print(parser.Usage(err))
+		os.Exit(1)
+	}
+
+	interval, err := parseDurationString(*opt_interval)
+	if err != nil || interval <= 0 {
+		log.Fatalf("Error parsing --interval value: %s", *opt_interval)
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		log.Fatalf("annotask top requires a terminal, use annotask stat instead")
+	}
+
+	globalDB, err := InitGlobalDB(config.Db)
+	if err != nil {
+		log.Fatalf("Failed to initialize global DB: %v", err)
+	}
+	defer globalDB.Db.Close()
+
+	state := &topState{
+		globalDB: globalDB,
+		usrID:    GetCurrentUserID(),
+		project:  *opt_project,
+		interval: interval,
+	}
+	if *opt_id != "" {
+		id, err := resolveRunRef(globalDB, state.usrID, *opt_id)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		run, err := loadRun(globalDB, state.usrID, id)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		state.run = run
+		state.fixedID = true
+	}
+
+	if err := runTopLoop(state); err != nil {
+		log.Fatalf("annotask top failed: %v", err)
+	}
+}
+
+// runTopLoop switches the terminal to raw mode and redraws the dashboard until the user quits
+func runTopLoop(state *topState) error {
+	fd := int(os.Stdin.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to set terminal raw mode: %v", err)
+	}
+	restore := func() {
+		fmt.Print(ansiShowCursor + ansiAltScreenOff)
+		term.Restore(fd, oldState)
+	}
+	defer restore()
+	fmt.Print(ansiAltScreenOn + ansiHideCursor)
+
+	keys := make(chan string, 16)
+	go readKeys(keys)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGWINCH)
+	defer signal.Stop(sigChan)
+
+	ticker := time.NewTicker(state.interval)
+	defer ticker.Stop()
+
+	state.refresh()
+	state.draw()
+	for {
+		select {
+		case key := <-keys:
+			if !state.handleKey(key) {
+				return nil
+			}
+			state.draw()
+		case <-ticker.C:
+			state.refresh()
+			state.draw()
+		case sig := <-sigChan:
+			if sig != syscall.SIGWINCH {
+				return nil
+			}
+			state.draw()
+		}
+	}
+}
+
+// readKeys reads key presses from stdin (in raw mode) and sends them as key names
+func readKeys(keys chan<- string) {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			keys <- keyQuit
+			return
+		}
+		input := string(buf[:n])
+		switch {
+		case input == "\033[A" || input == "k":
+			keys <- keyUp
+		case input == "\033[B" || input == "j":
+			keys <- keyDown
+		case input == "\033[5~":
+			keys <- keyPgUp
+		case input == "\033[6~" || input == " ":
+			keys <- keyPgDn
+		case input == "\r" || input == "\n":
+			keys <- keyEnter
+		case input == "\033" || input == "\x7f" || input == "b":
+			keys <- keyBack
+		case input == "q" || input == "\x03" || input == "\x04":
+			keys <- keyQuit
+		case input == "f":
+			keys <- keyFail
+		}
+	}
+}
+
+// refresh reloads runs or tasks from the databases
+func (s *topState) refresh() {
+	s.lastErr = ""
+	if s.run == nil {
+		runs, err := loadRuns(s.globalDB, s.usrID, s.project)
+		if err != nil {
+			s.lastErr = err.Error()
+			return
+		}
+		s.runs = runs
+		s.runSel = clampIndex(s.runSel, len(s.runs))
+		return
+	}
+
+	run, err := loadRun(s.globalDB, s.usrID, s.run.ID)
+	if err != nil {
+		s.lastErr = err.Error()
+		return
+	}
+	s.run = run
+	jobs, err := loadJobs(run.ShellPath)
+	if err != nil {
+		s.lastErr = err.Error()
+		s.jobs = nil
+		return
+	}
+	if s.failed {
+		var failedJobs []JobInfo
+		for _, job := range jobs {
+			if job.Status == string(J_failed) {
+				failedJobs = append(failedJobs, job)
+			}
+		}
+		jobs = failedJobs
+	}
+	s.jobs = jobs
+	s.jobSel = clampIndex(s.jobSel, len(s.jobs))
+}
+
+// handleKey applies a key press, returns false to quit
+func (s *topState) handleKey(key string) bool {
+	_, height := terminalSize()
+	page := height / 2
+	if page < 1 {
+		page = 1
+	}
+	moveSelection := func(sel *int, n, delta int) {
+		*sel = clampIndex(*sel+delta, n)
+	}
+
+	switch key {
+	case keyQuit:
+		return false
+	case keyUp, keyDown, keyPgUp, keyPgDn:
+		delta := map[string]int{keyUp: -1, keyDown: 1, keyPgUp: -page, keyPgDn: page}[key]
+		if s.run == nil {
+			moveSelection(&s.runSel, len(s.runs), delta)
+		} else {
+			moveSelection(&s.jobSel, len(s.jobs), delta)
+		}
+	case keyEnter:
+		if s.run == nil && s.runSel < len(s.runs) {
+			run := s.runs[s.runSel]
+			s.run = &run
+			s.jobSel = 0
+			s.refresh()
+		}
+	case keyBack:
+		if s.run != nil && !s.fixedID {
+			s.run = nil
+			s.jobs = nil
+			s.failed = false
+			s.refresh()
+		}
+	case keyFail:
+		if s.run != nil {
+			s.failed = !s.failed
+			s.jobSel = 0
+			s.refresh()
+		}
+	}
+	return true
+}
+
+// draw renders the current view
+func (s *topState) draw() {
+	width, height := terminalSize()
+	var lines []string
+	if s.run == nil {
+		lines = s.runListLines(width, height)
+	} else {
+		lines = s.runLines(width, height)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(ansiHome)
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		sb.WriteString(line)
+		sb.WriteString(ansiClearLine)
+		if i < height-1 && i < len(lines)-1 {
+			sb.WriteString("\r\n")
+		}
+	}
+	sb.WriteString(ansiClearToEnd)
+	fmt.Print(sb.String())
+}
+
+// header returns the title line and error line (if any)
+func (s *topState) header(width int, title, keysHelp string) []string {
+	lines := []string{
+		ansiBold + fitWidth(fmt.Sprintf("annotask top - %s    user: %s    %s", title, s.usrID, time.Now().Format("2006-01-02 15:04:05")), width) + ansiReset,
+		fitWidth(keysHelp, width),
+	}
+	if s.lastErr != "" {
+		lines = append(lines, ansiRed+fitWidth("Error: "+s.lastErr, width)+ansiReset)
+	}
+	return append(lines, "")
+}
+
+// runListLines renders the run list view
+func (s *topState) runListLines(width, height int) []string {
+	title := "all projects"
+	if s.project != "" {
+		title = "project " + s.project
+	}
+	lines := s.header(width, title, "[↑/↓] select  [enter] tasks  [q] quit")
+
+	lines = append(lines, ansiBold+fitWidth(fmt.Sprintf("%-6s %-16s %-20s %-8s %-10s %-28s %-11s %-7s %-6s %-10s",
+		"id", "project", "module", "mode", "status", "progress", "done/total", "running", "failed", "elapsed"), width)+ansiReset)
+
+	rowsAvailable := height - len(lines)
+	start, end := visibleRange(s.runSel, len(s.runs), rowsAvailable)
+	for i := start; i < end; i++ {
+		run := s.runs[i]
+		status := run.Status
+		if status == "" {
+			status = "-"
+		}
+		line := fitWidth(fmt.Sprintf("%-6d %-16s %-20s %-8s %-10s %-28s %-11s %-7d %-6d %-10s",
+			run.ID, truncate(run.Project, 16), truncate(run.Module, 20), run.Mode, status,
+			progressBar(run.Finished, run.Total, 20), fmt.Sprintf("%d/%d", run.Finished, run.Total),
+			run.Running, run.Failed, formatHRT(elapsedSince(run.StartTime, run.EndTime))), width)
+		lines = append(lines, s.colorize(line, i == s.runSel, run.Failed > 0, status == "completed"))
+	}
+	if len(s.runs) == 0 {
+		lines = append(lines, "No runs found")
+	}
+	return lines
+}
+
+// runLines renders the task view of the selected run, with the tail of the selected task's .e file
+func (s *topState) runLines(width, height int) []string {
+	run := s.run
+	keysHelp := "[↑/↓] select  [f] failed only  [b] back  [q] quit"
+	if s.fixedID {
+		keysHelp = "[↑/↓] select  [f] failed only  [q] quit"
+	}
+	lines := s.header(width, fmt.Sprintf("run %d  %s/%s", run.ID, run.Project, run.Module), keysHelp)
+	lines = append(lines,
+		fitWidth(fmt.Sprintf("%s  %d/%d finished  pending %d  running %d  failed %d  status %s  mode %s  elapsed %s",
+			progressBar(run.Finished, run.Total, 30), run.Finished, run.Total, run.Pending, run.Running, run.Failed,
+			run.Status, run.Mode, formatHRT(elapsedSince(run.StartTime, run.EndTime))), width),
+		fitWidth(run.ShellPath, width),
+		"",
+	)
+
+	lines = append(lines, ansiBold+fitWidth(fmt.Sprintf("%-6s %-9s %-6s %-16s %-10s %-5s %s",
+		"task", "status", "retry", "node", "elapsed", "exit", "reason"), width)+ansiReset)
+
+	// Task table takes about half of the remaining space, the rest shows the .e tail
+	remaining := height - len(lines)
+	tableRows := remaining / 2
+	if tableRows < 3 {
+		tableRows = remaining
+	}
+	start, end := visibleRange(s.jobSel, len(s.jobs), tableRows)
+	for i := start; i < end; i++ {
+		job := s.jobs[i]
+		node := job.Node
+		if node == "" {
+			node = run.Node
+		}
+		if node == "" {
+			node = "-"
+		}
+		exitCode := "-"
+		if job.ExitCode != nil && job.Status != string(J_pending) && job.Status != string(J_running) {
+			exitCode = fmt.Sprintf("%d", *job.ExitCode)
+		}
+		elapsed := "-"
+		if d := job.Elapsed(); d > 0 {
+			elapsed = formatHRT(d)
+		}
+		line := fitWidth(fmt.Sprintf("%-6d %-9s %-6d %-16s %-10s %-5s %s",
+			job.Num, job.Status, job.Retry, truncate(node, 16), elapsed, exitCode, job.Reason), width)
+		lines = append(lines, s.colorize(line, i == s.jobSel, job.Status == string(J_failed), job.Status == string(J_finished)))
+	}
+	if len(s.jobs) == 0 {
+		if s.failed {
+			lines = append(lines, "No failed tasks")
+		} else {
+			lines = append(lines, "No tasks found")
+		}
+	}
+	for len(lines) < height-remaining+tableRows && len(lines) < height {
+		lines = append(lines, "")
+	}
+
+	if s.jobSel < len(s.jobs) && len(lines) < height-2 {
+		job := s.jobs[s.jobSel]
+		_, errFile := job.LogFiles()
+		title := fitWidth(fmt.Sprintf("── task %d: %s ", job.Num, errFile), width)
+		if pad := width - len([]rune(title)); pad > 0 {
+			title += strings.Repeat("─", pad)
+		}
+		lines = append(lines, ansiBold+title+ansiReset)
+		for _, line := range tailFile(errFile, height-len(lines), 64*1024) {
+			lines = append(lines, fitWidth(sanitizeLine(line), width))
+		}
+	}
+	return lines
+}
+
+// colorize highlights the selected line and colors failed/finished lines
+func (s *topState) colorize(line string, selected, failed, finished bool) string {
+	switch {
+	case selected:
+		return ansiReverse + line + ansiReset
+	case failed:
+		return ansiRed + line + ansiReset
+	case finished:
+		return ansiGreen + line + ansiReset
+	}
+	return line
+}
+
+// terminalSize returns the terminal size, with a fallback of 80x24
+func terminalSize() (int, int) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// progressBar renders done/total as a bar of the given width followed by the percentage
+func progressBar(done, total, width int) string {
+	filled := 0
+	percent := 0
+	if total > 0 {
+		filled = done * width / total
+		percent = done * 100 / total
+	}
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat("-", width-filled), percent)
+}
+
+// visibleRange returns the range of rows to show so that the selected row stays visible
+func visibleRange(sel, n, rows int) (int, int) {
+	if rows <= 0 {
+		return 0, 0
+	}
+	start := 0
+	if sel >= rows {
+		start = sel - rows + 1
+	}
+	end := start + rows
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// clampIndex keeps a selection index within [0, n)
+func clampIndex(i, n int) int {
+	if i >= n {
+		i = n - 1
+	}
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string(r[:n])
+	}
+	return string(r[:n-1]) + "~"
+}
+
+// fitWidth cuts a line to the terminal width
+func fitWidth(s string, width int) string {
+	return truncate(s, width)
+}
+
+// sanitizeLine replaces tabs and drops control characters (e.g. colors in logs) that would break the layout
+func sanitizeLine(s string) string {
+	s = strings.ReplaceAll(s, "\t", "    ")
+	return strings.Map(func(r rune) rune {
+		if r < 32 || r == 127 {
+			return -1
+		}
+		return r
+	}, s)
+}
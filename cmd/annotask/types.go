@@ -72,6 +72,15 @@ type Config struct {
 	// Lower values provide more real-time updates but increase database load
 	// Higher values reduce database load but updates are less frequent
 	MonitorUpdateInterval int `yaml:"monitor_update_interval"`
+	// Notifications on run completion and task failures (command, email, webhooks)
+	Notify NotifyConfig `yaml:"notify,omitempty"`
+	// Shell hooks run before each task, after success and after failure
+	Hooks TaskHooks `yaml:"hooks,omitempty"`
+	// Admins may view runs of other users (stat --all-users / --user)
+	// Only read from system config (annotask.yaml in program directory), like sgeenv
+	Admins []string `yaml:"admins,omitempty"`
+	// Named resource settings selected with --profile (local/qsubsge)
+	Profiles map[string]Profile `yaml:"profiles,omitempty"`
 }
 
 // GlobalDB represents the global database connection
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// UsageSummary aggregates runs of one user, or of one project of a user
+type UsageSummary struct {
+	User         string
+	Project      string // Empty for the total of a user
+	Runs         int
+	Active       int // Runs with status running
+	RunningTasks int
+	PendingTasks int
+	FailedTasks  int
+	CPUHours     float64
+}
+
+// usageFields are the fields of stat --usage machine-readable output
+var usageFields = []outputField[UsageSummary]{
+	{"user", func(u *UsageSummary) interface{} { return u.User }},
+	{"project", func(u *UsageSummary) interface{} { return nullIfEmpty(u.Project) }},
+	{"runs", func(u *UsageSummary) interface{} { return u.Runs }},
+	{"active", func(u *UsageSummary) interface{} { return u.Active }},
+	{"running", func(u *UsageSummary) interface{} { return u.RunningTasks }},
+	{"pending", func(u *UsageSummary) interface{} { return u.PendingTasks }},
+	{"failed", func(u *UsageSummary) interface{} { return u.FailedTasks }},
+	{"cpuHours", func(u *UsageSummary) interface{} { return roundHours(u.CPUHours) }},
+}
+
+// isAdmin checks if a user is listed in admins of the system config
+func isAdmin(config *Config, usrID string) bool {
+	return containsString(config.Admins, usrID)
+}
+
+// recordTaskUsage adds the usage of one task attempt to the task's accumulated cpuTime (CPU-seconds)
+// and memTime (GB-seconds) in the local database
+// Called with write_pool held, like the other updates of the job table
+func recordTaskUsage(dbObj *MySql, N, cpu int, memGB float64, wall time.Duration) {
+	if wall <= 0 {
+		return
+	}
+	_, err := dbObj.Db.Exec("UPDATE job SET cpuTime=COALESCE(cpuTime, 0)+?, memTime=COALESCE(memTime, 0)+? WHERE subJob_num=?",
+		float64(cpu)*wall.Seconds(), memGB*wall.Seconds(), N)
+	if err != nil {
+		log.Printf("Warning: Could not record usage of task %d: %v", N, err)
+	}
+}
+
+// sgeAccountedMem returns the memory accounted for an SGE task attempt: the requested vf, else h_vmem,
+// else the peak virtual memory reported by SGE when no memory was requested
+func sgeAccountedMem(mem, h_vmem, maxvmemGB float64) float64 {
+	if mem > 0 {
+		return mem
+	}
+	if h_vmem > 0 {
+		return h_vmem
+	}
+	return maxvmemGB
+}
+
+// localTaskUsage returns the usage of the tasks of a local database (CPU-seconds, GB-seconds)
+func localTaskUsage(dbObj *MySql) (cpuSeconds, memSeconds float64, err error) {
+	err = dbObj.Db.QueryRow("SELECT COALESCE(SUM(cpuTime), 0), COALESCE(SUM(memTime), 0) FROM job").Scan(&cpuSeconds, &memSeconds)
+	return cpuSeconds, memSeconds, err
+}
+
+// UsageRecorder writes the usage of the current run to the global database
+// The local database accumulates usage over all runs of an input file, so the usage at start is subtracted
+// A nil *UsageRecorder does nothing
+type UsageRecorder struct {
+	globalDB                       *GlobalDB
+	runID                          string
+	baseCPUSeconds, baseMemSeconds float64
+}
+
+// runUsage is the usage recorder of the current run, set by runTasks
+var runUsage *UsageRecorder
+
+// NewUsageRecorder takes the usage recorded in the local database before the run starts
+func NewUsageRecorder(globalDB *GlobalDB, dbObj *MySql, runID string) (*UsageRecorder, error) {
+	cpuSeconds, memSeconds, err := localTaskUsage(dbObj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task usage: %v", err)
+	}
+	return &UsageRecorder{globalDB: globalDB, runID: runID, baseCPUSeconds: cpuSeconds, baseMemSeconds: memSeconds}, nil
+}
+
+// Update writes the usage of attempts completed since the run started
+func (r *UsageRecorder) Update(dbObj *MySql) {
+	if r == nil {
+		return
+	}
+	cpuSeconds, memSeconds, err := localTaskUsage(dbObj)
+	if err != nil {
+		log.Printf("Warning: Could not read task usage: %v", err)
+		return
+	}
+	cpuHours := math.Max(cpuSeconds-r.baseCPUSeconds, 0) / 3600
+	memHours := math.Max(memSeconds-r.baseMemSeconds, 0) / 3600
+	if err := UpdateGlobalTaskUsage(r.globalDB, r.runID, cpuHours, memHours); err != nil {
+		log.Printf("Warning: Could not update run usage: %v", err)
+	}
+}
+
+// summarizeUsage aggregates runs per user and per project of each user, both sorted by user and project
+func summarizeUsage(runs []RunInfo) (byUser, byProject []UsageSummary) {
+	users := make(map[string]*UsageSummary)
+	projects := make(map[[2]string]*UsageSummary)
+	for i := range runs {
+		run := &runs[i]
+		userKey := run.UsrID
+		if users[userKey] == nil {
+			users[userKey] = &UsageSummary{User: run.UsrID}
+		}
+		projectKey := [2]string{run.UsrID, run.Project}
+		if projects[projectKey] == nil {
+			projects[projectKey] = &UsageSummary{User: run.UsrID, Project: run.Project}
+		}
+		for _, u := range []*UsageSummary{users[userKey], projects[projectKey]} {
+			u.Runs++
+			if run.Status == "running" {
+				u.Active++
+			}
+			u.RunningTasks += run.Running
+			u.PendingTasks += run.Pending
+			u.FailedTasks += run.Failed
+			u.CPUHours += run.CPUHours
+		}
+	}
+
+	for _, u := range users {
+		byUser = append(byUser, *u)
+	}
+	for _, u := range projects {
+		byProject = append(byProject, *u)
+	}
+	sort.Slice(byUser, func(i, j int) bool { return byUser[i].User < byUser[j].User })
+	sort.Slice(byProject, func(i, j int) bool {
+		if byProject[i].User != byProject[j].User {
+			return byProject[i].User < byProject[j].User
+		}
+		return byProject[i].Project < byProject[j].Project
+	})
+	return byUser, byProject
+}
+
+// writeUsageTable writes per-user totals followed by the per-project breakdown
+func writeUsageTable(w io.Writer, byUser, byProject []UsageSummary) {
+	fmt.Fprintf(w, "%-16s %-6s %-7s %-9s %-9s %-8s %s\n", "user", "runs", "active", "running", "pending", "failed", "cpu_hours")
+	for _, u := range byUser {
+		fmt.Fprintf(w, "%-16s %-6d %-7d %-9d %-9d %-8d %.1f\n",
+			u.User, u.Runs, u.Active, u.RunningTasks, u.PendingTasks, u.FailedTasks, u.CPUHours)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%-16s %-28s %-6s %-7s %-9s %-9s %-8s %s\n", "user", "project", "runs", "active", "running", "pending", "failed", "cpu_hours")
+	for _, u := range byProject {
+		fmt.Fprintf(w, "%-16s %-28s %-6d %-7d %-9d %-9d %-8d %.1f\n",
+			u.User, u.Project, u.Runs, u.Active, u.RunningTasks, u.PendingTasks, u.FailedTasks, u.CPUHours)
+	}
+}
+
+// roundHours rounds hours to 2 decimals for machine-readable output
+func roundHours(h float64) float64 {
+	return float64(int64(h*100+0.5)) / 100
+}
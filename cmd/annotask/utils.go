@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -76,3 +78,43 @@ func formatTimeShort(timeStr string) string {
 	// If all parsing fails, return original string
 	return timeStr
 }
+
+// parseDurationString parses a wall-clock limit string and returns it as time.Duration
+// Supports formats: "3600" (seconds), "90m", "2h", "1h30m" (Go duration) and "HH:MM:SS" (SGE h_rt style)
+func parseDurationString(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty duration string")
+	}
+
+	// Plain number: seconds
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if seconds <= 0 {
+			return 0, fmt.Errorf("duration must be positive: %s", s)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	// HH:MM:SS (same format as SGE h_rt)
+	re := regexp.MustCompile(`^(\d+):(\d{1,2}):(\d{1,2})$`)
+	if matches := re.FindStringSubmatch(s); matches != nil {
+		hours, _ := strconv.Atoi(matches[1])
+		minutes, _ := strconv.Atoi(matches[2])
+		seconds, _ := strconv.Atoi(matches[3])
+		d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second
+		if d <= 0 {
+			return 0, fmt.Errorf("duration must be positive: %s", s)
+		}
+		return d, nil
+	}
+
+	// Go duration format: 90m, 2h, 1h30m
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration format: %s (expected format: seconds, Go duration like 90m/2h/1h30m, or HH:MM:SS)", s)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", s)
+	}
+	return d, nil
+}
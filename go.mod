@@ -9,6 +9,7 @@ require (
 	github.com/dgruber/drmaa v1.0.0
 	github.com/mattn/go-sqlite3 v1.14.28
 	golang.org/x/crypto v0.46.0
+	golang.org/x/term v0.38.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 